@@ -0,0 +1,184 @@
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CodedInternet/godynastat/onboard"
+	"time"
+)
+
+// FrameMode selects how the states sampled between two broadcasts to a client are combined.
+type FrameMode string
+
+const (
+	FRAME_LATEST  FrameMode = "latest"  // only the most recent state
+	FRAME_AVERAGE FrameMode = "average" // mean of each sensel
+	FRAME_PEAK    FrameMode = "peak"    // highest value of each sensel
+
+	// DEFAULT_BROADCAST_RATE is the rate in Hz states are sent to a client until it asks for another
+	DEFAULT_BROADCAST_RATE = onboard.FRAMERATE
+)
+
+// centreFinder finds the centres of pressure for combined sensor states as the device does for its own state.
+type centreFinder interface {
+	PressureCentres(sensors map[string]onboard.SensorState) onboard.PressureCentres
+}
+
+// frameAggregator combines the states sampled between broadcasts.
+// The centres of pressure are found again from the combined sensor values, the faults are those seen in any of the
+// states and the sensor samples count the frames combined. Everything else is taken from the latest state.
+type frameAggregator struct {
+	mode    FrameMode
+	state   onboard.DynastatState
+	sensors map[string]onboard.SensorState
+	faults  map[string][]onboard.SenselFault
+	samples map[string]onboard.Sample
+	count   int
+}
+
+// add includes a sampled state in the next broadcast.
+func (a *frameAggregator) add(state onboard.DynastatState) {
+	a.state = state
+	if a.mode == FRAME_LATEST {
+		a.count = 1
+		return
+	}
+
+	if a.count == 0 {
+		a.sensors = make(map[string]onboard.SensorState, len(state.Sensors))
+		a.faults = make(map[string][]onboard.SenselFault, len(state.Faults))
+		a.samples = make(map[string]onboard.Sample, len(state.SensorSamples))
+	}
+	for name, sensor := range state.Sensors {
+		acc, ok := a.sensors[name]
+		if !ok {
+			acc = make(onboard.SensorState, len(sensor))
+			for i, row := range sensor {
+				acc[i] = append([]float64(nil), row...)
+			}
+			a.sensors[name] = acc
+			continue
+		}
+
+		for i, row := range sensor {
+			for j, val := range row {
+				if a.mode == FRAME_PEAK {
+					if val > acc[i][j] {
+						acc[i][j] = val
+					}
+				} else {
+					acc[i][j] += val
+				}
+			}
+		}
+	}
+
+	for name, faults := range state.Faults {
+		for _, fault := range faults {
+			if !containsFault(a.faults[name], fault) {
+				a.faults[name] = append(a.faults[name], fault)
+			}
+		}
+	}
+
+	for name, sample := range state.SensorSamples {
+		prev, ok := a.samples[name]
+		sample.Frames = prev.Frames
+		if !ok || sample.Seq != prev.Seq {
+			// the same frame can be sampled again before the next one is read
+			sample.Frames++
+		}
+		a.samples[name] = sample
+	}
+	a.count++
+}
+
+// containsFault reports whether the fault is already in the list.
+func containsFault(faults []onboard.SenselFault, fault onboard.SenselFault) bool {
+	for _, f := range faults {
+		if f == fault {
+			return true
+		}
+	}
+	return false
+}
+
+// flush gives the combined state and starts again, ok is false if nothing has been sampled since the last flush.
+func (a *frameAggregator) flush(centres centreFinder) (state onboard.DynastatState, ok bool) {
+	if a.count == 0 {
+		return state, false
+	}
+
+	state = a.state
+	if a.mode != FRAME_LATEST {
+		if a.mode == FRAME_AVERAGE {
+			for _, acc := range a.sensors {
+				for _, row := range acc {
+					for j := range row {
+						row[j] /= float64(a.count)
+					}
+				}
+			}
+		}
+		state.Sensors = a.sensors
+		state.CoP = centres.PressureCentres(a.sensors)
+		state.SensorSamples = a.samples
+		state.Faults = nil
+		if len(a.faults) > 0 {
+			state.Faults = a.faults
+		}
+		a.sensors, a.faults, a.samples = nil, nil, nil
+	}
+
+	a.count = 0
+	return state, true
+}
+
+// SetBroadcast sets the rate in Hz states are sent to the client and how the samples between them are combined.
+func (client *WebRTCClient) SetBroadcast(rate int, mode FrameMode) error {
+	switch mode {
+	case "":
+		mode = FRAME_LATEST
+	case FRAME_LATEST, FRAME_AVERAGE, FRAME_PEAK:
+	default:
+		return errors.New(fmt.Sprintf("Unkown frame mode %s", mode))
+	}
+	if rate <= 0 || rate > onboard.MAX_SAMPLE_RATE {
+		return errors.New(fmt.Sprintf("Broadcast rate %d outside of 1-%d Hz", rate, onboard.MAX_SAMPLE_RATE))
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if mode != client.frames.mode {
+		// samples taken in the old mode cannot be combined with the new
+		client.frames = frameAggregator{mode: mode}
+	}
+	client.rate = rate
+	return nil
+}
+
+// sample adds the state to the next broadcast and gives the combined state once the client is due one.
+func (client *WebRTCClient) sample(state onboard.DynastatState, now time.Time, centres centreFinder) (onboard.DynastatState, bool) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.rate == 0 {
+		client.rate = DEFAULT_BROADCAST_RATE
+	}
+	if client.frames.mode == "" {
+		client.frames.mode = FRAME_LATEST
+	}
+
+	client.frames.add(state)
+	if now.Before(client.next) {
+		return state, false
+	}
+
+	interval := time.Second / time.Duration(client.rate)
+	client.next = client.next.Add(interval)
+	if client.next.Before(now) {
+		// do not try to catch up after falling behind
+		client.next = now.Add(interval)
+	}
+	return client.frames.flush(centres)
+}
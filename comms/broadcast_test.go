@@ -0,0 +1,101 @@
+package comms
+
+import (
+	"github.com/CodedInternet/godynastat/onboard"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func broadcastState(seq uint64, vals ...float64) onboard.DynastatState {
+	sensors := map[string]onboard.SensorState{"TestSensor": {vals}}
+	return onboard.DynastatState{
+		Seq:           seq,
+		Sensors:       sensors,
+		SensorSamples: map[string]onboard.Sample{"TestSensor": {Seq: seq}},
+		CoP:           new(mockDynastat).PressureCentres(sensors),
+	}
+}
+
+func TestFrameAggregator(t *testing.T) {
+	Convey("Combining the states between broadcasts", t, func() {
+		Convey("latest keeps only the last state", func() {
+			a := frameAggregator{mode: FRAME_LATEST}
+			a.add(broadcastState(1, 10, 0))
+			a.add(broadcastState(2, 20, 4))
+			state, ok := a.flush(new(mockDynastat))
+			So(ok, ShouldBeTrue)
+			So(state.Seq, ShouldEqual, 2)
+			So(state.Sensors["TestSensor"][0], ShouldResemble, []float64{20, 4})
+		})
+
+		Convey("average gives the mean of each sensel", func() {
+			a := frameAggregator{mode: FRAME_AVERAGE}
+			a.add(broadcastState(1, 10, 0))
+			a.add(broadcastState(2, 20, 4))
+			state, _ := a.flush(new(mockDynastat))
+			So(state.Seq, ShouldEqual, 2)
+			So(state.Sensors["TestSensor"][0], ShouldResemble, []float64{15, 2})
+
+			Convey("with everything derived from the sensors to match", func() {
+				So(state.CoP.Sensors["TestSensor"], ShouldResemble, state.Sensors["TestSensor"].CentreOfPressure())
+				So(state.SensorSamples["TestSensor"].Seq, ShouldEqual, 2)
+				So(state.SensorSamples["TestSensor"].Frames, ShouldEqual, 2)
+			})
+		})
+
+		Convey("peak holds the highest value of each sensel", func() {
+			a := frameAggregator{mode: FRAME_PEAK}
+			first := broadcastState(1, 30, 0)
+			a.add(first)
+			a.add(broadcastState(2, 20, 4))
+			state, _ := a.flush(new(mockDynastat))
+			So(state.Sensors["TestSensor"][0], ShouldResemble, []float64{30, 4})
+			So(first.Sensors["TestSensor"][0], ShouldResemble, []float64{30, 0})
+			So(state.CoP.Sensors["TestSensor"].Load, ShouldEqual, 34)
+		})
+
+		Convey("faults seen in any of the states are kept", func() {
+			a := frameAggregator{mode: FRAME_PEAK}
+			first := broadcastState(1, 10, 0)
+			first.Faults = map[string][]onboard.SenselFault{"TestSensor": {{Row: 0, Col: 1, Fault: onboard.FAULT_DEAD}}}
+			a.add(first)
+			second := broadcastState(1, 10, 0)
+			second.Faults = map[string][]onboard.SenselFault{"TestSensor": {{Row: 0, Col: 1, Fault: onboard.FAULT_DEAD}}}
+			a.add(second)
+			a.add(broadcastState(2, 20, 4))
+			state, _ := a.flush(new(mockDynastat))
+			So(state.Faults["TestSensor"], ShouldResemble, []onboard.SenselFault{{Row: 0, Col: 1, Fault: onboard.FAULT_DEAD}})
+			So(state.SensorSamples["TestSensor"].Frames, ShouldEqual, 2)
+		})
+
+		Convey("nothing is sent without a new sample", func() {
+			a := frameAggregator{mode: FRAME_AVERAGE}
+			a.add(broadcastState(1, 10, 0))
+			a.flush(new(mockDynastat))
+			_, ok := a.flush(new(mockDynastat))
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Clients are sent states at their own rate", t, func() {
+		client := new(WebRTCClient)
+		So(client.SetBroadcast(10, FRAME_PEAK), ShouldBeNil)
+		So(client.SetBroadcast(0, FRAME_PEAK), ShouldNotBeNil)
+		So(client.SetBroadcast(10, "median"), ShouldNotBeNil)
+
+		start := time.Now()
+		var sent []onboard.DynastatState
+		// sample at 100 Hz for half a second
+		for i := 0; i < 50; i++ {
+			state, ok := client.sample(broadcastState(uint64(i), float64(i%7)), start.Add(time.Duration(i)*10*time.Millisecond), new(mockDynastat))
+			if ok {
+				sent = append(sent, state)
+			}
+		}
+
+		So(sent, ShouldHaveLength, 5)
+		So(sent[1].Seq, ShouldEqual, 10)
+		So(sent[1].Sensors["TestSensor"][0][0], ShouldEqual, 6)
+	})
+}
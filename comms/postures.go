@@ -0,0 +1,171 @@
+package comms
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CodedInternet/godynastat/onboard"
+	"github.com/asdine/storm"
+	"math"
+	"strings"
+	"time"
+)
+
+// Posture is a named set of positions in the 0-255 application range for any of the motors, such as a neutral
+// posture or the final posture for a patient.
+type Posture struct {
+	ID        int    `storm:"increment"` // pk
+	Name      string `storm:"unique"`
+	Positions map[string]int
+	Created   time.Time
+	Updated   time.Time
+}
+
+// PostureLibrary stores postures in the database alongside the rest of the application data and moves the motors of
+// the device into them.
+type PostureLibrary struct {
+	db     *storm.DB
+	device onboard.DynastatInterface
+}
+
+var ErrPostureExists = errors.New("A posture with that name already exists")
+
+// ErrNoMotorsRead is returned when a posture is captured while none of the motors can be read.
+var ErrNoMotorsRead = errors.New("No motors could be read to capture")
+
+// InvalidPostureError is a posture which can not be stored as it was given, as opposed to a failure of the database.
+type InvalidPostureError string
+
+func (e InvalidPostureError) Error() string {
+	return string(e)
+}
+
+// NewPostureLibrary creates a posture library backed by the provided database for the motors of the device.
+func NewPostureLibrary(db *storm.DB, device onboard.DynastatInterface) (library *PostureLibrary, err error) {
+	if err = db.Init(&Posture{}); err != nil {
+		return nil, err
+	}
+
+	library = new(PostureLibrary)
+	library.db = db
+	library.device = device
+	return
+}
+
+// check makes sure the posture has a name and only positions the motors of the device within the application range.
+func (l *PostureLibrary) check(posture *Posture) error {
+	posture.Name = strings.TrimSpace(posture.Name)
+	if posture.Name == "" {
+		return InvalidPostureError("Posture must have a name")
+	}
+	if len(posture.Positions) == 0 {
+		return InvalidPostureError("Posture must position at least one motor")
+	}
+
+	motors := l.device.GetConfig().Motors
+	for name, position := range posture.Positions {
+		if _, ok := motors[name]; !ok {
+			return InvalidPostureError(fmt.Sprintf("Unkown motor %s", name))
+		}
+		if position < 0 || position > math.MaxUint8 {
+			return InvalidPostureError(fmt.Sprintf("Position %d of motor %s outside of 0-255", position, name))
+		}
+	}
+	return nil
+}
+
+// save writes the posture, reporting a name which is already taken as ErrPostureExists.
+func (l *PostureLibrary) save(posture *Posture) error {
+	err := l.db.Save(posture)
+	if err == storm.ErrAlreadyExists {
+		return ErrPostureExists
+	}
+	return err
+}
+
+// Postures lists every stored posture.
+func (l *PostureLibrary) Postures() (postures []Posture, err error) {
+	err = l.db.All(&postures)
+	return
+}
+
+// Posture fetches a single posture.
+func (l *PostureLibrary) Posture(id int) (posture Posture, err error) {
+	err = l.db.One("ID", id, &posture)
+	return
+}
+
+// Create stores a new posture.
+func (l *PostureLibrary) Create(name string, positions map[string]int) (posture *Posture, err error) {
+	posture = &Posture{Name: name, Positions: positions}
+	if err = l.check(posture); err != nil {
+		return nil, err
+	}
+
+	posture.Created = time.Now().UTC()
+	posture.Updated = posture.Created
+	if err = l.save(posture); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Update replaces the name and positions of a stored posture.
+func (l *PostureLibrary) Update(id int, name string, positions map[string]int) (posture *Posture, err error) {
+	stored, err := l.Posture(id)
+	if err != nil {
+		return nil, err
+	}
+
+	posture = &stored
+	posture.Name = name
+	posture.Positions = positions
+	if err = l.check(posture); err != nil {
+		return nil, err
+	}
+
+	posture.Updated = time.Now().UTC()
+	if err = l.save(posture); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Delete removes a stored posture.
+func (l *PostureLibrary) Delete(id int) error {
+	posture, err := l.Posture(id)
+	if err != nil {
+		return err
+	}
+	return l.db.DeleteStruct(&posture)
+}
+
+// Capture stores the current position of every motor on the device as a new posture.
+// Degraded motors are left out as their last position read may no longer be where they are.
+func (l *PostureLibrary) Capture(name string) (posture *Posture, err error) {
+	state, err := l.device.GetState()
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make(map[string]int, len(state.Motors))
+	for motor, ms := range state.Motors {
+		if state.MotorDegraded(motor) {
+			continue
+		}
+		// motors can overshoot the ends of the range slightly
+		positions[motor] = int(math.Max(0, math.Min(float64(ms.Current), math.MaxUint8)))
+	}
+	if len(positions) == 0 {
+		return nil, ErrNoMotorsRead
+	}
+	return l.Create(name, positions)
+}
+
+// Apply moves the motors of the device into a stored posture together. Zero tolerance and timeout use the defaults.
+func (l *PostureLibrary) Apply(id, tolerance int, timeout time.Duration) (*onboard.MotorMove, error) {
+	posture, err := l.Posture(id)
+	if err != nil {
+		return nil, err
+	}
+	return l.device.MoveMotors(posture.Positions, tolerance, timeout)
+}
@@ -0,0 +1,111 @@
+package comms
+
+import (
+	"github.com/CodedInternet/godynastat/onboard"
+	"github.com/asdine/storm"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostureLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postures")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := storm.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	dynastat := onboard.NewDynastatSimulator(&onboard.DynastatConfig{
+		Version: 2,
+		Motors:  map[string]onboard.MotorConfig{"left_heel": {}, "right_heel": {}},
+	})
+
+	library, err := NewPostureLibrary(db, dynastat)
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("Storing postures", t, func() {
+		posture, err := library.Create("Neutral", map[string]int{"left_heel": 128, "right_heel": 128})
+		So(err, ShouldBeNil)
+		So(posture.ID, ShouldBeGreaterThan, 0)
+		So(posture.Created, ShouldNotBeZeroValue)
+
+		Convey("it can be read back", func() {
+			stored, err := library.Posture(posture.ID)
+			So(err, ShouldBeNil)
+			So(stored.Name, ShouldEqual, "Neutral")
+			So(stored.Positions, ShouldResemble, posture.Positions)
+
+			postures, err := library.Postures()
+			So(err, ShouldBeNil)
+			So(postures, ShouldHaveLength, 1)
+		})
+
+		Convey("names are unique", func() {
+			_, err := library.Create("Neutral", map[string]int{"left_heel": 0})
+			So(err, ShouldEqual, ErrPostureExists)
+		})
+
+		Convey("only motors on the device can be positioned", func() {
+			_, err := library.Create("Missing", map[string]int{"missing": 0})
+			So(err, ShouldNotBeNil)
+			_, err = library.Create("Too high", map[string]int{"left_heel": 256})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("it can be updated to a subset of the motors", func() {
+			updated, err := library.Update(posture.ID, "Left raised", map[string]int{"left_heel": 200})
+			So(err, ShouldBeNil)
+			So(updated.Created, ShouldEqual, posture.Created)
+
+			stored, _ := library.Posture(posture.ID)
+			So(stored.Name, ShouldEqual, "Left raised")
+			So(stored.Positions, ShouldResemble, map[string]int{"left_heel": 200})
+		})
+
+		Convey("applying it moves the motors together", func() {
+			move, err := library.Apply(posture.ID, 0, 10*time.Second)
+			So(err, ShouldBeNil)
+			So(move.Progress().Targets, ShouldResemble, posture.Positions)
+			So(move.Wait().Status, ShouldEqual, onboard.MOVE_DONE)
+
+			Convey("and the result can be captured as a new posture", func() {
+				captured, err := library.Capture("Captured")
+				So(err, ShouldBeNil)
+				So(captured.Positions, ShouldHaveLength, 2)
+				So(captured.Positions["left_heel"], ShouldAlmostEqual, 128, onboard.DEFAULT_MOVE_TOLERANCE)
+			})
+		})
+
+		Reset(func() {
+			postures, _ := library.Postures()
+			for _, posture := range postures {
+				library.Delete(posture.ID)
+			}
+		})
+	})
+
+	Convey("Missing postures are not found", t, func() {
+		_, err := library.Posture(999)
+		So(err, ShouldEqual, storm.ErrNotFound)
+		So(library.Delete(999), ShouldEqual, storm.ErrNotFound)
+		_, err = library.Apply(999, 0, 0)
+		So(err, ShouldEqual, storm.ErrNotFound)
+	})
+	Convey("Nothing is captured without motors to read", t, func() {
+		empty, err := NewPostureLibrary(db, onboard.NewDynastatSimulator(&onboard.DynastatConfig{Version: 2}))
+		So(err, ShouldBeNil)
+		_, err = empty.Capture("Nothing")
+		So(err, ShouldEqual, ErrNoMotorsRead)
+	})
+}
@@ -0,0 +1,301 @@
+package comms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/CodedInternet/godynastat/onboard"
+	"github.com/asdine/storm"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// number of frames written to the database in a single transaction
+	recorderBatch = onboard.FRAMERATE
+	// number of frames loaded from the database at a time during replay
+	replayChunk = onboard.FRAMERATE * 10
+)
+
+// Session describes a single recording of device frames.
+// The frames themselves are stored in a node of their own so they can be read back in order and dropped in one go.
+type Session struct {
+	ID      int `storm:"increment"` // pk
+	Name    string
+	Started time.Time
+	Stopped time.Time
+	Frames  int
+}
+
+// Frame is a single DynastatState captured during a session.
+// Offset is the time since the start of the session.
+type Frame struct {
+	ID     int `storm:"increment"` // pk
+	Offset time.Duration
+	State  onboard.DynastatState
+}
+
+// Recorder captures frames into sessions stored in the database alongside the rest of the application data.
+type Recorder struct {
+	db      *storm.DB
+	session *Session
+	pending []Frame
+	lock    sync.Mutex
+}
+
+// Replay streams the frames of a stored session back in real time.
+type Replay struct {
+	Session Session
+	node    storm.Node
+	started time.Time
+	buffer  []Frame
+	pos     int
+	loaded  int
+	current Frame
+}
+
+var (
+	ErrRecording    = errors.New("A session is already being recorded")
+	ErrNotRecording = errors.New("No session is being recorded")
+)
+
+// NewRecorder creates a recorder backed by the provided database.
+func NewRecorder(db *storm.DB) (recorder *Recorder, err error) {
+	if err = db.Init(&Session{}); err != nil {
+		return nil, err
+	}
+
+	recorder = new(Recorder)
+	recorder.db = db
+	return
+}
+
+// sessionNode provides the node used to store the frames for a given session.
+func (r *Recorder) sessionNode(id int) storm.Node {
+	return r.db.From("sessions", fmt.Sprintf("%d", id))
+}
+
+// Start begins a new session. Only a single session may be recorded at a time.
+func (r *Recorder) Start(name string) (session *Session, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.session != nil {
+		return nil, ErrRecording
+	}
+
+	session = &Session{
+		Name:    name,
+		Started: time.Now().UTC(),
+	}
+	if err = r.db.Save(session); err != nil {
+		return nil, err
+	}
+
+	r.session = session
+	r.pending = make([]Frame, 0, recorderBatch)
+	return
+}
+
+// Stop finishes the current session, writing any outstanding frames to the database.
+func (r *Recorder) Stop() (session *Session, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.session == nil {
+		return nil, ErrNotRecording
+	}
+
+	session = r.session
+	r.session = nil
+
+	err = r.flush(session)
+	session.Stopped = time.Now().UTC()
+	if serr := r.db.Save(session); err == nil {
+		err = serr
+	}
+	return
+}
+
+// Recording reports if a session is currently being recorded.
+func (r *Recorder) Recording() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.session != nil
+}
+
+// Capture adds a frame to the current session. Frames are buffered and written in batches to keep the number of
+// database transactions down. Does nothing if no session is being recorded.
+func (r *Recorder) Capture(state onboard.DynastatState) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.session == nil {
+		return nil
+	}
+
+	r.pending = append(r.pending, Frame{
+		Offset: time.Since(r.session.Started),
+		State:  state,
+	})
+
+	if len(r.pending) < recorderBatch {
+		return nil
+	}
+	return r.flush(r.session)
+}
+
+// flush writes all pending frames to the database in a single transaction.
+// Must be called with the lock held.
+func (r *Recorder) flush(session *Session) (err error) {
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	tx, err := r.sessionNode(session.ID).Begin(true)
+	if err != nil {
+		return err
+	}
+
+	for i := range r.pending {
+		if err = tx.Save(&r.pending[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	session.Frames += len(r.pending)
+	r.pending = r.pending[:0]
+	return nil
+}
+
+// Sessions lists all of the stored sessions.
+func (r *Recorder) Sessions() (sessions []Session, err error) {
+	sessions = make([]Session, 0)
+	err = r.db.All(&sessions)
+	return
+}
+
+// Session gets a single stored session.
+func (r *Recorder) Session(id int) (session Session, err error) {
+	err = r.db.One("ID", id, &session)
+	return
+}
+
+// Frames gets a range of frames from a stored session in the order they were captured.
+func (r *Recorder) Frames(id, skip, limit int) (frames []Frame, err error) {
+	frames = make([]Frame, 0, limit)
+	err = r.sessionNode(id).All(&frames, storm.Skip(skip), storm.Limit(limit))
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// Delete removes a session and all of its frames.
+func (r *Recorder) Delete(id int) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.session != nil && r.session.ID == id {
+		return ErrRecording
+	}
+
+	var session Session
+	if err = r.db.One("ID", id, &session); err != nil {
+		return err
+	}
+
+	if err = r.sessionNode(id).Drop(&Frame{}); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return r.db.DeleteStruct(&session)
+}
+
+// Export writes the frames of a session to w as a session file of one JSON encoded onboard.SessionFrame per line,
+// which can be played back by the simulator away from the device.
+func (r *Recorder) Export(id int, w io.Writer) (err error) {
+	if _, err = r.Session(id); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	for skip := 0; ; skip += replayChunk {
+		frames, err := r.Frames(id, skip, replayChunk)
+		if err != nil {
+			return err
+		}
+		for _, frame := range frames {
+			if err = encoder.Encode(onboard.SessionFrame{Offset: frame.Offset, State: frame.State}); err != nil {
+				return err
+			}
+		}
+		if len(frames) < replayChunk {
+			return nil
+		}
+	}
+}
+
+// NewReplay prepares a stored session to be streamed back. The clock starts on the first call to Next.
+func (r *Recorder) NewReplay(id int) (replay *Replay, err error) {
+	replay = new(Replay)
+	if replay.Session, err = r.Session(id); err != nil {
+		return nil, err
+	}
+	replay.node = r.sessionNode(id)
+	return
+}
+
+// load fetches the next chunk of frames from the database.
+func (p *Replay) load() error {
+	frames := make([]Frame, 0, replayChunk)
+	err := p.node.All(&frames, storm.Skip(p.loaded), storm.Limit(replayChunk))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	p.buffer = frames
+	p.pos = 0
+	p.loaded += len(frames)
+	return nil
+}
+
+// Next provides the frame that should be shown at the current point in the replay.
+// done is set once the final frame of the session has been reached.
+func (p *Replay) Next() (state onboard.DynastatState, done bool, err error) {
+	if p.started.IsZero() {
+		if err = p.load(); err != nil {
+			return
+		}
+		if len(p.buffer) == 0 {
+			return state, true, nil
+		}
+		// line the clock up with the first frame so playback starts straight away
+		p.started = time.Now().Add(-p.buffer[0].Offset)
+	}
+	elapsed := time.Since(p.started)
+
+	for {
+		if p.pos >= len(p.buffer) {
+			if err = p.load(); err != nil {
+				return
+			}
+			if len(p.buffer) == 0 {
+				return p.current.State, true, nil
+			}
+		}
+
+		if p.buffer[p.pos].Offset > elapsed {
+			break
+		}
+		p.current = p.buffer[p.pos]
+		p.pos++
+	}
+
+	return p.current.State, false, nil
+}
@@ -0,0 +1,121 @@
+package comms
+
+import (
+	"bytes"
+	"github.com/CodedInternet/godynastat/onboard"
+	"github.com/asdine/storm"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := storm.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	recorder, err := NewRecorder(db)
+	if err != nil {
+		panic(err)
+	}
+
+	state := func(pos int) onboard.DynastatState {
+		return onboard.DynastatState{
+			Motors:  map[string]onboard.MotorState{"TestMotor": {Target: pos, Current: pos}},
+			Sensors: map[string]onboard.SensorState{"TestSensor": {{float64(pos)}}},
+		}
+	}
+
+	Convey("Recording a session stores every frame", t, func() {
+		So(recorder.Recording(), ShouldBeFalse)
+		So(recorder.Capture(state(0)), ShouldBeNil) // ignored while not recording
+
+		session, err := recorder.Start("test")
+		So(err, ShouldBeNil)
+		So(recorder.Recording(), ShouldBeTrue)
+
+		_, err = recorder.Start("again")
+		So(err, ShouldEqual, ErrRecording)
+
+		count := recorderBatch + 5
+		for i := 0; i < count; i++ {
+			So(recorder.Capture(state(i)), ShouldBeNil)
+		}
+
+		stopped, err := recorder.Stop()
+		So(err, ShouldBeNil)
+		So(stopped.ID, ShouldEqual, session.ID)
+		So(stopped.Frames, ShouldEqual, count)
+		So(recorder.Recording(), ShouldBeFalse)
+
+		Convey("Frames come back in order", func() {
+			frames, err := recorder.Frames(session.ID, 0, count)
+			So(err, ShouldBeNil)
+			So(frames, ShouldHaveLength, count)
+			for i, frame := range frames {
+				So(frame.State.Motors["TestMotor"].Target, ShouldEqual, i)
+			}
+		})
+
+		Convey("Session can be listed and fetched", func() {
+			sessions, err := recorder.Sessions()
+			So(err, ShouldBeNil)
+			So(sessions, ShouldNotBeEmpty)
+
+			stored, err := recorder.Session(session.ID)
+			So(err, ShouldBeNil)
+			So(stored.Name, ShouldEqual, "test")
+			So(stored.Frames, ShouldEqual, count)
+		})
+
+		Convey("Replay streams the frames back", func() {
+			replay, err := recorder.NewReplay(session.ID)
+			So(err, ShouldBeNil)
+
+			first, done, err := replay.Next()
+			So(err, ShouldBeNil)
+			So(done, ShouldBeFalse)
+			So(first.Motors, ShouldContainKey, "TestMotor")
+
+			// all of the frames were captured immediately so the whole session should be played by now
+			time.Sleep(time.Millisecond * 10)
+			for !done && err == nil {
+				first, done, err = replay.Next()
+			}
+			So(err, ShouldBeNil)
+			So(first.Motors["TestMotor"].Target, ShouldEqual, count-1)
+		})
+
+		Convey("Session can be exported for the simulator", func() {
+			var buf bytes.Buffer
+			So(recorder.Export(session.ID, &buf), ShouldBeNil)
+
+			frames, err := onboard.ReadSession(&buf)
+			So(err, ShouldBeNil)
+			So(frames, ShouldHaveLength, count)
+			So(frames[count-1].State.Motors["TestMotor"].Target, ShouldEqual, count-1)
+		})
+
+		Convey("Session can be deleted", func() {
+			So(recorder.Delete(session.ID), ShouldBeNil)
+			_, err := recorder.Session(session.ID)
+			So(err, ShouldEqual, storm.ErrNotFound)
+		})
+	})
+
+	Convey("Stopping without a session returns an error", t, func() {
+		_, err := recorder.Stop()
+		So(err, ShouldEqual, ErrNotRecording)
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/keroserene/go-webrtc"
 	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,18 +17,29 @@ type WebRTCClient struct {
 	pc        *webrtc.PeerConnection
 	tx, rx    *webrtc.DataChannel
 	conductor ConductorInterface
+	rate      int // Hz
+	frames    frameAggregator
+	next      time.Time
+	lock      sync.Mutex
 }
 
 type Cmd struct {
-	Cmd   string
-	Name  string
-	Value int
+	Cmd       string
+	Name      string
+	Value     int
+	Targets   map[string]int                   // motor positions for move_motors
+	Positions map[string]onboard.MotorPosition // physical motor positions for set_motor and move_motors
 }
 
 type Conductor struct {
 	Device           onboard.DynastatInterface
+	Recorder         *Recorder
+	Postures         *PostureLibrary
 	clients          []*WebRTCClient
 	signalingServers []*websocket.Conn
+	replay           *Replay
+	recorded         onboard.DynastatState // last state given to the recorder, only used by the update loop
+	lock             sync.Mutex
 }
 
 type ConductorInterface interface {
@@ -118,33 +130,148 @@ func (client *WebRTCClient) receiveMessage(msg []byte) {
 		client.rx.Send([]byte("Error: invalid json"))
 	}
 
+	// broadcast settings belong to the client rather than the device
+	switch cmd.Cmd {
+	case "set_broadcast":
+		if err := client.SetBroadcast(cmd.Value, FrameMode(cmd.Name)); err != nil {
+			client.rx.Send([]byte(fmt.Sprintf("Error: %v", err)))
+		}
+		return
+	}
+
 	client.conductor.ProcessCommand(cmd)
 }
 
 func (c *Conductor) ProcessCommand(cmd Cmd) {
 	switch cmd.Cmd {
 	case "set_motor":
-		c.Device.SetMotor(cmd.Name, cmd.Value)
+		var err error
+		if position, ok := cmd.Positions[cmd.Name]; ok {
+			err = c.Device.SetMotorPosition(cmd.Name, position)
+		} else {
+			err = c.Device.SetMotor(cmd.Name, cmd.Value)
+		}
+		if err != nil {
+			fmt.Printf("Unable to set motor: %v\n", err)
+		}
 		break
 
-	case "home_motor":
-		err := c.Device.HomeMotor(cmd.Name)
+	case "move_motors":
+		// physical positions are converted on the device and moved alongside any plain targets
+		targets, err := c.Device.MotorTargets(cmd.Positions)
 		if err != nil {
-			fmt.Errorf("%s\n", err)
+			fmt.Printf("Unable to move motors: %v\n", err)
+			break
+		}
+		for name, target := range cmd.Targets {
+			if _, ok := targets[name]; ok {
+				err = errors.New(fmt.Sprintf("Motor %s has both a target and a position", name))
+				break
+			}
+			targets[name] = target
+		}
+		if err != nil {
+			fmt.Printf("Unable to move motors: %v\n", err)
+			break
+		}
+		// clients follow the progress of the move in the device state
+		move, err := c.Device.MoveMotors(targets, cmd.Value, 0)
+		if err != nil {
+			fmt.Printf("Unable to move motors: %v\n", err)
+			break
+		}
+		go func() {
+			progress := move.Wait()
+			fmt.Printf("Move %d %s after %v\n", progress.ID, progress.Status, progress.Elapsed)
+		}()
+		break
+
+	case "apply_posture":
+		if c.Postures == nil {
+			fmt.Println("Unable to apply posture: no posture library available")
+			break
+		}
+		move, err := c.Postures.Apply(cmd.Value, 0, 0)
+		if err != nil {
+			fmt.Printf("Unable to apply posture %d: %v\n", cmd.Value, err)
+			break
+		}
+		go func() {
+			progress := move.Wait()
+			fmt.Printf("Posture %d %s after %v\n", cmd.Value, progress.Status, progress.Elapsed)
+		}()
+		break
+
+	case "home_motor":
+		if err := c.Device.HomeMotor(cmd.Name); err != nil {
+			fmt.Printf("Unable to home motor: %v\n", err)
 		}
 		break
 
 	case "motor_goto_raw":
-		c.Device.GotoMotorRaw(cmd.Name, cmd.Value)
+		if err := c.Device.GotoMotorRaw(cmd.Name, cmd.Value); err != nil {
+			fmt.Printf("Unable to move motor: %v\n", err)
+		}
 		break
 
 	case "motor_write_raw":
-		c.Device.WriteMotorRaw(cmd.Name, cmd.Value)
+		if err := c.Device.WriteMotorRaw(cmd.Name, cmd.Value); err != nil {
+			fmt.Printf("Unable to write motor position: %v\n", err)
+		}
 		break
 
 	case "motor_record_home":
 		reverse := cmd.Value != 0
-		c.Device.RecordMotorHome(cmd.Name, reverse)
+		if _, err := c.Device.RecordMotorHome(cmd.Name, reverse); err != nil {
+			fmt.Printf("Unable to record motor home: %v\n", err)
+		}
+		break
+
+	case "set_sensor_units":
+		if err := c.Device.SetSensorUnits(onboard.PressureUnit(cmd.Name)); err != nil {
+			fmt.Printf("Unable to set sensor units: %v\n", err)
+		}
+		break
+
+	case "tare":
+		if err := c.Device.Tare(); err != nil {
+			fmt.Printf("Unable to tare: %v\n", err)
+		}
+		break
+
+	case "record_start":
+		if c.Recorder == nil {
+			fmt.Println("Unable to record: no recorder available")
+			break
+		}
+		session, err := c.Recorder.Start(cmd.Name)
+		if err != nil {
+			fmt.Printf("Unable to start recording: %v\n", err)
+			break
+		}
+		fmt.Printf("Recording session %d %s\n", session.ID, session.Name)
+		break
+
+	case "record_stop":
+		if c.Recorder == nil {
+			break
+		}
+		session, err := c.Recorder.Stop()
+		if err != nil {
+			fmt.Printf("Unable to stop recording: %v\n", err)
+			break
+		}
+		fmt.Printf("Recorded %d frames to session %d\n", session.Frames, session.ID)
+		break
+
+	case "replay_start":
+		if err := c.StartReplay(cmd.Value); err != nil {
+			fmt.Printf("Unable to replay session %d: %v\n", cmd.Value, err)
+		}
+		break
+
+	case "replay_stop":
+		c.StopReplay()
 		break
 
 		//case "persist_config":
@@ -158,29 +285,110 @@ func (c *Conductor) ProcessCommand(cmd Cmd) {
 	}
 }
 
+// StartReplay streams a stored session to the clients in place of the live device state.
+func (c *Conductor) StartReplay(id int) error {
+	if c.Recorder == nil {
+		return errors.New("No recorder available")
+	}
+
+	replay, err := c.Recorder.NewReplay(id)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.replay = replay
+	c.lock.Unlock()
+	return nil
+}
+
+// StopReplay returns the clients to the live device state.
+func (c *Conductor) StopReplay() {
+	c.lock.Lock()
+	c.replay = nil
+	c.lock.Unlock()
+}
+
+// nextState provides the state to be sent to clients, either from the device or from the replay in progress.
+// Live states are passed on to the recorder.
+func (c *Conductor) nextState() (state onboard.DynastatState, err error) {
+	c.lock.Lock()
+	replay := c.replay
+	c.lock.Unlock()
+
+	if replay != nil {
+		state, done, err := replay.Next()
+		if err == nil {
+			if done {
+				c.StopReplay()
+			}
+			return state, nil
+		}
+		// fall back to the live state rather than taking down the update loop
+		fmt.Printf("Unable to replay session %d: %v\n", replay.Session.ID, err)
+		c.StopReplay()
+	}
+
+	state, err = c.Device.GetState()
+	// the device is sampled faster than it is read, only new readings are recorded so the size of a recording does
+	// not depend on the sample rate
+	if err == nil && c.Recorder != nil && newReadings(c.recorded, state) {
+		c.recorded = state
+		if rerr := c.Recorder.Capture(state); rerr != nil {
+			fmt.Printf("Unable to record frame: %v\n", rerr)
+		}
+	}
+	return
+}
+
+// newReadings reports whether any sensor or motor has been read again between two states.
+func newReadings(prev, next onboard.DynastatState) bool {
+	for name, sample := range next.SensorSamples {
+		if old, ok := prev.SensorSamples[name]; !ok || old.Seq != sample.Seq {
+			return true
+		}
+	}
+	for name, sample := range next.MotorSamples {
+		if old, ok := prev.MotorSamples[name]; !ok || old.Seq != sample.Seq {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateClients samples the device as fast as its sensor boards are read and sends each client the samples combined
+// at the rate the client has asked for. The motors are read at their own slower rate and repeated in between.
 func (c *Conductor) UpdateClients() {
-	for {
-		state, err := c.Device.GetState()
+	ticker := time.NewTicker(time.Second / time.Duration(c.Device.SampleRate()))
+	for now := range ticker.C {
+		state, err := c.nextState()
 		if err != nil {
 			switch err {
 			case io.EOF:
 				fmt.Println("Recieved EOF, continuing")
 				continue
 			default:
-				panic(err)
+				// failing hardware is reported in the state, anything else is skipped until the next tick
+				fmt.Printf("Unable to get state: %v\n", err)
+				continue
 			}
 		}
-		msg, err := json.Marshal(state)
-		if err != nil {
-			panic(err)
-		}
+
 		for _, client := range c.clients {
-			if client.tx != nil && client.tx.ReadyState() == webrtc.DataStateOpen {
-				client.tx.SendText(string(msg))
+			if client.tx == nil || client.tx.ReadyState() != webrtc.DataStateOpen {
+				continue
 			}
-		}
 
-		time.Sleep(time.Second / onboard.FRAMERATE)
+			frame, ok := client.sample(state, now, c.Device)
+			if !ok {
+				continue
+			}
+			msg, err := json.Marshal(frame)
+			if err != nil {
+				panic(err)
+			}
+			client.tx.SendText(string(msg))
+		}
 	}
 }
 
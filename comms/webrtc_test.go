@@ -2,6 +2,7 @@ package comms
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/keroserene/go-webrtc"
 	. "github.com/smartystreets/goconvey/convey"
 	"testing"
@@ -52,11 +53,59 @@ func (d *mockDynastat) GetConfig() *onboard.DynastatConfig {
 	panic("[NotImplemented]")
 }
 
+func (d *mockDynastat) MarshalConfig() ([]byte, error) {
+	panic("[NotImplemented]")
+}
+
+func (d *mockDynastat) PlateCoordinate(name string, row, col int) (onboard.Point, error) {
+	panic("[NotImplemented]")
+}
+
+func (d *mockDynastat) NewSensorCalibrator(name string, kind onboard.CurveType, degree int, area float64) (*onboard.SensorCalibrator, error) {
+	panic("[NotImplemented]")
+}
+
+func (d *mockDynastat) SetSensorUnits(units onboard.PressureUnit) error {
+	d.lastCmd = &Cmd{
+		"set_sensor_units",
+		string(units),
+		0,
+		nil,
+		nil,
+	}
+	return nil
+}
+
+func (d *mockDynastat) Tare() error {
+	d.lastCmd = &Cmd{
+		"tare",
+		"",
+		0,
+		nil,
+		nil,
+	}
+	return nil
+}
+
+func (d *mockDynastat) PressureCentres(sensors map[string]onboard.SensorState) (result onboard.PressureCentres) {
+	result.Sensors = make(map[string]onboard.CentreOfPressure, len(sensors))
+	for name, state := range sensors {
+		result.Sensors[name] = state.CentreOfPressure()
+	}
+	return
+}
+
+func (d *mockDynastat) SampleRate() int {
+	return onboard.FRAMERATE
+}
+
 func (d *mockDynastat) SetMotor(name string, position int) (err error) {
 	d.lastCmd = &Cmd{
 		"set_motor",
 		name,
 		position,
+		nil,
+		nil,
 	}
 	return nil
 }
@@ -66,6 +115,8 @@ func (d *mockDynastat) HomeMotor(name string) error {
 		"home_motor",
 		name,
 		0,
+		nil,
+		nil,
 	}
 	return nil
 }
@@ -75,6 +126,8 @@ func (d *mockDynastat) GotoMotorRaw(name string, position int) error {
 		"motor_goto_raw",
 		name,
 		position,
+		nil,
+		nil,
 	}
 	return nil
 }
@@ -95,6 +148,36 @@ func (d *mockDynastat) RecordMotorHome(name string, reverse bool) (pos int, err
 	panic("[NotImplemented]")
 }
 
+func (d *mockDynastat) MoveMotors(targets map[string]int, tolerance int, timeout time.Duration) (*onboard.MotorMove, error) {
+	d.lastCmd = &Cmd{
+		"move_motors",
+		"",
+		tolerance,
+		targets,
+		nil,
+	}
+	return nil, errors.New("motors are mocked")
+}
+
+func (d *mockDynastat) SetMotorPosition(name string, position onboard.MotorPosition) error {
+	d.lastCmd = &Cmd{
+		"set_motor",
+		name,
+		0,
+		nil,
+		map[string]onboard.MotorPosition{name: position},
+	}
+	return nil
+}
+
+func (d *mockDynastat) MotorTargets(positions map[string]onboard.MotorPosition) (map[string]int, error) {
+	targets := make(map[string]int, len(positions))
+	for name, position := range positions {
+		targets[name] = int(position.Value)
+	}
+	return targets, nil
+}
+
 func TestWebRTCClient(t *testing.T) {
 	var err error
 	// Build our remote party
@@ -311,5 +394,67 @@ func TestConductor(t *testing.T) {
 		cmd.Value = 0 // hard coded in mockDynastat, change for test
 		So(device.lastCmd, ShouldResemble, cmd)
 		cmd.Value = 123 // reset back in case we use it again later
+
+		device.lastCmd = nil
+		cmd.Cmd = "set_sensor_units"
+		cmd.Name = string(onboard.UNIT_KPA)
+		conductor.ProcessCommand(*cmd)
+		cmd.Value = 0
+		So(device.lastCmd, ShouldResemble, cmd)
+
+		device.lastCmd = nil
+		cmd.Cmd = "move_motors"
+		cmd.Name = ""
+		cmd.Value = 2
+		cmd.Targets = map[string]int{"TEST MOTOR": 42}
+		conductor.ProcessCommand(*cmd)
+		So(device.lastCmd, ShouldResemble, cmd)
+
+		// a motor can not be given both a target and a position
+		device.lastCmd = nil
+		cmd.Positions = map[string]onboard.MotorPosition{"TEST MOTOR": {Value: 12.5, Unit: "deg"}}
+		conductor.ProcessCommand(*cmd)
+		So(device.lastCmd, ShouldBeNil)
+		cmd.Value = 0
+		cmd.Targets = nil
+		cmd.Positions = nil
+
+		device.lastCmd = nil
+		cmd.Cmd = "set_motor"
+		cmd.Name = "TEST MOTOR"
+		cmd.Positions = map[string]onboard.MotorPosition{"TEST MOTOR": {Value: 12.5, Unit: "deg"}}
+		conductor.ProcessCommand(*cmd)
+		So(device.lastCmd, ShouldResemble, cmd)
+		cmd.Positions = nil
+
+		device.lastCmd = nil
+		cmd.Cmd = "tare"
+		cmd.Name = ""
+		conductor.ProcessCommand(*cmd)
+		So(device.lastCmd, ShouldResemble, cmd)
+	})
+}
+
+func TestNewReadings(t *testing.T) {
+	Convey("Only states with new readings are recorded", t, func() {
+		first := onboard.DynastatState{
+			SensorSamples: map[string]onboard.Sample{"TestSensor": {Seq: 1}},
+			MotorSamples:  map[string]onboard.Sample{"TestMotor": {Seq: 1}},
+		}
+		So(newReadings(onboard.DynastatState{}, first), ShouldBeTrue)
+
+		again := onboard.DynastatState{
+			Seq:           2,
+			SensorSamples: map[string]onboard.Sample{"TestSensor": {Seq: 1}},
+			MotorSamples:  map[string]onboard.Sample{"TestMotor": {Seq: 1}},
+		}
+		So(newReadings(first, again), ShouldBeFalse)
+
+		again.SensorSamples["TestSensor"] = onboard.Sample{Seq: 2}
+		So(newReadings(first, again), ShouldBeTrue)
+
+		again.SensorSamples["TestSensor"] = onboard.Sample{Seq: 1}
+		again.MotorSamples["TestMotor"] = onboard.Sample{Seq: 2}
+		So(newReadings(first, again), ShouldBeTrue)
 	})
 }
@@ -15,11 +15,13 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type EnvConfig struct {
@@ -29,6 +31,7 @@ type EnvConfig struct {
 	SRCDIR       string `env:"SRCDIR" envDefault:"."`
 	HTMLDIR      string `env:"HTMLDIR" envDefault:"./frontend/dist/"`
 	DB           *storm.DB
+	ConfigFile   string
 	Conductor    *comms.Conductor
 	Simulated    bool
 	TwilioClient *comms.TwilioClient
@@ -76,6 +79,11 @@ func main() {
 
 	// process flags
 	simulated := flag.Bool("sim", false, "Run the device in simulator mode)")
+	simMode := flag.String("sim-mode", "emulated", "Simulator to run with -sim: emulated hardware behind the real drivers (linux only, objects elsewhere), simulated objects, or replay")
+	replayFile := flag.String("replay", "", "Session file to play back with -sim-mode replay")
+	replayLoop := flag.Bool("replay-loop", false, "Start the replay again from the beginning once the end is reached")
+	replaySpeed := flag.Float64("replay-speed", 1, "Multiple of the recorded speed to play the replay at")
+	replaySeek := flag.Duration("replay-seek", 0, "Position in the session to start the replay from")
 	port := flag.String("port", "0.0.0.0:80", "Specify the ip:port to listen on")
 	flag.Parse()
 
@@ -103,6 +111,7 @@ func main() {
 			panic(err)
 		}
 	}
+	ENV.ConfigFile = filename
 	yamlFile, err := ioutil.ReadFile(filename)
 
 	if err != nil {
@@ -122,11 +131,43 @@ func main() {
 
 	// create an appropriate Twilio client
 	var dynastat *Dynastat
+	var player *SessionPlayer
 
 	ENV.Simulated = *simulated
 	if ENV.Simulated {
-		println("Creating simulator")
-		dynastat = NewDynastatSimulator(&config)
+		if *simMode == "emulated" && !EMULATOR_AVAILABLE {
+			println("Emulated hardware is not available on this platform, using simulated objects")
+			*simMode = "objects"
+		}
+		switch *simMode {
+		case "objects":
+			println("Creating simulator")
+			dynastat = NewDynastatSimulator(&config)
+		case "emulated":
+			println("Creating emulated hardware")
+			var emulator *DeviceEmulator
+			dynastat, emulator, err = NewEmulatedDynastat(&config)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to emulate dynastat: %v", err))
+			}
+			defer emulator.Close()
+		case "replay":
+			println("Replaying session", *replayFile)
+			frames, err := ReadSessionFile(*replayFile)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to read session: %v", err))
+			}
+			player, err = NewSessionPlayer(frames, ReplayConfig{Loop: *replayLoop, Speed: *replaySpeed, Seek: *replaySeek})
+			if err != nil {
+				panic(fmt.Sprintf("Unable to replay session: %v", err))
+			}
+			dynastat, err = NewDynastatReplay(&config, player)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to replay dynastat: %v", err))
+			}
+		default:
+			panic(fmt.Sprintf("Unkown simulator mode %s", *simMode))
+		}
 	} else {
 		dynastat, err = NewDynastat(&config)
 		if err != nil {
@@ -136,6 +177,14 @@ func main() {
 
 	ENV.Conductor = new(comms.Conductor)
 	ENV.Conductor.Device = dynastat
+	ENV.Conductor.Recorder, err = comms.NewRecorder(ENV.DB)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to create recorder: %v", err))
+	}
+	ENV.Conductor.Postures, err = comms.NewPostureLibrary(ENV.DB, dynastat)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to create posture library: %v", err))
+	}
 
 	go ENV.Conductor.UpdateClients()
 
@@ -151,6 +200,14 @@ func main() {
 			return keys
 		}
 
+		sensorNames := func([]string) []string {
+			keys := make([]string, 0, len(dynastat.GetConfig().Sensors))
+			for k := range dynastat.GetConfig().Sensors {
+				keys = append(keys, k)
+			}
+			return keys
+		}
+
 		shell := ishell.New()
 		shell.Println("Dynastat development shell")
 		shell.ShowPrompt(true)
@@ -208,6 +265,61 @@ func main() {
 				dynastat.SetMotor(name, position)
 			},
 		})
+		shell.AddCmd(&ishell.Cmd{
+			Name:      "moveall",
+			Completer: motorNames,
+			Help:      "moveall <Motor>=<position (0-255)>... - moves the motors together and waits for them to arrive",
+			Func: func(c *ishell.Context) {
+				targets := make(map[string]int, len(c.Args))
+				for _, arg := range c.Args {
+					parts := strings.SplitN(arg, "=", 2)
+					if len(parts) != 2 {
+						c.Err(errors.New(fmt.Sprintf("Invalid target %s", arg)))
+						return
+					}
+					position, err := strconv.Atoi(parts[1])
+					if err != nil {
+						c.Err(errors.New(fmt.Sprintf("Invalid position for %s", parts[0])))
+						return
+					}
+					targets[parts[0]] = position
+				}
+
+				move, err := dynastat.MoveMotors(targets, 0, 0)
+				if err != nil {
+					c.Err(err)
+					return
+				}
+				progress := move.Wait()
+				c.Printf("Move %s after %v %s\n", progress.Status, progress.Elapsed, progress.Error)
+			},
+		})
+		shell.AddCmd(&ishell.Cmd{
+			Name:      "moveto",
+			Completer: motorNames,
+			Help:      "moveto <Motor> <position> <unit, e.g. deg or mm>",
+			Func: func(c *ishell.Context) {
+				if len(c.Args) != 3 {
+					c.Err(errors.New("Motor, position and unit required"))
+					return
+				}
+				value, err := strconv.ParseFloat(c.Args[1], 64)
+				if err != nil {
+					c.Err(errors.New(fmt.Sprintf("Invalid position %s", c.Args[1])))
+					return
+				}
+				position := MotorPosition{Value: value, Unit: c.Args[2]}
+				target, err := dynastat.MotorFromUnits(c.Args[0], position)
+				if err != nil {
+					c.Err(err)
+					return
+				}
+				c.Printf("Moving Motor %s to %v %s (%d)\n", c.Args[0], value, position.Unit, target)
+				if err = dynastat.SetMotor(c.Args[0], target); err != nil {
+					c.Err(err)
+				}
+			},
+		})
 		shell.AddCmd(&ishell.Cmd{
 			Name:      "home",
 			Completer: motorNames,
@@ -222,6 +334,58 @@ func main() {
 				}
 			},
 		})
+		shell.AddCmd(&ishell.Cmd{
+			Name: "tare",
+			Help: "tare [clear] - zero the sensor boards with the plate unloaded, or clear the tare",
+			Func: func(c *ishell.Context) {
+				if len(c.Args) > 0 && c.Args[0] == "clear" {
+					dynastat.ClearTare()
+					c.Println("Tare cleared")
+					return
+				}
+
+				c.Println("Taring sensor boards, keep the plate unloaded")
+				if err := dynastat.Tare(); err != nil {
+					c.Err(err)
+					return
+				}
+				c.Println("Tare complete")
+			},
+		})
+		shell.AddCmd(&ishell.Cmd{
+			Name: "faults",
+			Help: "Lists the faulty sensels found by the diagnostics",
+			Func: func(c *ishell.Context) {
+				state, err := dynastat.GetState()
+				if err != nil {
+					c.Err(err)
+					return
+				}
+				if len(state.Faults) == 0 {
+					c.Println("No faulty sensels found")
+					return
+				}
+				for name, faults := range state.Faults {
+					for _, f := range faults {
+						c.Printf("%s (%d, %d) %s\n", name, f.Row, f.Col, f.Fault)
+					}
+				}
+			},
+		})
+		shell.AddCmd(&ishell.Cmd{
+			Name: "hardware",
+			Help: "Lists the hardware which is failing",
+			Func: func(c *ishell.Context) {
+				degraded := dynastat.Degraded()
+				if len(degraded) == 0 {
+					c.Println("All hardware responding")
+					return
+				}
+				for component, err := range degraded {
+					c.Printf("%s: %s\n", component, err)
+				}
+			},
+		})
 		shell.AddCmd(&ishell.Cmd{
 			Name: "state",
 			Help: "Reads the current state of the device",
@@ -235,8 +399,15 @@ func main() {
 		shell.AddCmd(&ishell.Cmd{
 			Name: "control",
 			Func: func(c *ishell.Context) {
+				if dynastat.SensorBus == nil {
+					c.Err(errors.New("Sensor bus is not available"))
+					return
+				}
 				buf := make([]byte, 2)
-				dynastat.SensorBus.Get(0x20, 3, buf)
+				if err := dynastat.SensorBus.Get(0x20, 3, buf); err != nil {
+					c.Err(err)
+					return
+				}
 				val := binary.LittleEndian.Uint16(buf)
 				c.Printf("0x%X\n", val)
 
@@ -246,6 +417,128 @@ func main() {
 			},
 		})
 
+		if player != nil {
+			// Replay specific commands
+			replayCmd := &ishell.Cmd{
+				Name: "replay",
+				Help: "Shows where the replay is in the session",
+				Func: func(c *ishell.Context) {
+					c.Printf("%v of %v at %vx, loop %v\n", player.Position(), player.Duration(), player.Speed(), player.Loop())
+				},
+			}
+
+			replayCmd.AddCmd(&ishell.Cmd{
+				Name: "seek",
+				Help: "seek <position, e.g. 1m30s>",
+				Func: func(c *ishell.Context) {
+					if len(c.Args) != 1 {
+						c.Err(errors.New("Position required"))
+						return
+					}
+					offset, err := time.ParseDuration(c.Args[0])
+					if err == nil {
+						err = player.Seek(offset)
+					}
+					if err != nil {
+						c.Err(err)
+					}
+				},
+			})
+
+			replayCmd.AddCmd(&ishell.Cmd{
+				Name: "speed",
+				Help: "speed <multiple of the recorded speed>",
+				Func: func(c *ishell.Context) {
+					if len(c.Args) != 1 {
+						c.Err(errors.New("Speed required"))
+						return
+					}
+					speed, err := strconv.ParseFloat(c.Args[0], 64)
+					if err == nil {
+						err = player.SetSpeed(speed)
+					}
+					if err != nil {
+						c.Err(err)
+					}
+				},
+			})
+
+			replayCmd.AddCmd(&ishell.Cmd{
+				Name: "loop",
+				Help: "loop <on|off>",
+				Func: func(c *ishell.Context) {
+					if len(c.Args) != 1 || (c.Args[0] != "on" && c.Args[0] != "off") {
+						c.Err(errors.New("loop on or loop off"))
+						return
+					}
+					player.SetLoop(c.Args[0] == "on")
+				},
+			})
+
+			shell.AddCmd(replayCmd)
+		}
+
+		{
+			// Posture library commands
+			postures := ENV.Conductor.Postures
+			postureCmd := &ishell.Cmd{
+				Name: "posture",
+				Help: "Lists the stored postures",
+				Func: func(c *ishell.Context) {
+					list, err := postures.Postures()
+					if err != nil {
+						c.Err(err)
+						return
+					}
+					for _, posture := range list {
+						c.Printf("%d %s %v\n", posture.ID, posture.Name, posture.Positions)
+					}
+				},
+			}
+
+			postureCmd.AddCmd(&ishell.Cmd{
+				Name: "apply",
+				Help: "apply <id> - moves the motors into the posture and waits for them to arrive",
+				Func: func(c *ishell.Context) {
+					if len(c.Args) != 1 {
+						c.Err(errors.New("Posture id required"))
+						return
+					}
+					id, err := strconv.Atoi(c.Args[0])
+					if err != nil {
+						c.Err(errors.New("Invalid posture id"))
+						return
+					}
+					move, err := postures.Apply(id, 0, 0)
+					if err != nil {
+						c.Err(err)
+						return
+					}
+					progress := move.Wait()
+					c.Printf("Move %s after %v %s\n", progress.Status, progress.Elapsed, progress.Error)
+				},
+			})
+
+			postureCmd.AddCmd(&ishell.Cmd{
+				Name: "capture",
+				Help: "capture <name> - stores the current motor positions as a posture",
+				Func: func(c *ishell.Context) {
+					if len(c.Args) == 0 {
+						c.Err(errors.New("Posture name required"))
+						return
+					}
+					posture, err := postures.Capture(strings.Join(c.Args, " "))
+					if err != nil {
+						c.Err(err)
+						return
+					}
+					c.Printf("Captured posture %d %s\n", posture.ID, posture.Name)
+				},
+			})
+
+			shell.AddCmd(postureCmd)
+		}
+
 		{
 			// Calibration specific commands
 			calCmd := &ishell.Cmd{
@@ -321,12 +614,181 @@ func main() {
 				},
 			})
 
+			calCmd.AddCmd(&ishell.Cmd{
+				Name:      "equalise",
+				Help:      "Build the per sensel equalisation for a sensor using a uniform load",
+				Completer: sensorNames,
+				Func: func(c *ishell.Context) {
+					if len(c.Args) != 1 {
+						c.Err(errors.New("Incorrect number of arguments. Usage: cal equalise <sensor_name>"))
+						return
+					}
+					name := c.Args[0]
+
+					equaliser, err := dynastat.NewEqualiser(name)
+					if err != nil {
+						c.Err(err)
+						return
+					}
+
+					c.ShowPrompt(false)
+					defer c.ShowPrompt(true)
+
+					c.Print("Remove all load from the sensor then press enter")
+					c.ReadLine()
+					equaliser.CaptureUnloaded()
+
+					c.Print("Apply a uniform load across the whole sensor then press enter")
+					c.ReadLine()
+					eq, err := equaliser.CaptureLoaded()
+					if err != nil {
+						c.Err(err)
+						return
+					}
+
+					min, max := eq.Gain[0][0], eq.Gain[0][0]
+					for _, row := range eq.Gain {
+						for _, gain := range row {
+							min = math.Min(min, gain)
+							max = math.Max(max, gain)
+						}
+					}
+					c.Printf("Sensor %s equalised, gain %.2f to %.2f. Use cal commit to save.\n", name, min, max)
+				},
+			})
+
+			calCmd.AddCmd(&ishell.Cmd{
+				Name:      "curve",
+				Help:      "Fit a calibration curve to a sensor. Usage: cal curve <sensor_name> <piecewise|polynomial[:degree]> <counts:kpa>...",
+				Completer: sensorNames,
+				Func: func(c *ishell.Context) {
+					if len(c.Args) < 3 {
+						c.Err(errors.New("Incorrect number of arguments. Usage: cal curve <sensor_name> <piecewise|polynomial[:degree]> <counts:kpa>..."))
+						return
+					}
+					name := c.Args[0]
+
+					kind := strings.SplitN(c.Args[1], ":", 2)
+					degree := 0
+					if len(kind) == 2 {
+						degree, _ = strconv.Atoi(kind[1])
+					}
+
+					points := make([]CalibrationPoint, 0, len(c.Args)-2)
+					for _, arg := range c.Args[2:] {
+						var p CalibrationPoint
+						if _, err := fmt.Sscanf(arg, "%g:%g", &p.Counts, &p.Load); err != nil {
+							c.Err(fmt.Errorf("Invalid point %s: %v", arg, err))
+							return
+						}
+						points = append(points, p)
+					}
+
+					curve, err := FitCurve(CurveType(kind[0]), degree, points)
+					if err != nil {
+						c.Err(err)
+						return
+					}
+					if err = dynastat.SetSensorCurve(name, curve); err != nil {
+						c.Err(err)
+						return
+					}
+
+					c.Printf("Sensor %s fitted: R² %.4f, RMSE %.2f kPa, max error %.2f kPa. Use cal commit to save.\n",
+						name, curve.Fit.RSquared, curve.Fit.RMSE, curve.Fit.MaxError)
+				},
+			})
+
+			calCmd.AddCmd(&ishell.Cmd{
+				Name:      "sensor",
+				Help:      "Calibrate a sensor with known masses. Usage: cal sensor <sensor_name> [piecewise|polynomial[:degree]] [area_mm2]",
+				Completer: sensorNames,
+				Func: func(c *ishell.Context) {
+					if len(c.Args) < 1 || len(c.Args) > 3 {
+						c.Err(errors.New("Incorrect number of arguments. Usage: cal sensor <sensor_name> [piecewise|polynomial[:degree]] [area_mm2]"))
+						return
+					}
+					name := c.Args[0]
+
+					var kind []string
+					degree := 0
+					if len(c.Args) > 1 {
+						kind = strings.SplitN(c.Args[1], ":", 2)
+						if len(kind) == 2 {
+							degree, _ = strconv.Atoi(kind[1])
+						}
+					} else {
+						kind = []string{""}
+					}
+
+					area := 0.0
+					if len(c.Args) > 2 {
+						var err error
+						if area, err = strconv.ParseFloat(c.Args[2], 64); err != nil {
+							c.Err(fmt.Errorf("Invalid area %s: %v", c.Args[2], err))
+							return
+						}
+					}
+
+					calibrator, err := dynastat.NewSensorCalibrator(name, CurveType(kind[0]), degree, area)
+					if err != nil {
+						c.Err(err)
+						return
+					}
+
+					c.ShowPrompt(false)
+					defer c.ShowPrompt(true)
+
+					c.Print("Remove all load from the sensor then press enter")
+					c.ReadLine()
+					c.Printf("Sensor %s zero value %d\n", name, calibrator.CaptureZero())
+
+					for {
+						c.Print("Place a known mass on the sensor and enter its mass in kg, or leave blank to finish: ")
+						line := strings.TrimSpace(c.ReadLine())
+						if line == "" {
+							break
+						}
+
+						mass, err := strconv.ParseFloat(line, 64)
+						if err != nil {
+							c.Err(fmt.Errorf("Invalid mass %s: %v", line, err))
+							continue
+						}
+
+						step, err := calibrator.CaptureStep(mass)
+						if err != nil {
+							c.Err(err)
+							continue
+						}
+						c.Printf("%.3f kg over %.0f mm² (%d sensels) is %.2f kPa at %.1f counts\n",
+							step.Mass, step.Area, step.Sensels, step.Pressure, step.Counts)
+					}
+
+					_, curve, err := calibrator.Finish()
+					if err != nil {
+						c.Err(err)
+						return
+					}
+
+					c.Printf("Sensor %s calibrated: R² %.4f, RMSE %.2f kPa, max error %.2f kPa.\n",
+						name, curve.Fit.RSquared, curve.Fit.RMSE, curve.Fit.MaxError)
+					// saved straight away as it is through the API, the calibration is a record of the masses used
+					if err := saveConfig(dynastat); err != nil {
+						c.Err(err)
+						return
+					}
+					c.Println("Saved to", ENV.ConfigFile)
+				},
+			})
+
 			calCmd.AddCmd(&ishell.Cmd{
 				Name: "commit",
 				Help: "Commit the current config to disk",
 				Func: func(c *ishell.Context) {
-					yml, _ := yaml.Marshal(dynastat.GetConfig())
-					ioutil.WriteFile(filename, yml, 0744)
+					if err := saveConfig(dynastat); err != nil {
+						c.Err(err)
+					}
 				},
 			})
 
@@ -340,6 +802,7 @@ func main() {
 	//---
 	// Build the API routes
 	//---
+	calibrations := new(SensorCalibrations)
 	r.Route("/api", func(r chi.Router) {
 		// login
 		r.Post("/login", Login)
@@ -355,6 +818,37 @@ func main() {
 
 			r.Get("/refresh_token", JWTRefresh)
 			r.Get("/ice_servers", IceServers)
+
+			r.Route("/sensors", func(r chi.Router) {
+				r.Get("/", ListSensors)
+				r.Get("/{sensor}/plate", PlateCoordinate)
+				r.Get("/{sensor}/calibration", GetSensorCalibration)
+				r.Post("/{sensor}/calibration", calibrations.StartSensorCalibration)
+				r.Post("/{sensor}/calibration/steps", calibrations.CaptureCalibrationStep)
+				r.Post("/{sensor}/calibration/finish", calibrations.FinishSensorCalibration)
+				r.Delete("/{sensor}/calibration", calibrations.CancelSensorCalibration)
+			})
+
+			r.Route("/motors", func(r chi.Router) {
+				r.Post("/move", MoveMotors)
+			})
+
+			r.Route("/postures", func(r chi.Router) {
+				r.Get("/", ListPostures)
+				r.Post("/", CreatePosture)
+				r.Post("/capture", CapturePosture)
+				r.Get("/{postureID}", GetPosture)
+				r.Put("/{postureID}", UpdatePosture)
+				r.Delete("/{postureID}", DeletePosture)
+				r.Post("/{postureID}/apply", ApplyPosture)
+			})
+
+			r.Route("/sessions", func(r chi.Router) {
+				r.Get("/", ListSessions)
+				r.Get("/{sessionID}", GetSession)
+				r.Get("/{sessionID}/export", ExportSession)
+				r.Delete("/{sessionID}", DeleteSession)
+			})
 		})
 
 	})
@@ -381,6 +875,15 @@ func main() {
 	}
 }
 
+// saveConfig writes the device config back to the file it was loaded from
+func saveConfig(device DynastatInterface) error {
+	yml, err := device.MarshalConfig()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ENV.ConfigFile, yml, 0744)
+}
+
 func openDb(dbFile string) (db *storm.DB, err error) {
 	db, err = storm.Open(dbFile)
 	if err != nil {
@@ -391,6 +894,9 @@ func openDb(dbFile string) (db *storm.DB, err error) {
 	if err := db.Init(&User{}); err != nil {
 		return nil, err
 	}
+	if err := db.Init(&comms.Session{}); err != nil {
+		return nil, err
+	}
 
 	return
 }
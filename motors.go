@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/CodedInternet/godynastat/onboard"
+	"github.com/go-chi/render"
+	"net/http"
+	"time"
+)
+
+//---
+// Motors
+//---
+
+// MoveMotorsPayload sets several motors together, either in the 0-255 application range or at physical positions in
+// any of the units configured for each motor.
+// Tolerance and timeout in ms are left as 0 for the defaults. With wait set the response is held until the move has
+// finished, otherwise it is returned as soon as the motors have been set and the progress follows in the device state.
+type MoveMotorsPayload struct {
+	Targets   map[string]int           `json:"targets"`
+	Positions map[string]MotorPosition `json:"positions"`
+	Tolerance int                      `json:"tolerance"`
+	Timeout   int                      `json:"timeout"`
+	Wait      bool                     `json:"wait"`
+}
+
+func (p *MoveMotorsPayload) Bind(r *http.Request) error {
+	if len(p.Targets) == 0 && len(p.Positions) == 0 {
+		return errors.New("No motors to move")
+	}
+	if p.Tolerance < 0 || p.Timeout < 0 {
+		return errors.New("Tolerance and timeout must not be negative")
+	}
+	return nil
+}
+
+// MoveMotors moves several motors together and reports the progress of the move
+func MoveMotors(w http.ResponseWriter, r *http.Request) {
+	data := &MoveMotorsPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	targets, err := ENV.Conductor.Device.MotorTargets(data.Positions)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	for name, target := range data.Targets {
+		if _, ok := targets[name]; ok {
+			render.Render(w, r, ErrInvalidRequest(errors.New(fmt.Sprintf("Motor %s has both a target and a position", name))))
+			return
+		}
+		targets[name] = target
+	}
+
+	move, err := ENV.Conductor.Device.MoveMotors(targets, data.Tolerance, time.Duration(data.Timeout)*time.Millisecond)
+	renderMove(w, r, move, err, data.Wait)
+}
+
+// renderMove reports the progress of a move once the motors have been set, or once it has finished with wait set
+func renderMove(w http.ResponseWriter, r *http.Request, move *MotorMove, err error, wait bool) {
+	if err != nil {
+		if move == nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		// some of the motors were set so the failed move is reported like any other
+		render.JSON(w, r, move.Progress())
+		return
+	}
+
+	if wait {
+		select {
+		case <-move.Done():
+		case <-r.Context().Done():
+			// the move carries on without the caller
+			return
+		}
+	}
+	render.JSON(w, r, move.Progress())
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+/*
+	Analytics calculated from the sensor states so every client gets the same answer.
+*/
+
+package onboard
+
+import "strings"
+
+// Point is a location either on a single sensor or on the foot plate.
+type Point struct {
+	X, Y float64
+}
+
+// CentreOfPressure is the load weighted centre of a set of sensels.
+// Load is the sum of all the sensel values, when it is 0 the position has no meaning.
+type CentreOfPressure struct {
+	Point
+	Load float64
+}
+
+// PressureCentres holds the centre of pressure for each named sensor, in sensel units relative to the sensor, and
+// for each foot, in mm relative to the plate.
+type PressureCentres struct {
+	Sensors map[string]CentreOfPressure
+	Feet    map[string]CentreOfPressure
+}
+
+// CentreOfPressure calculates the load weighted centre of the sensor.
+// X runs along the columns and Y along the rows, with the centre of the first sensel at 0,0.
+func (state SensorState) CentreOfPressure() (cop CentreOfPressure) {
+	var x, y float64
+	for row, cols := range state {
+		for col, val := range cols {
+			v := float64(val)
+			if v <= 0 {
+				continue
+			}
+			x += v * float64(col)
+			y += v * float64(row)
+			cop.Load += v
+		}
+	}
+
+	if cop.Load > 0 {
+		cop.X = x / cop.Load
+		cop.Y = y / cop.Load
+	}
+	return
+}
+
+// combineCentres merges a number of centres of pressure into one, weighting each by its load.
+func combineCentres(centres []CentreOfPressure) (cop CentreOfPressure) {
+	var x, y float64
+	for _, c := range centres {
+		x += c.X * c.Load
+		y += c.Y * c.Load
+		cop.Load += c.Load
+	}
+
+	if cop.Load > 0 {
+		cop.X = x / cop.Load
+		cop.Y = y / cop.Load
+	}
+	return
+}
+
+// footName gives the foot a sensor belongs to.
+// Falls back to the prefix of the sensor name, e.g. left_heel is on the left foot, if it is not in the config.
+func footName(name, foot string) string {
+	if foot != "" {
+		return foot
+	}
+	return strings.SplitN(name, "_", 2)[0]
+}
+
+// sensorPlacement provides the foot and plate geometry of the named sensor from the config.
+func (d *Dynastat) sensorPlacement(name string) (foot string, geometry SensorGeometry) {
+	if d.config == nil {
+		return footName(name, ""), SensorGeometry{Pitch: DEFAULT_PITCH}
+	}
+
+	conf := d.config.Sensors[name]
+	return footName(name, conf.Foot), conf.Geometry
+}
+
+// PressureCentres finds the centres of pressure of sensor states in the same way as for the device state, so states
+// which have been combined can be given centres which match them.
+func (d *Dynastat) PressureCentres(sensors map[string]SensorState) PressureCentres {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.calculateCentres(sensors)
+}
+
+// calculateCentres finds the centre of pressure for each sensor then maps them on to the plate using the sensor
+// geometry and combines them to give the centre of pressure for each foot.
+func (d *Dynastat) calculateCentres(sensors map[string]SensorState) (result PressureCentres) {
+	result.Sensors = make(map[string]CentreOfPressure, len(sensors))
+	feet := make(map[string][]CentreOfPressure)
+
+	for name, state := range sensors {
+		cop := state.CentreOfPressure()
+		result.Sensors[name] = cop
+
+		foot, geometry := d.sensorPlacement(name)
+		cop.Point = geometry.PlatePoint(cop.Point)
+		feet[foot] = append(feet[foot], cop)
+	}
+
+	result.Feet = make(map[string]CentreOfPressure, len(feet))
+	for foot, centres := range feet {
+		result.Feet[foot] = combineCentres(centres)
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package onboard
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+const kCoPTolerance = 0.001
+
+func TestCentreOfPressure(t *testing.T) {
+	Convey("Sensor centre of pressure", t, func() {
+		Convey("Empty sensor has no load", func() {
+			cop := SensorState{{0, 0}, {0, 0}}.CentreOfPressure()
+			So(cop.Load, ShouldEqual, 0)
+			So(cop.X, ShouldEqual, 0)
+			So(cop.Y, ShouldEqual, 0)
+		})
+
+		Convey("Single loaded sensel", func() {
+			cop := SensorState{{0, 0, 0}, {0, 0, 10}}.CentreOfPressure()
+			So(cop.Load, ShouldEqual, 10)
+			So(cop.X, ShouldEqual, 2)
+			So(cop.Y, ShouldEqual, 1)
+		})
+
+		Convey("Load is weighted between sensels", func() {
+			cop := SensorState{{30, 0, 0, 10}}.CentreOfPressure()
+			So(cop.Load, ShouldEqual, 40)
+			So(cop.X, ShouldAlmostEqual, 0.75, kCoPTolerance)
+			So(cop.Y, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Combining centres weights by load", t, func() {
+		cop := combineCentres([]CentreOfPressure{
+			{Point{0, 0}, 10},
+			{Point{10, 20}, 30},
+			{Point{100, 100}, 0},
+		})
+		So(cop.Load, ShouldEqual, 40)
+		So(cop.X, ShouldAlmostEqual, 7.5, kCoPTolerance)
+		So(cop.Y, ShouldAlmostEqual, 15, kCoPTolerance)
+	})
+
+	Convey("Foot falls back to the sensor name", t, func() {
+		So(footName("left_heel", ""), ShouldEqual, "left")
+		So(footName("left_heel", "right"), ShouldEqual, "right")
+		So(footName("heel", ""), ShouldEqual, "heel")
+	})
+
+	Convey("Device combines sensors into feet using their position", t, func() {
+		config := new(DynastatConfig)
+		config.Sensors = make(map[string]SensorConfig)
+		config.Sensors["left_heel"] = SensorConfig{Geometry: SensorGeometry{Pitch: 2}}
+		config.Sensors["left_toe"] = SensorConfig{Geometry: SensorGeometry{Pitch: 2, Origin: Point{0, 20}}}
+
+		dynastat := &Dynastat{config: config}
+		result := dynastat.calculateCentres(map[string]SensorState{
+			"left_heel":  {{0, 10}},
+			"left_toe":   {{0, 10}},
+			"right_heel": {{0}},
+		})
+
+		So(result.Sensors, ShouldContainKey, "left_heel")
+		So(result.Sensors["left_toe"].Y, ShouldEqual, 0)
+		So(result.Feet, ShouldContainKey, "left")
+		So(result.Feet, ShouldContainKey, "right")
+		So(result.Feet["left"].Load, ShouldEqual, 20)
+		So(result.Feet["left"].X, ShouldAlmostEqual, 2, kCoPTolerance)
+		So(result.Feet["left"].Y, ShouldAlmostEqual, 10, kCoPTolerance)
+		So(result.Feet["right"].Load, ShouldEqual, 0)
+	})
+}
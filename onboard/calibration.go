@@ -0,0 +1,221 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+/*
+	Calibration of the sensors beyond the single scale factor held on each sensor.
+*/
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// CALIBRATION_FRAMES is the number of frames averaged for each calibration or equalisation capture
+	CALIBRATION_FRAMES = FRAMERATE * 2
+	// MAX_EQUALISATION_GAIN limits how far a weak sensel is boosted so noise on a near dead cell is not amplified
+	MAX_EQUALISATION_GAIN = 4
+)
+
+// SensorEqualisation holds the per sensel correction for the non-uniformity of a sensor.
+// Offset is the count each sensel reads above the sensor zero value when unloaded and Gain is the multiplier that
+// brings the sensel in line with the average response of the sensor. Both are indexed [row][col] in the same
+// orientation as the sensor state. An empty equalisation leaves the values untouched.
+type SensorEqualisation struct {
+	Gain   [][]float64 `yaml:",omitempty"`
+	Offset [][]float64 `yaml:",omitempty"`
+}
+
+// flatten converts the matrices into slices indexed row*cols+col ready for use by the sensor.
+// Missing matrices give an identity gain and zero offset.
+func (e SensorEqualisation) flatten(rows, cols int) (gain, offset []float64, err error) {
+	gain = make([]float64, rows*cols)
+	offset = make([]float64, rows*cols)
+	for i := range gain {
+		gain[i] = 1
+	}
+
+	copyMatrix := func(name string, matrix [][]float64, dst []float64) error {
+		if len(matrix) == 0 {
+			return nil
+		}
+		if len(matrix) != rows {
+			return errors.New(fmt.Sprintf("Equalisation %s has %d rows expected %d", name, len(matrix), rows))
+		}
+		for r, vals := range matrix {
+			if len(vals) != cols {
+				return errors.New(fmt.Sprintf("Equalisation %s row %d has %d cols expected %d", name, r, len(vals), cols))
+			}
+			copy(dst[r*cols:], vals)
+		}
+		return nil
+	}
+
+	if err = copyMatrix("gain", e.Gain, gain); err != nil {
+		return nil, nil, err
+	}
+	if err = copyMatrix("offset", e.Offset, offset); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// NewSensorEqualisation builds the equalisation for a sensor from two averaged raw frames, one taken with the sensor
+// unloaded and one with a uniform load across the whole sensor, such as from a bladder. unloaded may be nil in which
+// case the zero value is used for every sensel and no offsets are recorded.
+func NewSensorEqualisation(rows, cols int, zero uint16, unloaded, loaded []float64) (eq SensorEqualisation, err error) {
+	if len(loaded) != rows*cols || (unloaded != nil && len(unloaded) != rows*cols) {
+		return eq, errors.New("Captured frame does not match the size of the sensor")
+	}
+
+	baseline := func(i int) float64 {
+		if unloaded == nil {
+			return float64(zero)
+		}
+		return unloaded[i]
+	}
+
+	// find the average response to the uniform load across the whole sensor
+	var mean float64
+	for i, val := range loaded {
+		mean += val - baseline(i)
+	}
+	mean /= float64(len(loaded))
+	if mean <= 0 {
+		return eq, errors.New("Sensor did not respond to the load")
+	}
+
+	eq.Gain = make([][]float64, rows)
+	if unloaded != nil {
+		eq.Offset = make([][]float64, rows)
+	}
+	for r := 0; r < rows; r++ {
+		eq.Gain[r] = make([]float64, cols)
+		if unloaded != nil {
+			eq.Offset[r] = make([]float64, cols)
+		}
+
+		for c := 0; c < cols; c++ {
+			i := r*cols + c
+			gain := 1.0
+			if response := loaded[i] - baseline(i); response > 0 {
+				gain = mean / response
+			}
+			if gain > MAX_EQUALISATION_GAIN {
+				gain = MAX_EQUALISATION_GAIN
+			}
+			eq.Gain[r][c] = gain
+
+			if unloaded != nil {
+				eq.Offset[r][c] = unloaded[i] - float64(zero)
+			}
+		}
+	}
+	return
+}
+
+// averageFrame reads the raw values of the whole sensor a number of times and gives the mean of each sensel,
+// indexed row*cols+col.
+func averageFrame(sensor SensorInterface, rows, cols, frames int) []float64 {
+	sum := make([]float64, rows*cols)
+	for f := 0; f < frames; f++ {
+		state := sensor.GetState(UNIT_RAW)
+		for r := 0; r < rows; r++ {
+			for c := 0; c < cols; c++ {
+				sum[r*cols+c] += state[r][c]
+			}
+		}
+		time.Sleep(time.Second / FRAMERATE)
+	}
+
+	for i := range sum {
+		sum[i] /= float64(frames)
+	}
+	return sum
+}
+
+// Equaliser walks through the captures needed to build the equalisation for a single sensor.
+type Equaliser struct {
+	Name     string
+	device   *Dynastat
+	sensor   SensorInterface
+	unloaded []float64
+}
+
+// NewEqualiser starts the equalisation of the named sensor.
+func (d *Dynastat) NewEqualiser(name string) (*Equaliser, error) {
+	sensor, ok := d.sensors[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unkown sensor %s", name))
+	}
+	return &Equaliser{Name: name, device: d, sensor: sensor}, nil
+}
+
+// CaptureUnloaded records the baseline of each sensel. The sensor must have no load on it.
+func (e *Equaliser) CaptureUnloaded() {
+	conf := e.device.config.Sensors[e.Name]
+	e.unloaded = averageFrame(e.sensor, conf.Rows, conf.Cols, CALIBRATION_FRAMES)
+}
+
+// CaptureLoaded records the response of each sensel to a uniform load across the sensor then builds the equalisation
+// and applies it to the device.
+func (e *Equaliser) CaptureLoaded() (eq SensorEqualisation, err error) {
+	conf := e.device.config.Sensors[e.Name]
+	loaded := averageFrame(e.sensor, conf.Rows, conf.Cols, CALIBRATION_FRAMES)
+
+	eq, err = NewSensorEqualisation(conf.Rows, conf.Cols, conf.ZeroValue, e.unloaded, loaded)
+	if err != nil {
+		return
+	}
+
+	err = e.device.SetSensorEqualisation(e.Name, eq)
+	return
+}
+
+// SetSensorEqualisation applies the equalisation to the named sensor and records it in the config.
+func (d *Dynastat) SetSensorEqualisation(name string, eq SensorEqualisation) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sensor, ok := d.sensors[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unkown sensor %s", name))
+	}
+
+	if err := sensor.SetEqualisation(eq); err != nil {
+		return err
+	}
+
+	conf := d.config.Sensors[name]
+	conf.Equalisation = eq
+	d.config.Sensors[name] = conf
+	return nil
+}
+
+// SetSensorCurve applies the calibration curve to the named sensor and records it in the config.
+// A nil curve returns the sensor to its linear full scale.
+func (d *Dynastat) SetSensorCurve(name string, curve *CalibrationCurve) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sensor, ok := d.sensors[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unkown sensor %s", name))
+	}
+
+	// the config records the prepared curve, with its fit, as the sensor uses it
+	curve, err := curve.prepared()
+	if err != nil {
+		return err
+	}
+	if err = sensor.SetCurve(curve); err != nil {
+		return err
+	}
+
+	conf := d.config.Sensors[name]
+	conf.Curve = curve
+	d.config.Sensors[name] = conf
+	return nil
+}
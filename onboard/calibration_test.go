@@ -0,0 +1,174 @@
+package onboard
+
+import (
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSensorEqualisation(t *testing.T) {
+	Convey("Building an equalisation from captured frames", t, func() {
+		unloaded := []float64{10, 20, 10, 10}
+		loaded := []float64{110, 220, 60, 60}
+
+		eq, err := NewSensorEqualisation(2, 2, 10, unloaded, loaded)
+		So(err, ShouldBeNil)
+
+		// mean response is 100
+		So(eq.Gain[0][0], ShouldAlmostEqual, 1, kScaleTolerance)
+		So(eq.Gain[0][1], ShouldAlmostEqual, 0.5, kScaleTolerance)
+		So(eq.Gain[1][0], ShouldAlmostEqual, 2, kScaleTolerance)
+		So(eq.Offset[0][1], ShouldEqual, 10)
+		So(eq.Offset[1][1], ShouldEqual, 0)
+
+		Convey("without an unloaded frame the zero value is used", func() {
+			eq, err := NewSensorEqualisation(2, 2, 10, nil, loaded)
+			So(err, ShouldBeNil)
+			So(eq.Offset, ShouldBeNil)
+			So(eq.Gain[0][1], ShouldBeLessThan, 1)
+		})
+
+		Convey("weak sensels are limited", func() {
+			eq, err := NewSensorEqualisation(2, 2, 10, unloaded, []float64{210, 20, 210, 210})
+			So(err, ShouldBeNil)
+			So(eq.Gain[0][1], ShouldEqual, 1) // no response at all
+			So(eq.Gain[0][0], ShouldBeLessThanOrEqualTo, MAX_EQUALISATION_GAIN)
+		})
+
+		Convey("no load is rejected", func() {
+			_, err := NewSensorEqualisation(2, 2, 10, unloaded, unloaded)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("frames of the wrong size are rejected", func() {
+			_, err := NewSensorEqualisation(3, 2, 10, unloaded, loaded)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Flattening checks the matrix sizes", t, func() {
+		gain, offset, err := SensorEqualisation{}.flatten(2, 3)
+		So(err, ShouldBeNil)
+		So(gain, ShouldResemble, []float64{1, 1, 1, 1, 1, 1})
+		So(offset, ShouldResemble, []float64{0, 0, 0, 0, 0, 0})
+
+		_, _, err = SensorEqualisation{Gain: [][]float64{{1, 1, 1}}}.flatten(2, 3)
+		So(err, ShouldNotBeNil)
+
+		_, _, err = SensorEqualisation{Offset: [][]float64{{1, 1, 1}, {1, 1}}}.flatten(2, 3)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Sensor applies the equalisation", t, func() {
+		msb := &MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}
+		sb := NewSensorBoard(msb, 0)
+		sensor, _ := NewSensor(sb, 1, false, 2, 2, 0, 2047, 4095, 0)
+		for i := 0; i < sb_ROWS*sb_COLS; i++ {
+			binary.BigEndian.PutUint16(msb.data[i*2:], 1010)
+		}
+		sb.read()
+
+		before := sensor.GetPressure(0, 0)
+		So(sensor.SetEqualisation(SensorEqualisation{
+			Gain:   [][]float64{{2, 1}, {1, 1}},
+			Offset: [][]float64{{10, 0}, {0, 0}},
+		}), ShouldBeNil)
+
+		So(sensor.GetRaw(0, 0), ShouldEqual, 1010)
+		So(sensor.GetPressure(0, 0), ShouldAlmostEqual, before*2000/1010, kScaleTolerance)
+		So(sensor.GetPressure(0, 1), ShouldAlmostEqual, before, kScaleTolerance)
+
+		Convey("mismatched matrices are rejected", func() {
+			err := sensor.SetEqualisation(SensorEqualisation{Gain: [][]float64{{1}}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("device records the equalisation in the config", func() {
+			dynastat := &Dynastat{
+				sensors: map[string]SensorInterface{"TestSensor": sensor},
+				config:  &DynastatConfig{Sensors: map[string]SensorConfig{"TestSensor": {Rows: 2, Cols: 2}}},
+			}
+			eq := SensorEqualisation{Gain: [][]float64{{1, 2}, {3, 4}}}
+			So(dynastat.SetSensorEqualisation("TestSensor", eq), ShouldBeNil)
+			So(dynastat.config.Sensors["TestSensor"].Equalisation, ShouldResemble, eq)
+
+			So(dynastat.SetSensorEqualisation("whoami", eq), ShouldNotBeNil)
+			_, err := dynastat.NewEqualiser("whoami")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSensorCalibrator(t *testing.T) {
+	Convey("Calibrating a sensor with known masses", t, func() {
+		msb := &MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}
+		sb := NewSensorBoard(msb, 0)
+		sensor, _ := NewSensor(sb, 1, false, 2, 2, 0, 2047, 4095, 0)
+		dynastat := &Dynastat{
+			sensors: map[string]SensorInterface{"TestSensor": sensor},
+			config: &DynastatConfig{Sensors: map[string]SensorConfig{"TestSensor": {
+				Rows:     2,
+				Cols:     2,
+				Geometry: SensorGeometry{Pitch: 10},
+			}}},
+		}
+		// values are given row by row
+		load := func(vals ...uint16) {
+			for i, val := range vals {
+				j := (sensor.oRows+i/2)*sb_COLS + sensor.oCols + i%2
+				binary.BigEndian.PutUint16(msb.data[j*2:], val)
+			}
+			sb.read()
+		}
+
+		_, err := dynastat.NewSensorCalibrator("whoami", "", 0, 0)
+		So(err, ShouldNotBeNil)
+		_, err = dynastat.NewSensorCalibrator("TestSensor", "spline", 0, 0)
+		So(err, ShouldNotBeNil)
+
+		calibrator, err := dynastat.NewSensorCalibrator("TestSensor", "", 0, 0)
+		So(err, ShouldBeNil)
+		So(calibrator.Type, ShouldEqual, CURVE_PIECEWISE)
+
+		_, err = calibrator.CaptureStep(1)
+		So(err, ShouldNotBeNil)
+
+		load(100, 100, 100, 100)
+		So(calibrator.CaptureZero(), ShouldEqual, 100)
+
+		// 1 kg over 2 sensels of 100mm² is 49.03 kPa
+		load(1100, 1100, 105, 100)
+		step, err := calibrator.CaptureStep(1)
+		So(err, ShouldBeNil)
+		So(step.Sensels, ShouldEqual, 2)
+		So(step.Counts, ShouldAlmostEqual, 1000, kScaleTolerance)
+		So(step.Area, ShouldAlmostEqual, 200, kScaleTolerance)
+		So(step.Pressure, ShouldAlmostEqual, 49.033, kCurveTolerance)
+
+		load(3100, 3100, 100, 100)
+		_, err = calibrator.CaptureStep(4)
+		So(err, ShouldBeNil)
+
+		record, curve, err := calibrator.Finish()
+		So(err, ShouldBeNil)
+		So(record.Steps, ShouldHaveLength, 2)
+		So(curve.Points, ShouldHaveLength, 3)
+		So(curve.Apply(3000), ShouldAlmostEqual, 4*GRAVITY*5, kCurveTolerance)
+
+		conf := dynastat.config.Sensors["TestSensor"]
+		So(conf.ZeroValue, ShouldEqual, 100)
+		So(conf.FullValue, ShouldEqual, 3100)
+		So(conf.HalfValue, ShouldEqual, 1767) // half the pressure of 4 kg sits between the captures
+		So(conf.FullScale, ShouldAlmostEqual, 4*GRAVITY*5, kCurveTolerance)
+		So(conf.Calibration, ShouldResemble, &record)
+		So(sensor.GetPressure(0, 0), ShouldAlmostEqual, 4*GRAVITY*5, kCurveTolerance)
+
+		Convey("masses that cannot be seen are rejected", func() {
+			load(100, 100, 100, 100)
+			_, err := calibrator.CaptureStep(1)
+			So(err, ShouldNotBeNil)
+			_, err = calibrator.CaptureStep(0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
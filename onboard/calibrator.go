@@ -0,0 +1,240 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// GRAVITY is standard gravity in m/s² used to convert the calibration masses to force
+	GRAVITY = 9.80665
+	// LOADED_THRESHOLD is the fraction of the largest response a sensel must reach to count as being under the load
+	LOADED_THRESHOLD = 0.1
+)
+
+// CalibrationStep is a known mass placed on a sensor and the response that was captured for it.
+type CalibrationStep struct {
+	Mass     float64 // kg
+	Area     float64 // mm² the mass was spread over
+	Pressure float64 // kPa
+	Counts   float64 // mean counts of the sensels under the mass
+	Sensels  int     // number of sensels under the mass
+}
+
+// CalibrationRecord keeps track of where the calibration of a sensor came from.
+type CalibrationRecord struct {
+	Date      time.Time
+	ZeroValue uint16
+	Steps     []CalibrationStep
+}
+
+// SensorCalibrator walks an operator through calibrating a sensor with known masses.
+// The sensor is zeroed unloaded first, then each mass is captured in turn before the curve is fitted and written back
+// to the device and config. Area is the contact area of the masses in mm², when it is 0 the area of the sensels that
+// respond to the mass is used instead.
+type SensorCalibrator struct {
+	Name   string
+	Type   CurveType
+	Degree int
+	Area   float64
+	device *Dynastat
+	sensor SensorInterface
+	conf   SensorConfig
+	gain   []float64
+	offset []float64
+	zero   float64
+	zeroed bool
+	steps  []CalibrationStep
+	lock   sync.Mutex
+}
+
+// NewSensorCalibrator starts the calibration of the named sensor. Piecewise curves are used if no type is given.
+func (d *Dynastat) NewSensorCalibrator(name string, kind CurveType, degree int, area float64) (c *SensorCalibrator, err error) {
+	sensor, ok := d.sensors[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unkown sensor %s", name))
+	}
+
+	switch kind {
+	case "":
+		kind = CURVE_PIECEWISE
+	case CURVE_PIECEWISE, CURVE_POLYNOMIAL:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unkown curve type %s", kind))
+	}
+
+	if area < 0 {
+		return nil, errors.New("Area must not be negative")
+	}
+
+	c = &SensorCalibrator{
+		Name:   name,
+		Type:   kind,
+		Degree: degree,
+		Area:   area,
+		device: d,
+		sensor: sensor,
+		conf:   d.config.Sensors[name],
+	}
+
+	c.gain, c.offset, err = c.conf.Equalisation.flatten(c.conf.Rows, c.conf.Cols)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// CaptureZero records the zero value of the sensor. The sensor must have no load on it.
+func (c *SensorCalibrator) CaptureZero() uint16 {
+	frame := averageFrame(c.sensor, c.conf.Rows, c.conf.Cols, CALIBRATION_FRAMES)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var sum float64
+	for i, val := range frame {
+		sum += val - c.offset[i]
+	}
+	c.zero = sum / float64(len(frame))
+	c.zeroed = true
+	c.steps = nil
+	return uint16(c.zero + 0.5)
+}
+
+// CaptureStep records the response of the sensor to a known mass in kg.
+func (c *SensorCalibrator) CaptureStep(mass float64) (step CalibrationStep, err error) {
+	if mass <= 0 {
+		return step, errors.New("Mass must be greater than 0")
+	}
+	if !c.zeroed {
+		return step, errors.New("Sensor must be zeroed before capturing a mass")
+	}
+
+	frame := averageFrame(c.sensor, c.conf.Rows, c.conf.Cols, CALIBRATION_FRAMES)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var max float64
+	response := make([]float64, len(frame))
+	for i, val := range frame {
+		response[i] = (val - c.zero - c.offset[i]) * c.gain[i]
+		if response[i] > max {
+			max = response[i]
+		}
+	}
+	if max <= 0 {
+		return step, errors.New("Sensor did not respond to the mass")
+	}
+
+	var sum float64
+	for _, r := range response {
+		if r >= max*LOADED_THRESHOLD {
+			sum += r
+			step.Sensels++
+		}
+	}
+
+	step.Mass = mass
+	step.Counts = sum / float64(step.Sensels)
+	step.Area = c.Area
+	if step.Area == 0 {
+		step.Area = float64(step.Sensels) * c.conf.Geometry.SenselArea()
+	}
+	if step.Area <= 0 {
+		return step, errors.New("Unable to work out the loaded area, the sensor has no pitch")
+	}
+	// N/mm² is MPa
+	step.Pressure = mass * GRAVITY / step.Area * 1000
+
+	c.steps = append(c.steps, step)
+	return
+}
+
+// Steps gives the masses captured so far.
+func (c *SensorCalibrator) Steps() []CalibrationStep {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]CalibrationStep(nil), c.steps...)
+}
+
+// Finish fits the calibration curve to the captured steps and applies the result to the device and its config.
+// The zero, half and full values are also updated from the captures so the 0-255 range follows the calibration.
+func (c *SensorCalibrator) Finish() (record CalibrationRecord, curve *CalibrationCurve, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.steps) == 0 {
+		return record, nil, errors.New("No masses have been captured")
+	}
+
+	// the unloaded sensor is the first point on the curve
+	points := []CalibrationPoint{{0, 0}}
+	heaviest := c.steps[0]
+	for _, step := range c.steps {
+		points = append(points, CalibrationPoint{step.Counts, step.Pressure})
+		if step.Pressure > heaviest.Pressure {
+			heaviest = step
+		}
+	}
+
+	curve, err = FitCurve(c.Type, c.Degree, points)
+	if err != nil {
+		return record, nil, err
+	}
+
+	// find the counts for half of the heaviest load by running the points backwards
+	inverse := make([]CalibrationPoint, len(curve.Points))
+	for i, p := range curve.Points {
+		inverse[i] = CalibrationPoint{p.Load, p.Counts}
+	}
+
+	zero := uint16(c.zero + 0.5)
+	half := uint16(c.zero + interpolate(inverse, heaviest.Pressure/2) + 0.5)
+	full := uint16(c.zero + heaviest.Counts + 0.5)
+
+	record = CalibrationRecord{
+		Date:      time.Now().UTC(),
+		ZeroValue: zero,
+		Steps:     append([]CalibrationStep(nil), c.steps...),
+	}
+
+	err = c.device.applySensorCalibration(c.Name, zero, half, full, heaviest.Pressure, curve, &record)
+	return
+}
+
+// applySensorCalibration updates the named sensor and its config with the result of a calibration.
+func (d *Dynastat) applySensorCalibration(name string, zero, half, full uint16, fullScale float64,
+	curve *CalibrationCurve, record *CalibrationRecord) error {
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sensor, ok := d.sensors[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unkown sensor %s", name))
+	}
+
+	curve, err := curve.prepared()
+	if err != nil {
+		return err
+	}
+	if err = sensor.SetCurve(curve); err != nil {
+		return err
+	}
+	sensor.SetScale(zero, half, full)
+
+	conf := d.config.Sensors[name]
+	conf.ZeroValue = zero
+	conf.HalfValue = half
+	conf.FullValue = full
+	conf.FullScale = fullScale
+	conf.Curve = curve
+	conf.Calibration = record
+	d.config.Sensors[name] = conf
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Capture is a single tick of the capture scheduler in which every board due a read was read back to back.
+// Skew is the time between the first and last board frames in the capture. Boards which could not be read are
+// counted in Errors and keep their previous frame.
+type Capture struct {
+	Seq    uint64
+	Time   time.Time
+	Skew   time.Duration
+	Boards int
+	Errors int
+}
+
+// CaptureScheduler reads all of the sensor boards on the shared bus from a single timer so the frames from each
+// board line up. Boards sampled slower than the fastest board are read on every nth tick.
+// The frames of every board are published together once a capture is complete so readers never mix two captures.
+type CaptureScheduler struct {
+	boards   []*SensorBoard
+	divisors []uint64
+	rate     int
+	seq      uint64
+	last     Capture
+	frames   map[int]*SensorFrame // latest frame from each board keyed by address, replaced whole on each capture
+	lock     sync.RWMutex
+}
+
+// NewCaptureScheduler schedules the boards at the fastest of their sample rates.
+func NewCaptureScheduler(boards map[int]*SensorBoard) *CaptureScheduler {
+	s := new(CaptureScheduler)
+
+	addresses := make([]int, 0, len(boards))
+	for address, board := range boards {
+		addresses = append(addresses, address)
+		if board.rate > s.rate {
+			s.rate = board.rate
+		}
+	}
+	if s.rate == 0 {
+		s.rate = FRAMERATE
+	}
+	// read in a fixed order so the skew between boards is repeatable
+	sort.Ints(addresses)
+
+	for _, address := range addresses {
+		board := boards[address]
+		divisor := uint64(1)
+		if board.rate > 0 && board.rate < s.rate {
+			divisor = uint64((s.rate + board.rate/2) / board.rate)
+		}
+		s.boards = append(s.boards, board)
+		s.divisors = append(s.divisors, divisor)
+	}
+
+	s.frames = make(map[int]*SensorFrame, len(s.boards))
+	for _, board := range s.boards {
+		s.frames[board.address] = board.Frame()
+	}
+	return s
+}
+
+// Run triggers a capture at the scheduled rate, it does not return.
+func (s *CaptureScheduler) Run() {
+	ticker := time.NewTicker(time.Second / time.Duration(s.rate))
+	for range ticker.C {
+		s.Tick()
+	}
+}
+
+// Tick reads every board due on this tick and labels their frames with the capture.
+func (s *CaptureScheduler) Tick() Capture {
+	s.seq++
+	capture := Capture{Seq: s.seq, Time: time.Now()}
+
+	// boards which are not due or fail to read carry their previous frame into the capture
+	s.lock.RLock()
+	frames := make(map[int]*SensorFrame, len(s.frames))
+	for address, frame := range s.frames {
+		frames[address] = frame
+	}
+	s.lock.RUnlock()
+
+	var first, last time.Time
+	for i, board := range s.boards {
+		if (s.seq-1)%s.divisors[i] != 0 {
+			continue
+		}
+
+		frame, err := board.capture(capture.Seq)
+		frames[board.address] = frame
+		if err != nil {
+			capture.Errors++
+			continue
+		}
+		if capture.Boards == 0 || frame.Time.Before(first) {
+			first = frame.Time
+		}
+		if frame.Time.After(last) {
+			last = frame.Time
+		}
+		capture.Boards++
+	}
+	if capture.Boards > 0 {
+		capture.Skew = last.Sub(first)
+	}
+
+	s.lock.Lock()
+	s.last = capture
+	s.frames = frames
+	s.lock.Unlock()
+	return capture
+}
+
+// Frames gives the most recent capture along with the frame from every board which makes it up.
+// The frames must not be modified.
+func (s *CaptureScheduler) Frames() (Capture, map[int]*SensorFrame) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.last, s.frames
+}
+
+// Last gives the most recent capture.
+func (s *CaptureScheduler) Last() Capture {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.last
+}
@@ -0,0 +1,101 @@
+package onboard
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// SlowI2CSensorBoard takes a while to answer each read like a real board on a busy bus
+type SlowI2CSensorBoard struct {
+	MockI2CSensorBoard
+	delay time.Duration
+}
+
+func (s *SlowI2CSensorBoard) Get(i2cAddr int, cmd uint16, buf []byte) error {
+	time.Sleep(s.delay)
+	return s.MockI2CSensorBoard.Get(i2cAddr, cmd, buf)
+}
+
+func TestCaptureScheduler(t *testing.T) {
+	Convey("Capturing every board from one timer", t, func() {
+		bus := &SlowI2CSensorBoard{MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}, time.Millisecond}
+		boards := map[int]*SensorBoard{
+			0x16: NewSensorBoard(bus, 0x16),
+			0x15: NewSensorBoard(bus, 0x15),
+			0x25: NewSensorBoard(bus, 0x25),
+		}
+		boards[0x15].SetSampleRate(100)
+		boards[0x16].SetSampleRate(100)
+		boards[0x25].SetSampleRate(50)
+
+		scheduler := NewCaptureScheduler(boards)
+		So(scheduler.rate, ShouldEqual, 100)
+		So(scheduler.boards[0], ShouldEqual, boards[0x15])
+		So(scheduler.divisors, ShouldResemble, []uint64{1, 1, 2})
+
+		first := scheduler.Tick()
+		So(first.Seq, ShouldEqual, 1)
+		So(first.Boards, ShouldEqual, 3)
+		So(first.Skew, ShouldBeGreaterThanOrEqualTo, 2*time.Millisecond)
+		So(scheduler.Last(), ShouldResemble, first)
+		for _, board := range boards {
+			So(board.Frame().Capture, ShouldEqual, first.Seq)
+		}
+		capture, frames := scheduler.Frames()
+		So(capture, ShouldResemble, first)
+		So(frames, ShouldHaveLength, 3)
+		for address, frame := range frames {
+			So(frame, ShouldEqual, boards[address].Frame())
+		}
+
+		Convey("slower boards are read on every nth tick", func() {
+			second := scheduler.Tick()
+			So(second.Boards, ShouldEqual, 2)
+			So(boards[0x15].Frame().Capture, ShouldEqual, second.Seq)
+			So(boards[0x25].Frame().Capture, ShouldEqual, first.Seq)
+			_, frames := scheduler.Frames()
+			So(frames[0x15].Capture, ShouldEqual, second.Seq)
+			So(frames[0x25].Capture, ShouldEqual, first.Seq)
+
+			third := scheduler.Tick()
+			So(third.Boards, ShouldEqual, 3)
+			So(boards[0x25].Frame().Capture, ShouldEqual, third.Seq)
+		})
+
+		Convey("the device reports the capture behind its state", func() {
+			sensor, _ := NewSensor(boards[0x15], 1, false, 2, 2, 0, 127, 255, 0)
+			dynastat := &Dynastat{
+				sensors:   map[string]SensorInterface{"TestSensor": sensor},
+				boards:    boards,
+				scheduler: scheduler,
+			}
+			state, _ := dynastat.GetState()
+			So(state.Capture, ShouldResemble, first)
+			So(state.SensorSamples["TestSensor"].Capture, ShouldEqual, first.Seq)
+
+			Convey("from the published frames rather than a board read since", func() {
+				boards[0x15].read()
+				state, _ := dynastat.GetState()
+				So(state.SensorSamples["TestSensor"].Capture, ShouldEqual, first.Seq)
+			})
+		})
+	})
+
+	Convey("Boards which fail to read are counted", t, func() {
+		bus := &MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2), err: errors.New("bus error")}
+		scheduler := NewCaptureScheduler(map[int]*SensorBoard{0: NewSensorBoard(bus, 0)})
+		capture := scheduler.Tick()
+		So(capture.Boards, ShouldEqual, 0)
+		So(capture.Errors, ShouldEqual, 1)
+	})
+
+	Convey("A single board has no skew", t, func() {
+		scheduler := NewCaptureScheduler(map[int]*SensorBoard{
+			0: NewSensorBoard(&MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}, 0),
+		})
+		So(scheduler.rate, ShouldEqual, FRAMERATE)
+		So(scheduler.Tick().Skew, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// CONFIG_VERSION is the current version of the config schema.
+	CONFIG_VERSION = 2
+
+	// DEFAULT_PITCH is the sensel pitch in mm assumed when upgrading version 1 configs which have no geometry.
+	DEFAULT_PITCH = 5.08
+)
+
+// Upgrade brings a config written against an older schema up to the current version.
+// The changes are made in place so they are written out the next time the config is committed to disk. Sensors
+// without a positive pitch are rejected as nothing measured in mm could be worked out for them.
+func (c *DynastatConfig) Upgrade() error {
+	if c.Version < 1 || c.Version > CONFIG_VERSION {
+		return errors.New(fmt.Sprintf("Unkown config version %d", c.Version))
+	}
+
+	if c.Version == 1 {
+		// Sensors gained their physical geometry. Version 1 has no plate positions so the sensors start at the origin.
+		for name, conf := range c.Sensors {
+			conf.Geometry.Pitch = DEFAULT_PITCH
+			c.Sensors[name] = conf
+		}
+		c.Version = 2
+	}
+
+	for name, conf := range c.Sensors {
+		if conf.Geometry.Pitch <= 0 {
+			return errors.New(fmt.Sprintf("Sensor %s has a pitch of %v, it must be above 0", name, conf.Geometry.Pitch))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CurveType selects how a calibration curve is fitted to its points.
+type CurveType string
+
+const (
+	CURVE_PIECEWISE  CurveType = "piecewise"
+	CURVE_POLYNOMIAL CurveType = "polynomial"
+
+	// DEFAULT_CURVE_DEGREE is used for polynomial curves when no degree is given
+	DEFAULT_CURVE_DEGREE = 2
+)
+
+// CalibrationPoint is a known load in kPa and the counts the sensor gave for it.
+// Counts have the zero value removed and the equalisation applied.
+type CalibrationPoint struct {
+	Counts, Load float64
+}
+
+// CurveFit reports how well a curve matches the points it was fitted from.
+// For piecewise curves, which pass through every point, the errors are found by leaving out each interior point in
+// turn and predicting it from its neighbours.
+type CurveFit struct {
+	RSquared float64
+	RMSE     float64 // kPa
+	MaxError float64 // kPa
+}
+
+// CalibrationCurve maps sensor counts to pressure for sensels which do not respond linearly to load.
+// Coefficients are lowest order first and are only used by polynomial curves.
+type CalibrationCurve struct {
+	Type         CurveType
+	Degree       int `yaml:",omitempty"`
+	Points       []CalibrationPoint
+	Coefficients []float64 `yaml:",omitempty"`
+	Fit          CurveFit
+}
+
+// FitCurve fits a curve of the given type through the points.
+func FitCurve(kind CurveType, degree int, points []CalibrationPoint) (curve *CalibrationCurve, err error) {
+	curve = &CalibrationCurve{
+		Type:   kind,
+		Degree: degree,
+		Points: append([]CalibrationPoint(nil), points...),
+	}
+	if err = curve.prepare(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// prepare validates the curve and fits it to its points, ready to be applied.
+func (c *CalibrationCurve) prepare() (err error) {
+	sort.Slice(c.Points, func(i, j int) bool { return c.Points[i].Counts < c.Points[j].Counts })
+
+	switch c.Type {
+	case CURVE_PIECEWISE:
+		c.Degree = 0
+		c.Coefficients = nil
+		if len(c.Points) < 2 {
+			return errors.New("Piecewise curves need at least 2 points")
+		}
+		for i := 1; i < len(c.Points); i++ {
+			if c.Points[i].Counts == c.Points[i-1].Counts {
+				return errors.New(fmt.Sprintf("Multiple points at %v counts", c.Points[i].Counts))
+			}
+		}
+
+	case CURVE_POLYNOMIAL:
+		if c.Degree <= 0 {
+			c.Degree = DEFAULT_CURVE_DEGREE
+		}
+		if len(c.Points) <= c.Degree {
+			return errors.New(fmt.Sprintf("Polynomial curves of degree %d need at least %d points", c.Degree, c.Degree+1))
+		}
+		if c.Coefficients, err = fitPolynomial(c.Points, c.Degree); err != nil {
+			return err
+		}
+
+	default:
+		return errors.New(fmt.Sprintf("Unkown curve type %s", c.Type))
+	}
+
+	c.Fit = c.fitQuality()
+	return nil
+}
+
+// prepared gives a prepared copy of the curve, with its points sorted and its fit worked out, leaving the curve and
+// its points as they were. A nil curve gives nil.
+func (c *CalibrationCurve) prepared() (*CalibrationCurve, error) {
+	if c == nil {
+		return nil, nil
+	}
+	prepared := *c
+	prepared.Points = append([]CalibrationPoint(nil), c.Points...)
+	if err := prepared.prepare(); err != nil {
+		return nil, err
+	}
+	return &prepared, nil
+}
+
+// Apply converts counts to pressure in kPa.
+func (c *CalibrationCurve) Apply(counts float64) float64 {
+	if c.Type == CURVE_POLYNOMIAL {
+		return evalPolynomial(c.Coefficients, counts)
+	}
+	return interpolate(c.Points, counts)
+}
+
+// fitQuality works out the residuals of the curve against its points.
+func (c *CalibrationCurve) fitQuality() (fit CurveFit) {
+	var mean float64
+	for _, p := range c.Points {
+		mean += p.Load
+	}
+	mean /= float64(len(c.Points))
+
+	var ssRes, ssTot float64
+	var n int
+	for i, p := range c.Points {
+		var predicted float64
+		if c.Type == CURVE_POLYNOMIAL {
+			predicted = evalPolynomial(c.Coefficients, p.Counts)
+		} else {
+			// the ends cannot be left out without extrapolating, which says little about the sensor
+			if i == 0 || i == len(c.Points)-1 {
+				continue
+			}
+			others := append(append([]CalibrationPoint(nil), c.Points[:i]...), c.Points[i+1:]...)
+			predicted = interpolate(others, p.Counts)
+		}
+
+		residual := p.Load - predicted
+		ssRes += residual * residual
+		ssTot += (p.Load - mean) * (p.Load - mean)
+		fit.MaxError = math.Max(fit.MaxError, math.Abs(residual))
+		n++
+	}
+
+	fit.RSquared = 1
+	if n > 0 {
+		fit.RMSE = math.Sqrt(ssRes / float64(n))
+		if ssTot > 0 {
+			fit.RSquared = 1 - ssRes/ssTot
+		}
+	}
+	return
+}
+
+// interpolate finds the load for the counts along the line between the surrounding points.
+// Counts outside the points are extrapolated from the nearest segment. Points must be sorted.
+func interpolate(points []CalibrationPoint, counts float64) float64 {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Counts >= counts })
+	if i == 0 {
+		i = 1
+	} else if i == len(points) {
+		i = len(points) - 1
+	}
+
+	a, b := points[i-1], points[i]
+	return a.Load + (counts-a.Counts)*(b.Load-a.Load)/(b.Counts-a.Counts)
+}
+
+// evalPolynomial evaluates the polynomial with coefficients lowest order first.
+func evalPolynomial(coefficients []float64, x float64) (y float64) {
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = y*x + coefficients[i]
+	}
+	return
+}
+
+// fitPolynomial performs a least squares fit of a polynomial of the given degree through the points.
+// Counts are normalised before solving the normal equations to keep them well conditioned for 12 bit values.
+func fitPolynomial(points []CalibrationPoint, degree int) ([]float64, error) {
+	var scale float64
+	for _, p := range points {
+		scale = math.Max(scale, math.Abs(p.Counts))
+	}
+	if scale == 0 {
+		scale = 1
+	}
+
+	n := degree + 1
+	// augmented matrix of the normal equations
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = make([]float64, n+1)
+	}
+	for _, p := range points {
+		x := p.Counts / scale
+		for i := 0; i < n; i++ {
+			xi := math.Pow(x, float64(i))
+			for j := 0; j < n; j++ {
+				m[i][j] += xi * math.Pow(x, float64(j))
+			}
+			m[i][n] += xi * p.Load
+		}
+	}
+
+	// gaussian elimination with partial pivoting
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, errors.New("Unable to fit polynomial to the points")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+
+		for row := col + 1; row < n; row++ {
+			f := m[row][col] / m[col][col]
+			for k := col; k <= n; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+		}
+	}
+
+	coefficients := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := m[row][n]
+		for k := row + 1; k < n; k++ {
+			sum -= m[row][k] * coefficients[k]
+		}
+		coefficients[row] = sum / m[row][row]
+	}
+
+	// undo the normalisation
+	for i := range coefficients {
+		coefficients[i] /= math.Pow(scale, float64(i))
+	}
+	return coefficients, nil
+}
@@ -0,0 +1,146 @@
+package onboard
+
+import (
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+const kCurveTolerance = 0.01
+
+func TestCalibrationCurve(t *testing.T) {
+	// a sensor which saturates as the load increases
+	points := []CalibrationPoint{
+		{0, 0},
+		{1000, 50},
+		{2000, 150},
+		{3000, 300},
+		{3500, 500},
+	}
+
+	Convey("Piecewise curves", t, func() {
+		curve, err := FitCurve(CURVE_PIECEWISE, 0, points)
+		So(err, ShouldBeNil)
+
+		Convey("pass through every point", func() {
+			for _, p := range points {
+				So(curve.Apply(p.Counts), ShouldAlmostEqual, p.Load, kCurveTolerance)
+			}
+		})
+
+		Convey("interpolate between points", func() {
+			So(curve.Apply(1500), ShouldAlmostEqual, 100, kCurveTolerance)
+			So(curve.Apply(3250), ShouldAlmostEqual, 400, kCurveTolerance)
+		})
+
+		Convey("extrapolate from the end segments", func() {
+			So(curve.Apply(4000), ShouldAlmostEqual, 700, kCurveTolerance)
+			So(curve.Apply(-1000), ShouldAlmostEqual, -50, kCurveTolerance)
+		})
+
+		Convey("report the fit from the interior points", func() {
+			So(curve.Fit.MaxError, ShouldBeGreaterThan, 0)
+			So(curve.Fit.RSquared, ShouldBeLessThan, 1)
+		})
+
+		Convey("points out of order are sorted", func() {
+			curve, err := FitCurve(CURVE_PIECEWISE, 0, []CalibrationPoint{{2000, 20}, {0, 0}, {1000, 10}})
+			So(err, ShouldBeNil)
+			So(curve.Apply(500), ShouldAlmostEqual, 5, kCurveTolerance)
+		})
+
+		Convey("need distinct points", func() {
+			_, err := FitCurve(CURVE_PIECEWISE, 0, []CalibrationPoint{{0, 0}})
+			So(err, ShouldNotBeNil)
+			_, err = FitCurve(CURVE_PIECEWISE, 0, []CalibrationPoint{{0, 0}, {0, 10}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Polynomial curves", t, func() {
+		Convey("exactly fit a polynomial", func() {
+			// load = 2 + 0.01x + 0.00002x²
+			exact := make([]CalibrationPoint, 0)
+			for x := 0.0; x <= 4000; x += 500 {
+				exact = append(exact, CalibrationPoint{x, 2 + 0.01*x + 0.00002*x*x})
+			}
+
+			curve, err := FitCurve(CURVE_POLYNOMIAL, 2, exact)
+			So(err, ShouldBeNil)
+			So(curve.Coefficients, ShouldHaveLength, 3)
+			So(curve.Coefficients[0], ShouldAlmostEqual, 2, kCurveTolerance)
+			So(curve.Apply(1234), ShouldAlmostEqual, 2+12.34+0.00002*1234*1234, kCurveTolerance)
+			So(curve.Fit.RSquared, ShouldAlmostEqual, 1, kCurveTolerance)
+			So(curve.Fit.RMSE, ShouldAlmostEqual, 0, kCurveTolerance)
+		})
+
+		Convey("report a poor fit", func() {
+			linear, err := FitCurve(CURVE_POLYNOMIAL, 1, points)
+			So(err, ShouldBeNil)
+			cubic, err := FitCurve(CURVE_POLYNOMIAL, 3, points)
+			So(err, ShouldBeNil)
+			So(linear.Fit.RMSE, ShouldBeGreaterThan, cubic.Fit.RMSE)
+			So(linear.Fit.RSquared, ShouldBeLessThan, cubic.Fit.RSquared)
+		})
+
+		Convey("default to degree 2", func() {
+			curve, err := FitCurve(CURVE_POLYNOMIAL, 0, points)
+			So(err, ShouldBeNil)
+			So(curve.Degree, ShouldEqual, DEFAULT_CURVE_DEGREE)
+		})
+
+		Convey("need more points than the degree", func() {
+			_, err := FitCurve(CURVE_POLYNOMIAL, 4, points[:3])
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Unknown curve types are rejected", t, func() {
+		_, err := FitCurve("spline", 0, points)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Sensor uses the curve for pressure", t, func() {
+		msb := &MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}
+		sb := NewSensorBoard(msb, 0)
+		sensor, _ := NewSensor(sb, 1, false, 2, 2, 0, 2047, 4095, 0)
+		for i := 0; i < sb_ROWS*sb_COLS; i++ {
+			binary.BigEndian.PutUint16(msb.data[i*2:], 1500)
+		}
+		sb.read()
+
+		linear := sensor.GetPressure(0, 0)
+		curve, _ := FitCurve(CURVE_PIECEWISE, 0, points)
+		So(sensor.SetCurve(curve), ShouldBeNil)
+		So(sensor.GetPressure(0, 0), ShouldAlmostEqual, 100, kCurveTolerance)
+
+		So(sensor.SetCurve(nil), ShouldBeNil)
+		So(sensor.GetPressure(0, 0), ShouldEqual, linear)
+
+		So(sensor.SetCurve(&CalibrationCurve{Type: CURVE_PIECEWISE}), ShouldNotBeNil)
+
+		Convey("without reordering the points it was given", func() {
+			unsorted := []CalibrationPoint{points[2], points[0], points[1]}
+			given := append([]CalibrationPoint(nil), unsorted...)
+			So(sensor.SetCurve(&CalibrationCurve{Type: CURVE_PIECEWISE, Points: unsorted}), ShouldBeNil)
+			So(unsorted, ShouldResemble, given)
+		})
+
+		Convey("and the device records the prepared curve with its fit", func() {
+			dynastat := &Dynastat{
+				sensors: map[string]SensorInterface{"TestSensor": sensor},
+				config:  &DynastatConfig{Sensors: map[string]SensorConfig{"TestSensor": {Rows: 2, Cols: 2}}},
+			}
+			unsorted := []CalibrationPoint{points[2], points[0], points[1]}
+			given := &CalibrationCurve{Type: CURVE_PIECEWISE, Points: unsorted}
+			So(dynastat.SetSensorCurve("TestSensor", given), ShouldBeNil)
+
+			recorded := dynastat.config.Sensors["TestSensor"].Curve
+			So(recorded, ShouldNotPointTo, given)
+			So(recorded.Points, ShouldResemble, points[:3])
+			fitted, _ := FitCurve(CURVE_PIECEWISE, 0, points[:3])
+			So(recorded.Fit, ShouldResemble, fitted.Fit)
+			So(given.Fit, ShouldResemble, CurveFit{})
+		})
+	})
+}
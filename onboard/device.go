@@ -11,16 +11,24 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jacobsa/go-serial/serial"
+	"gopkg.in/yaml.v2"
 	"io"
 	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
 	FRAMERATE = 30
-	i2c_SLAVE = 0x0703
+	// MAX_SAMPLE_RATE is the fastest a sensor board can be polled in Hz
+	MAX_SAMPLE_RATE = 200
+	i2c_SLAVE       = 0x0703
+	i2c_RDWR        = 0x0707
+	i2c_M_RD        = 0x0001
 
 	sb_REG_VALUES = 0x0100
 	sb_REG_ADDR   = 0x0004
@@ -31,12 +39,21 @@ const (
 	s_BANK1_COLS  = 16
 	s_BANK2_COLS  = 8
 
+	// DEFAULT_FULL_SCALE is the pressure in kPa represented by a sensors full value when none is configured
+	DEFAULT_FULL_SCALE = 600
+
 	// Switch MCU
 	sm_ADDRESS    = 0x20
 	sm_REG_ID     = 0x0000
 	sm_REG_VALUES = 0x0003
 	sm_KNOWN_ID   = 0xFE00
 
+	// UART MCU
+	// DEFAULT_UART_TIMEOUT is how long to wait for the response to a request when none is configured
+	DEFAULT_UART_TIMEOUT = 100 * time.Millisecond
+	uart_MAX_LINE        = 64 // longer lines are garbage
+	uart_LINE_BUFFER     = 16 // lines waiting to be read before new lines are dropped
+
 	// Motor constants
 	m_BITS          = 8
 	m_REG_MAX_SPEED = 0
@@ -47,13 +64,19 @@ const (
 	m_REG_RELATIVE  = 8
 )
 
+// ErrNoResponse is given when the MCU reports the motor did not answer it.
+var ErrNoResponse = errors.New("No response from motor")
+
 type UARTMCU struct {
-	port io.ReadWriteCloser
-	lock sync.Mutex
+	port    io.ReadWriteCloser
+	lines   chan string // complete lines read from the port
+	timeout time.Duration
+	err     error // set once the port can no longer be read
+	lock    sync.Mutex
 }
 
 type UARTMCUInterface interface {
-	Put(i2cAddr int, cmd uint8, value int32)
+	Put(i2cAddr int, cmd uint8, value int32) error
 	Get(i2cAddr int, cmd uint8) (value int32, err error)
 }
 
@@ -63,31 +86,83 @@ type I2CBus struct {
 }
 
 type I2CBusInterface interface {
-	Get(i2cAddr int, reg uint16, buf []byte)
-	Put(i2cAddr int, reg uint16, buf []byte)
+	Get(i2cAddr int, reg uint16, buf []byte) error
+	Put(i2cAddr int, reg uint16, buf []byte) error
+}
+
+// i2cMsg mirrors struct i2c_msg from linux/i2c.h
+type i2cMsg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	buf   unsafe.Pointer // tracked by the runtime so it stays valid if the stack moves
+}
+
+// i2cRdwrData mirrors struct i2c_rdwr_ioctl_data from linux/i2c-dev.h
+type i2cRdwrData struct {
+	msgs  unsafe.Pointer
+	nmsgs uint32
+}
+
+// SensorFrame is a snapshot of every value on a sensor board from a single I2C read.
+// Frames are never modified once they have been swapped in so they can be shared without locking.
+// Capture is the sequence number of the capture the frame was read in, 0 if the board is updating on its own.
+type SensorFrame struct {
+	Seq     uint64
+	Time    time.Time
+	Capture uint64
+	values  []uint16
 }
 
 type SensorBoard struct {
-	i2cBus  I2CBusInterface
-	address int
-	buf     []byte
+	i2cBus   I2CBusInterface
+	address  int
+	buf      []byte       // back buffer for the next I2C read
+	frame    *SensorFrame // latest complete frame
+	err      error        // error from the last read, nil once a read succeeds
+	rate     int          // Hz
+	baseline []float64
+	lock     sync.RWMutex
 }
 
 type Sensor struct {
 	board        *SensorBoard
 	zeroValue    uint16
 	scaleFactor  float64
+	fullScale    float64
+	gain, offset []float64
+	curve        *CalibrationCurve
 	mirror       bool
 	rows, cols   int
 	oRows, oCols int
 }
 
-type SensorState [][]int
+type SensorState [][]float64
+
+// PressureUnit selects the units sensor values are reported in.
+type PressureUnit string
+
+const (
+	UNIT_SCALED PressureUnit = "scaled" // 0-255 application range
+	UNIT_RAW    PressureUnit = "raw"    // counts straight from the sensor board
+	UNIT_KPA    PressureUnit = "kpa"    // calibrated pressure in kPa
+)
 
 type SensorInterface interface {
 	SetScale(zero, half, full uint16)
+	SetEqualisation(eq SensorEqualisation) error
+	SetCurve(curve *CalibrationCurve) error
 	GetValue(row, col int) uint8
-	GetState() SensorState
+	GetRaw(row, col int) uint16
+	GetPressure(row, col int) float64
+	GetState(units PressureUnit) SensorState
+}
+
+// sensorSource is implemented by sensors which make frames of their own rather than being read from a SensorBoard,
+// so the frames they miss and the boards they are on can still be reported.
+type sensorSource interface {
+	sample() Sample
+	boardErr() (address int, err error)
 }
 
 type SwitchMCU struct {
@@ -107,68 +182,149 @@ type RMCS220xMotor struct {
 
 type MotorState struct {
 	Target, Current int
+	Units           map[string]MotorUnitState `json:",omitempty"` // target and current in each configured unit
+}
+
+// configurableMotor is implemented by motors which can take a new range, speed and damping in place once they have
+// been calibrated. Other motors are set up again from their config.
+type configurableMotor interface {
+	configure(rawLow, rawHigh int, speed, damping int32) error
 }
 
 type MotorInterface interface {
-	SetTarget(target int)
+	SetTarget(target int) error
 	GetPosition() (position int, err error)
 	Home(calibrationValue int) error
 	GetState() (state MotorState, err error)
 	getRaw(reg uint8) (int, error)
-	putRaw(reg uint8, val int)
+	putRaw(reg uint8, val int) error
 	findHome(reverse bool) error
 }
 
 type Dynastat struct {
-	Motors    map[string]MotorInterface
-	sensors   map[string]SensorInterface
-	SensorBus I2CBusInterface
-	motorBus  UARTMCUInterface
-	switches  *SwitchMCU
-	config    *DynastatConfig
-	lock      sync.Mutex
+	Motors       map[string]MotorInterface
+	sensors      map[string]SensorInterface
+	boards       map[int]*SensorBoard
+	scheduler    *CaptureScheduler
+	diagnostics  map[string]*SensorDiagnostics
+	units        PressureUnit
+	tared        time.Time
+	tareDone     chan struct{} // closed to stop the automatic re-tare
+	seq          uint64
+	motorStates  map[string]MotorState // last state read from each motor
+	motorSamples map[string]Sample
+	motorPolled  map[string]time.Time // when each motor was last read
+	motorLock    sync.Mutex           // held while reading the motors in place of the device lock
+	move         *MotorMove           // latest move of several motors together
+	moves        uint64
+	moveLock     sync.Mutex
+	health       hardwareHealth
+	SensorBus    I2CBusInterface
+	motorBus     UARTMCUInterface
+	switches     *SwitchMCU
+	config       *DynastatConfig
+	lock         sync.Mutex
 }
 
 type DynastatConfig struct {
 	Version          int
 	SignalingServers []string
+	SensorUnits      PressureUnit
+	Tare             TareConfig
+	Diagnostics      DiagnosticsConfig
+	Boards           map[int]BoardConfig // keyed by address
+	Retry            RetryPolicy
+	Simulator        SimulatorConfig // pressure synthesised and faults injected when running without the hardware
 	I2CBus           struct {
 		Sensor int
 	}
 	UART struct {
-		Motor string
-	}
-	Motors map[string]struct {
-		Address        int
-		Cal, Low, High int
-		Speed, Damping int32
-		Control        uint16
-	}
-	Sensors map[string]struct {
-		Address                         int
-		Mode                            uint8
-		Registry                        uint
-		Mirror                          bool
-		Rows, Cols                      int
-		ZeroValue, HalfValue, FullValue uint16
+		Motor   string
+		Timeout time.Duration // per request, DEFAULT_UART_TIMEOUT if 0
+		Rate    int           // Hz the motors are read at for the state, FRAMERATE if 0
 	}
+	Motors  map[string]MotorConfig
+	Sensors map[string]SensorConfig
+}
+
+// MotorConfig sets up a motor. Low and High are the raw encoder counts at either end of the 0-255 application range
+// and Cal is the count at the home switch. Units gives the physical positions the motor can also be driven in.
+type MotorConfig struct {
+	Address        int
+	Cal, Low, High int
+	Speed, Damping int32
+	Control        uint16
+	Units          map[string]MotorUnit `yaml:",omitempty"` // keyed by unit name, e.g. deg or mm
+}
+
+// BoardConfig holds the settings shared by every sensor on a sensor board.
+// SampleRate is how often the board is polled in Hz, FRAMERATE is used if it is 0.
+type BoardConfig struct {
+	SampleRate int
+}
+
+type SensorConfig struct {
+	Address                         int
+	Mode                            uint8
+	Registry                        uint
+	Mirror                          bool
+	Rows, Cols                      int
+	ZeroValue, HalfValue, FullValue uint16
+	FullScale                       float64
+	Equalisation                    SensorEqualisation
+	Curve                           *CalibrationCurve  `yaml:",omitempty"`
+	Calibration                     *CalibrationRecord `yaml:",omitempty"`
+	Foot                            string
+	Geometry                        SensorGeometry
+}
+
+// Sample identifies the reading behind part of the state so clients can spot dropped frames and line data up in time.
+// Seq increases by one for every frame read from a sensor board or every poll of a motor. Age is how long before the
+// state was built the reading was taken. Frames counts the readings combined into a broadcast, the latest of which the
+// rest of the sample is from, and is 0 for a single reading.
+type Sample struct {
+	Seq     uint64
+	Time    time.Time
+	Age     time.Duration
+	Capture uint64
+	Frames  int
 }
 
 type DynastatState struct {
-	Motors  map[string]MotorState
-	Sensors map[string]SensorState
+	Seq           uint64
+	Time          time.Time
+	Capture       Capture
+	Motors        map[string]MotorState
+	Sensors       map[string]SensorState
+	MotorSamples  map[string]Sample
+	SensorSamples map[string]Sample
+	Units         PressureUnit
+	CoP           PressureCentres
+	Faults        map[string][]SenselFault
+	Degraded      map[string]string // failing hardware with the last error from each
+	Move          *MoveProgress     // latest move of several motors together, nil before the first
 }
 
 type DynastatInterface interface {
 	GetState() (DynastatState, error)
 	GetConfig() *DynastatConfig
+	MarshalConfig() ([]byte, error)
+	PlateCoordinate(name string, row, col int) (point Point, err error)
+	PressureCentres(sensors map[string]SensorState) PressureCentres
+	SetSensorUnits(units PressureUnit) error
+	NewSensorCalibrator(name string, kind CurveType, degree int, area float64) (*SensorCalibrator, error)
+	Tare() error
+	SampleRate() int
 	SetMotor(name string, position int) (err error)
+	SetMotorPosition(name string, position MotorPosition) error
+	MotorTargets(positions map[string]MotorPosition) (map[string]int, error)
 	HomeMotor(name string) error
 	GotoMotorRaw(name string, position int) error
 	WriteMotorRaw(name string, position int) error
 	RecordMotorLow(name string) error
 	RecordMotorHigh(name string) error
 	RecordMotorHome(name string, reverse bool) (pos int, err error)
+	MoveMotors(targets map[string]int, tolerance int, timeout time.Duration) (*MotorMove, error)
 }
 
 // Generic functions
@@ -190,7 +346,8 @@ func translateValue(val, leftMin, leftMax, rightMin, rightMax int) int {
 
 // OpenUARTMCU performs the necessary actions to open a new UART connection on the device.
 // This sets up the UART port for propper communication with the hardware.
-func OpenUARTMCU(ttyName string) *UARTMCU {
+// timeout is how long each request waits for its response, DEFAULT_UART_TIMEOUT is used if it is 0.
+func OpenUARTMCU(ttyName string, timeout time.Duration) (*UARTMCU, error) {
 	port, err := serial.Open(serial.OpenOptions{
 		PortName:              ttyName,
 		BaudRate:              115200,
@@ -200,11 +357,22 @@ func OpenUARTMCU(ttyName string) *UARTMCU {
 	})
 
 	if err != nil {
-		panic(fmt.Sprintf("Unable to open UART %s: %v", ttyName, err))
-		return nil
+		return nil, errors.New(fmt.Sprintf("Unable to open UART %s: %v", ttyName, err))
+	}
+	return NewUARTMCU(port, timeout), nil
+}
+
+// NewUARTMCU starts reading responses from an open port.
+func NewUARTMCU(port io.ReadWriteCloser, timeout time.Duration) *UARTMCU {
+	if timeout <= 0 {
+		timeout = DEFAULT_UART_TIMEOUT
+	}
+	mcu := &UARTMCU{
+		port:    port,
+		lines:   make(chan string, uart_LINE_BUFFER),
+		timeout: timeout,
 	}
-	mcu := new(UARTMCU)
-	mcu.port = port
+	go mcu.readLines()
 	return mcu
 }
 
@@ -213,52 +381,140 @@ func (mcu *UARTMCU) Close() {
 	mcu.port.Close()
 }
 
+// readLines splits everything read from the port into lines until the port is closed.
+// Overlong lines are thrown away so a stream of garbage cannot grow without bound, and lines nobody is waiting for
+// are dropped once the buffer is full.
+func (mcu *UARTMCU) readLines() {
+	buf := make([]byte, uart_MAX_LINE)
+	line := make([]byte, 0, uart_MAX_LINE)
+	overflow := false
+	for {
+		n, err := mcu.port.Read(buf)
+		for _, b := range buf[:n] {
+			switch {
+			case b == '\n':
+				if !overflow {
+					select {
+					case mcu.lines <- string(line):
+					default:
+					}
+				}
+				line = line[:0]
+				overflow = false
+			case len(line) >= uart_MAX_LINE:
+				overflow = true
+			default:
+				line = append(line, b)
+			}
+		}
+
+		// the port gives EOF each time the inter character timeout passes without any data
+		if err != nil && err != io.EOF {
+			mcu.err = err
+			close(mcu.lines)
+			return
+		}
+	}
+}
+
+// drain throws away any lines waiting from before a request, such as late responses to requests which timed out.
+func (mcu *UARTMCU) drain() {
+	for {
+		select {
+		case _, ok := <-mcu.lines:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// parseResponse reads the value or error from a line of the response.
+// Control characters and noise around the line are ignored, ok is false if the line is not a response at all.
+func parseResponse(line string) (value int32, err error, ok bool) {
+	line = strings.TrimFunc(line, func(r rune) bool { return r <= ' ' || r > '~' })
+
+	if strings.HasPrefix(line, "ERROR") {
+		if line == "ERROR NO RESPONSE" {
+			return 0, ErrNoResponse, true
+		}
+		return 0, errors.New(fmt.Sprintf("MCU reported %s", line)), true
+	}
+
+	v, perr := strconv.ParseInt(line, 10, 32)
+	if perr != nil {
+		return 0, nil, false
+	}
+	return int32(v), nil, true
+}
+
 // Put sends date out to the UARTMCU in the required format to act on a motor.
 // More features may be added later.
-func (mcu *UARTMCU) Put(i2cAddr int, cmd uint8, value int32) {
+func (mcu *UARTMCU) Put(i2cAddr int, cmd uint8, value int32) error {
 	buf := fmt.Sprintf("M%d %d %d\n", i2cAddr, cmd, value)
 
 	// Keep as little processing outside the critical section as possible
 	mcu.lock.Lock()
 	defer mcu.lock.Unlock()
-	mcu.port.Write([]byte(buf))
+	if _, err := mcu.port.Write([]byte(buf)); err != nil {
+		return errors.New(fmt.Sprintf("UART write to motor 0x%x failed: %v", i2cAddr, err))
+	}
+	return nil
 }
 
-// Get returns values from the MCU on the specified registry
+// Get returns values from the MCU on the specified registry.
+// Lines which are not a response are skipped until one is found or the request times out, so the reader
+// resynchronises after any garbage on the line. Failed requests are retried by the retry policy of the device.
 func (mcu *UARTMCU) Get(i2cAddr int, cmd uint8) (value int32, err error) {
 	// Create buffers and format strings outside of cricial section
 	wbuf := fmt.Sprintf("M%d %d\n", i2cAddr, cmd)
-	rbuf := make([]byte, 18)
 
 	// Perform read/write in critical section - keep to minimum to prevent excessive locking between threads
 	mcu.lock.Lock()
 	defer mcu.lock.Unlock()
-	mcu.port.Write([]byte(wbuf))
-	i, err := mcu.port.Read(rbuf)
-	if i == 0 || err != nil {
-		return 0, err
+	mcu.drain()
+	if _, err = mcu.port.Write([]byte(wbuf)); err != nil {
+		return 0, errors.New(fmt.Sprintf("UART write to motor 0x%x failed: %v", i2cAddr, err))
 	}
 
-	resp := string(rbuf)
-	if resp == "ERROR NO RESPONSE" {
-		return 0xEEEEEEE, errors.New("No response from motor")
-	}
+	deadline := time.NewTimer(mcu.timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case line, open := <-mcu.lines:
+			if !open {
+				return 0, errors.New(fmt.Sprintf("UART read from motor 0x%x failed: %v", i2cAddr, mcu.err))
+			}
+			value, err, ok := parseResponse(line)
+			if !ok {
+				continue
+			}
+			return value, err
 
-	fmt.Sscanf(string(rbuf), "%d", &value)
-	return
+		case <-deadline.C:
+			return 0, errors.New(fmt.Sprintf("Timed out waiting for motor 0x%x after %v", i2cAddr, mcu.timeout))
+		}
+	}
 }
 
 // I2C related functions
 
 // OpenI2C performs the actions necessary to create the I2CBus object.
 // This opens the file and does very basic error checking on it
-func OpenI2C(dev string) *I2CBus {
+func OpenI2C(dev string) (*I2CBus, error) {
 	fd, err := syscall.Open(dev, syscall.O_RDWR, 0777)
 	if err != nil {
-		panic(err)
+		return nil, errors.New(fmt.Sprintf("Unable to open I2C bus %s: %v", dev, err))
 	}
 
-	return &I2CBus{fd: fd}
+	return &I2CBus{fd: fd}, nil
+}
+
+// Close releases the file descriptor of the bus.
+func (bus *I2CBus) Close() error {
+	return syscall.Close(bus.fd)
 }
 
 // ioctl proxy to appropriate syscall method.
@@ -271,33 +527,60 @@ func ioctl(fd, cmd, arg uintptr) (err error) {
 	return
 }
 
-// Connect send the commands to put the receiving device into slave mode so it can accept commands from the BBB
-func (bus *I2CBus) Connect(i2cAddr int) {
-	if err := ioctl(uintptr(bus.fd), i2c_SLAVE, uintptr(i2cAddr)); err != nil {
-		panic(err)
+// Connect send the commands to put the receiving device into slave mode so it can accept plain reads and writes.
+// Get and Put address each device directly so this is only needed when using the file descriptor by hand.
+func (bus *I2CBus) Connect(i2cAddr int) error {
+	return ioctl(uintptr(bus.fd), i2c_SLAVE, uintptr(i2cAddr))
+}
+
+// transfer performs the messages as a single combined transaction using a repeated start between each message.
+func (bus *I2CBus) transfer(msgs []i2cMsg) error {
+	data := i2cRdwrData{
+		msgs:  unsafe.Pointer(&msgs[0]),
+		nmsgs: uint32(len(msgs)),
 	}
-	return
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	// the pointer is converted in the call itself so data is kept in place until the syscall returns
+	_, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, uintptr(bus.fd), i2c_RDWR, uintptr(unsafe.Pointer(&data)))
+	if e1 != 0 {
+		return e1
+	}
+	return nil
 }
 
 // Get performs write/read to get a value from an I2C device in a 16bit registry space.
+// The register write and the read are done as one transaction so no other master can get in between.
 // Thread-safe.
-func (bus *I2CBus) Get(i2cAddr int, reg uint16, buf []byte) {
+func (bus *I2CBus) Get(i2cAddr int, reg uint16, buf []byte) error {
+	if len(buf) == 0 || len(buf) > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("Invalid I2C read length %d", len(buf)))
+	}
+
 	// perform bitbashing to get write command first
 	wbuf := make([]byte, 2)
 	wbuf[0] = byte(reg >> 8 & 0xff)
 	wbuf[1] = byte(reg & 0xff)
 
-	bus.lock.Lock()
-	bus.Connect(i2cAddr)
-	// Do write/read inside critical section
-	syscall.Write(bus.fd, wbuf)
-	syscall.Read(bus.fd, buf)
-	bus.lock.Unlock()
+	msgs := []i2cMsg{
+		{addr: uint16(i2cAddr), len: uint16(len(wbuf)), buf: unsafe.Pointer(&wbuf[0])},
+		{addr: uint16(i2cAddr), flags: i2c_M_RD, len: uint16(len(buf)), buf: unsafe.Pointer(&buf[0])},
+	}
+	err := bus.transfer(msgs)
+	if err != nil {
+		return errors.New(fmt.Sprintf("I2C read of 0x%x reg 0x%x failed: %v", i2cAddr, reg, err))
+	}
+	return nil
 }
 
 // Put performs write to I2C device in a 16bit registry space.
 // Thread-safe
-func (bus *I2CBus) Put(i2cAddr int, reg uint16, buf []byte) {
+func (bus *I2CBus) Put(i2cAddr int, reg uint16, buf []byte) error {
+	if len(buf)+2 > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("Invalid I2C write length %d", len(buf)))
+	}
+
 	wbuf := make([]byte, len(buf)+2)
 	wbuf[0] = byte(reg >> 8 & 0xff)
 	wbuf[1] = byte(reg & 0xff)
@@ -306,37 +589,106 @@ func (bus *I2CBus) Put(i2cAddr int, reg uint16, buf []byte) {
 		wbuf[i+2] = b
 	}
 
-	bus.lock.Lock()
-	bus.Connect(i2cAddr)
-	syscall.Write(bus.fd, wbuf)
-	bus.lock.Unlock()
+	msgs := []i2cMsg{
+		{addr: uint16(i2cAddr), len: uint16(len(wbuf)), buf: unsafe.Pointer(&wbuf[0])},
+	}
+	err := bus.transfer(msgs)
+	if err != nil {
+		return errors.New(fmt.Sprintf("I2C write of 0x%x reg 0x%x failed: %v", i2cAddr, reg, err))
+	}
+	return nil
 }
 
 // Sensor Boards
 
-// Update routine to fetch new data from the board at the appropriate frame-rate
-func (sb *SensorBoard) Update() {
-	for {
-		sb.i2cBus.Get(sb.address, sb_REG_VALUES, sb.buf)
-		time.Sleep(time.Second / FRAMERATE)
+// NewSensorBoard creates a sensor board at the address with an empty frame ready to be updated.
+func NewSensorBoard(bus I2CBusInterface, address int) *SensorBoard {
+	return &SensorBoard{
+		i2cBus:  bus,
+		address: address,
+		buf:     make([]byte, sb_ROWS*sb_COLS*2),
+		frame:   &SensorFrame{values: make([]uint16, sb_ROWS*sb_COLS)},
+		rate:    FRAMERATE,
+	}
+}
+
+// SetSampleRate sets how often the board is polled in Hz. Must be called before the board is updated.
+func (sb *SensorBoard) SetSampleRate(rate int) error {
+	if rate <= 0 || rate > MAX_SAMPLE_RATE {
+		return errors.New(fmt.Sprintf("Sample rate %d outside of 1-%d Hz", rate, MAX_SAMPLE_RATE))
+	}
+	sb.rate = rate
+	return nil
+}
+
+// read fetches the values from the board outside of any capture.
+func (sb *SensorBoard) read() error {
+	_, err := sb.capture(0)
+	return err
+}
+
+// capture fetches the values from the board into the back buffer then swaps in a new frame built from them.
+// Readers holding the previous frame are unaffected. The previous frame is kept if the read fails.
+func (sb *SensorBoard) capture(capture uint64) (*SensorFrame, error) {
+	if err := sb.i2cBus.Get(sb.address, sb_REG_VALUES, sb.buf); err != nil {
+		sb.lock.Lock()
+		sb.err = err
+		sb.lock.Unlock()
+		return sb.Frame(), err
+	}
+
+	values := make([]uint16, sb_ROWS*sb_COLS)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(sb.buf[i*2:])
+	}
+
+	frame := &SensorFrame{
+		Seq:     sb.Frame().Seq + 1,
+		Time:    time.Now(),
+		Capture: capture,
+		values:  values,
 	}
+
+	sb.lock.Lock()
+	sb.frame = frame
+	sb.err = nil
+	sb.lock.Unlock()
+	return frame, nil
+}
+
+// Frame gives the latest complete frame from the board.
+func (sb *SensorBoard) Frame() *SensorFrame {
+	sb.lock.RLock()
+	defer sb.lock.RUnlock()
+	return sb.frame
+}
+
+// Err gives the error from the last read of the board, nil if it succeeded.
+func (sb *SensorBoard) Err() error {
+	sb.lock.RLock()
+	defer sb.lock.RUnlock()
+	return sb.err
 }
 
 // Sets the mode of the sensor board in the firmware
-func (sb *SensorBoard) SetMode(mode uint8) {
+func (sb *SensorBoard) SetMode(mode uint8) error {
 	buf := make([]byte, 1)
 	buf[0] = mode
-	sb.i2cBus.Put(sb.address, sb_REG_MODE, buf)
-	sb.i2cBus.Get(sb.address, sb_REG_MODE, buf)
+	if err := sb.i2cBus.Put(sb.address, sb_REG_MODE, buf); err != nil {
+		return errors.New(fmt.Sprintf("Unable to set sensor board mode 0x%x: %v", sb.address, err))
+	}
+	if err := sb.i2cBus.Get(sb.address, sb_REG_MODE, buf); err != nil {
+		return errors.New(fmt.Sprintf("Unable to read sensor board mode 0x%x: %v", sb.address, err))
+	}
 	if buf[0] != mode {
-		panic(fmt.Sprintf("Setting sensor board mode has not worked 0x%x got %d expected %d", sb.address, buf[0], mode))
+		return errors.New(fmt.Sprintf("Setting sensor board mode has not worked 0x%x got %d expected %d", sb.address, buf[0], mode))
 	}
+	return nil
 }
 
-// getValue returns a uint16 from the appropriate reg and +1 to ease with this process
+// getValue returns the value of the reg in the latest frame
 func (sb *SensorBoard) getValue(reg int) uint16 {
-	reg *= 2 // scale from 16bit to 8 bit
-	return binary.BigEndian.Uint16([]byte{sb.buf[reg], sb.buf[reg+1]})
+	return sb.Frame().values[reg]
 }
 
 // changeAddress updates the address register on the sensor board.
@@ -348,7 +700,9 @@ func (sb *SensorBoard) changeAddress(newAddr int) error {
 
 	// Read old address to sanity check
 	buf := make([]byte, 1)
-	sb.i2cBus.Get(sb.address, sb_REG_ADDR, buf)
+	if err := sb.i2cBus.Get(sb.address, sb_REG_ADDR, buf); err != nil {
+		return err
+	}
 	oldAddr := int(buf[0])
 
 	if oldAddr != sb.address {
@@ -356,14 +710,13 @@ func (sb *SensorBoard) changeAddress(newAddr int) error {
 	}
 
 	buf[0] = byte(newAddr)
-	sb.i2cBus.Put(sb.address, sb_REG_ADDR, buf)
-
-	return nil
+	return sb.i2cBus.Put(sb.address, sb_REG_ADDR, buf)
 }
 
 // NewSensor provides an individual sensor on the given sensor board.
+// fullScale is the pressure in kPa at the full value, DEFAULT_FULL_SCALE is used if it is 0.
 func NewSensor(board *SensorBoard, reg uint, mirror bool, rows, cols int,
-	zeroValue, halfValue, fullValue uint16) (sensor *Sensor, err error) {
+	zeroValue, halfValue, fullValue uint16, fullScale float64) (sensor *Sensor, err error) {
 
 	sensor = new(Sensor)
 	sensor.board = board
@@ -371,6 +724,11 @@ func NewSensor(board *SensorBoard, reg uint, mirror bool, rows, cols int,
 	sensor.rows = rows
 	sensor.cols = cols
 
+	sensor.fullScale = fullScale
+	if sensor.fullScale == 0 {
+		sensor.fullScale = DEFAULT_FULL_SCALE
+	}
+
 	switch reg {
 	case 1:
 		sensor.oCols = (s_BANK1_COLS - cols) / 2
@@ -388,6 +746,7 @@ func NewSensor(board *SensorBoard, reg uint, mirror bool, rows, cols int,
 	sensor.oRows = (sb_ROWS - rows) / 2
 
 	sensor.SetScale(zeroValue, halfValue, fullValue)
+	sensor.SetEqualisation(SensorEqualisation{})
 	return
 }
 
@@ -405,9 +764,9 @@ func (s *Sensor) SetScale(zero, half, full uint16) {
 	s.scaleFactor = (m1 + m2) / 2
 }
 
-// GetValue calculates the appropriate reg value then returns it from the board.
+// reg calculates the register on the board for the row and col.
 // Applies offsets if operating in two sensor mode.
-func (s *Sensor) GetValue(row, col int) uint8 {
+func (s *Sensor) reg(row, col int) int {
 	if s.mirror {
 		row = (s.rows - 1) - row
 		col = (s.cols - 1) - col
@@ -416,18 +775,105 @@ func (s *Sensor) GetValue(row, col int) uint8 {
 	row += s.oRows
 	col += s.oCols
 
-	i := row*sb_COLS + col
-	val := s.board.getValue(i)
-	return uint8(float64(val) / s.scaleFactor)
+	return row*sb_COLS + col
+}
+
+// GetRaw returns the raw count from the board.
+func (s *Sensor) GetRaw(row, col int) uint16 {
+	return s.raw(s.board.Frame(), row, col)
+}
+
+// raw returns the raw count from the frame.
+func (s *Sensor) raw(frame *SensorFrame, row, col int) uint16 {
+	return frame.values[s.reg(row, col)]
 }
 
-// GetState goes over all rows and cols on a sensor and gives values for this
-func (s *Sensor) GetState() (state SensorState) {
+// SetEqualisation applies the per sensel gain and offset matrices to the sensor.
+func (s *Sensor) SetEqualisation(eq SensorEqualisation) (err error) {
+	gain, offset, err := eq.flatten(s.rows, s.cols)
+	if err != nil {
+		return
+	}
+	s.gain, s.offset = gain, offset
+	return
+}
+
+// SetCurve replaces the linear full scale with a calibration curve when converting to kPa.
+// A nil curve returns the sensor to the linear full scale.
+// The sensor keeps its own prepared copy so the curve of the caller is left as it was.
+func (s *Sensor) SetCurve(curve *CalibrationCurve) error {
+	c, err := curve.prepared()
+	if err != nil {
+		return err
+	}
+	s.curve = c
+	return nil
+}
+
+// counts gives the raw value with the zero removed and the equalisation for the sensel applied.
+// The baseline of a tared board replaces the zero value and offset of the sensel.
+func (s *Sensor) counts(frame *SensorFrame, row, col int) float64 {
+	i := row*s.cols + col
+	reg := s.reg(row, col)
+
+	zero, tared := s.board.getBaseline(reg)
+	if !tared {
+		zero = float64(s.zeroValue) + s.offset[i]
+	}
+	return (float64(frame.values[reg]) - zero) * s.gain[i]
+}
+
+// scaled gives the value with the zero removed in the 0-255 application range, without any clamping.
+func (s *Sensor) scaled(frame *SensorFrame, row, col int) float64 {
+	return s.counts(frame, row, col) / s.scaleFactor
+}
+
+// GetValue gives the value in the 0-255 application range.
+// Values outside of the range are clamped rather than being allowed to wrap around.
+func (s *Sensor) GetValue(row, col int) uint8 {
+	return s.value(s.board.Frame(), row, col)
+}
+
+func (s *Sensor) value(frame *SensorFrame, row, col int) uint8 {
+	return uint8(math.Max(0, math.Min(s.scaled(frame, row, col), math.MaxUint8)))
+}
+
+// GetPressure gives the calibrated pressure in kPa at full resolution.
+// Uses the calibration curve if there is one, otherwise the linear full scale.
+func (s *Sensor) GetPressure(row, col int) float64 {
+	return s.pressure(s.board.Frame(), row, col)
+}
+
+func (s *Sensor) pressure(frame *SensorFrame, row, col int) float64 {
+	if s.curve != nil {
+		return math.Max(0, s.curve.Apply(s.counts(frame, row, col)))
+	}
+	return math.Max(0, s.scaled(frame, row, col)*s.fullScale/math.MaxUint8)
+}
+
+// GetState goes over all rows and cols on a sensor and gives values for this in the requested units.
+// Every value comes from the same frame of the board.
+func (s *Sensor) GetState(units PressureUnit) (state SensorState) {
+	return s.frameState(s.board.Frame(), units)
+}
+
+// frameState gives the values of the sensor in the frame in the requested units.
+func (s *Sensor) frameState(frame *SensorFrame, units PressureUnit) (state SensorState) {
+	var value func(row, col int) float64
+	switch units {
+	case UNIT_RAW:
+		value = func(row, col int) float64 { return float64(s.raw(frame, row, col)) }
+	case UNIT_KPA:
+		value = func(row, col int) float64 { return s.pressure(frame, row, col) }
+	default:
+		value = func(row, col int) float64 { return float64(s.value(frame, row, col)) }
+	}
+
 	state = make(SensorState, s.rows)
 	for i := 0; i < s.rows; i++ {
-		state[i] = make([]int, s.cols)
+		state[i] = make([]float64, s.cols)
 		for j := 0; j < s.cols; j++ {
-			state[i][j] = int(s.GetValue(i, j))
+			state[i][j] = value(i, j)
 		}
 	}
 	return state
@@ -444,7 +890,9 @@ func NewSwitchMCU(bus I2CBusInterface, address int) (mcu *SwitchMCU, err error)
 
 	// check ID reads correctly
 	buf := make([]byte, 2)
-	mcu.bus.Get(address, sm_REG_ID, buf)
+	if err = mcu.bus.Get(address, sm_REG_ID, buf); err != nil {
+		return nil, err
+	}
 	val := binary.LittleEndian.Uint16(buf)
 	if val != sm_KNOWN_ID {
 		return nil, errors.New(fmt.Sprintf("Switch MCU not recognised. Expected ID %x recieved %x", sm_KNOWN_ID, val))
@@ -455,7 +903,9 @@ func NewSwitchMCU(bus I2CBusInterface, address int) (mcu *SwitchMCU, err error)
 
 func (mcu *SwitchMCU) ReadInput(target uint16) (bool, error) {
 	buf := make([]byte, 2)
-	mcu.bus.Get(mcu.address, sm_REG_VALUES, buf)
+	if err := mcu.bus.Get(mcu.address, sm_REG_VALUES, buf); err != nil {
+		return true, err
+	}
 	val := binary.LittleEndian.Uint16(buf)
 	if val == 0 {
 		return true, errors.New("Switch MCU reported value of 0")
@@ -465,20 +915,26 @@ func (mcu *SwitchMCU) ReadInput(target uint16) (bool, error) {
 
 // RMCS220xMotor
 
-// scalePos takes in a value and either scales it up to 16bit motor range or down to 0-255 application range.
-func (m *RMCS220xMotor) scalePos(val int, up bool) int {
+// scaleMotorPos takes in a value and either scales it up to the raw motor range between rawLow and rawHigh or down
+// to 0-255 application range.
+func scaleMotorPos(val, rawLow, rawHigh int, up bool) int {
 	max := int(math.Pow(2, float64(m_BITS)))
 	if up {
-		return translateValue(val, 0, max, m.rawLow, m.rawHigh)
+		return translateValue(val, 0, max, rawLow, rawHigh)
 	} else {
-		val := translateValue(val, m.rawLow, m.rawHigh, 0, max)
+		val := translateValue(val, rawLow, rawHigh, 0, max)
 		return val
 	}
 }
 
+// scalePos takes in a value and either scales it up to 16bit motor range or down to 0-255 application range.
+func (m *RMCS220xMotor) scalePos(val int, up bool) int {
+	return scaleMotorPos(val, m.rawLow, m.rawHigh, up)
+}
+
 // writePosition performs the write to the motor.
-func (m *RMCS220xMotor) writePosition(pos int32) {
-	m.bus.Put(m.address, m_REG_GOTO, pos)
+func (m *RMCS220xMotor) writePosition(pos int32) error {
+	return m.bus.Put(m.address, m_REG_GOTO, pos)
 }
 
 // readPosition gets the Current position from the motors encoder.
@@ -488,9 +944,9 @@ func (m *RMCS220xMotor) readPosition() (val int32, err error) {
 }
 
 // SetTarget updates the Current Target in software and issues the write to the motor with the scaled value.
-func (m *RMCS220xMotor) SetTarget(target int) {
+func (m *RMCS220xMotor) SetTarget(target int) error {
 	m.target = target
-	m.writePosition(int32(m.scalePos(target, true)))
+	return m.writePosition(int32(m.scalePos(target, true)))
 }
 
 // GetPosition reads the position from motor and scales it to application range.
@@ -512,12 +968,13 @@ func (m *RMCS220xMotor) Home(cal int) (err error) {
 	}
 
 	time.Sleep(time.Second / 5)
-	m.bus.Put(m.address, m_REG_POSITION, int32(cal))
+	if err = m.bus.Put(m.address, m_REG_POSITION, int32(cal)); err != nil {
+		return err
+	}
 
 	// Sleep to allow the motor to reset the PID to the new encoder position and allow the MCU time to catch up
 	time.Sleep(time.Second / 5)
-	m.writePosition(0)
-	return
+	return m.writePosition(0)
 }
 
 // GetState provides information on the desired and Current position of the motor.
@@ -533,8 +990,8 @@ func (m *RMCS220xMotor) getRaw(reg uint8) (int, error) {
 	return int(raw), err
 }
 
-func (m *RMCS220xMotor) putRaw(reg uint8, val int) {
-	m.bus.Put(m.address, reg, int32(val))
+func (m *RMCS220xMotor) putRaw(reg uint8, val int) error {
+	return m.bus.Put(m.address, reg, int32(val))
 }
 
 func (m *RMCS220xMotor) findHome(reverse bool) (err error) {
@@ -551,18 +1008,23 @@ func (m *RMCS220xMotor) findHome(reverse bool) (err error) {
 
 	var home bool
 	for ; !home && err == nil; home, err = m.switches.ReadInput(m.control) {
-		m.bus.Put(m.address, m_REG_RELATIVE, inc)
+		if err = m.bus.Put(m.address, m_REG_RELATIVE, inc); err != nil {
+			break
+		}
 		time.Sleep(time.Millisecond * 5)
 	}
-	// all stop
-	m.bus.Put(m.address, m_REG_MANUAL, 0)
+	// all stop, even if the search failed
+	if stopErr := m.bus.Put(m.address, m_REG_MANUAL, 0); err == nil {
+		err = stopErr
+	}
 	return
 }
 
 // NewRMCS220xMotor sets up all the necessary components to run a motor through the custom MCU.
 // Also sets up the onboard controller of the motor to include desired speed and damping parameters.
+// The motor is always returned so it can be used once it responds, err is set if the parameters could not be written.
 func NewRMCS220xMotor(bus UARTMCUInterface, switches *SwitchMCU, control uint16,
-	address, rawLow, rawHigh int, speed, damping int32) (motor *RMCS220xMotor) {
+	address, rawLow, rawHigh int, speed, damping int32) (motor *RMCS220xMotor, err error) {
 
 	motor = new(RMCS220xMotor)
 	motor.bus = bus
@@ -575,61 +1037,127 @@ func NewRMCS220xMotor(bus UARTMCUInterface, switches *SwitchMCU, control uint16,
 	// calculate target and set to a raw value of zero
 	motor.target = motor.scalePos(0, false)
 
-	motor.bus.Put(motor.address, m_REG_MAX_SPEED, speed)
-	motor.bus.Put(motor.address, m_REG_DAMPING, damping)
+	if err = motor.bus.Put(motor.address, m_REG_MAX_SPEED, speed); err != nil {
+		return
+	}
+	err = motor.bus.Put(motor.address, m_REG_DAMPING, damping)
 	return
 }
 
 // Device level functions
 
 // NewDynastat sets up all the components of the device ready to go based on the config provided.
+// Hardware which cannot be reached does not stop the device, it is reported as degraded in the state and the rest of
+// the device carries on. Only errors in the config are returned.
 func NewDynastat(config *DynastatConfig) (dynastat *Dynastat, err error) {
+	// Open COM ports
+	var sensorBus I2CBusInterface
+	var motorBus UARTMCUInterface
+	i2c, i2cErr := OpenI2C(fmt.Sprintf("/dev/i2c-%d", config.I2CBus.Sensor))
+	if i2cErr == nil {
+		sensorBus = i2c
+	}
+	uart, uartErr := OpenUARTMCU(config.UART.Motor, config.UART.Timeout)
+	if uartErr == nil {
+		motorBus = uart
+	}
+
+	dynastat, err = NewDynastatWithBuses(config, sensorBus, motorBus)
+	if err != nil {
+		if i2cErr == nil {
+			i2c.Close()
+		}
+		if uartErr == nil {
+			uart.Close()
+		}
+		return nil, err
+	}
+	if i2cErr != nil {
+		dynastat.health.degrade(COMPONENT_I2C, i2cErr)
+	}
+	if uartErr != nil {
+		dynastat.health.degrade(COMPONENT_UART, uartErr)
+	}
+	return
+}
+
+// NewDynastatWithBuses sets up the device on buses which have already been opened, such as emulated hardware.
+// A nil bus is treated as one which could not be opened.
+func NewDynastatWithBuses(config *DynastatConfig, sensorBus I2CBusInterface, motorBus UARTMCUInterface) (dynastat *Dynastat, err error) {
+	if err = config.Upgrade(); err != nil {
+		return nil, err
+	}
+
 	dynastat = new(Dynastat)
 	dynastat.config = config
+	if err = dynastat.SetSensorUnits(config.SensorUnits); err != nil {
+		return nil, err
+	}
+
 	switch config.Version {
-	case 1:
+	case 2:
 		// initialise
 		dynastat.Motors = make(map[string]MotorInterface, len(config.Motors))
 		dynastat.sensors = make(map[string]SensorInterface, len(config.Sensors))
+		dynastat.boards = make(map[int]*SensorBoard)
 
-		// Open COM ports
-		dynastat.SensorBus = OpenI2C(fmt.Sprintf("/dev/i2c-%d", config.I2CBus.Sensor))
-		dynastat.motorBus = OpenUARTMCU(config.UART.Motor)
+		// every transfer on the buses is retried before it is treated as a failure
+		if sensorBus == nil {
+			dynastat.health.degrade(COMPONENT_I2C, errors.New("Sensor bus not connected"))
+		} else {
+			dynastat.SensorBus = NewRetryI2CBus(sensorBus, config.Retry)
+		}
+		if motorBus == nil {
+			dynastat.health.degrade(COMPONENT_UART, errors.New("Motor bus not connected"))
+		} else {
+			dynastat.motorBus = NewRetryUARTMCU(motorBus, config.Retry)
+		}
 
-		dynastat.switches, err = NewSwitchMCU(dynastat.SensorBus, sm_ADDRESS)
-		if err != nil {
-			fmt.Errorf("Unable to proceed with homing: %s", err)
-			dynastat.switches = nil
+		if dynastat.SensorBus != nil {
+			dynastat.switches, err = NewSwitchMCU(dynastat.SensorBus, sm_ADDRESS)
+			if err != nil {
+				// motors can still be driven but not homed
+				dynastat.health.degrade(COMPONENT_SWITCHES, err)
+				dynastat.switches = nil
+			}
 		}
 
-		for name, conf := range config.Motors {
-			dynastat.Motors[name] = NewRMCS220xMotor(
-				dynastat.motorBus,
-				dynastat.switches,
-				conf.Control,
-				conf.Address,
-				conf.Low,
-				conf.High,
-				conf.Speed,
-				conf.Damping,
-			)
+		if dynastat.motorBus != nil {
+			for name, conf := range config.Motors {
+				motor, err := NewRMCS220xMotor(
+					dynastat.motorBus,
+					dynastat.switches,
+					conf.Control,
+					conf.Address,
+					conf.Low,
+					conf.High,
+					conf.Speed,
+					conf.Damping,
+				)
+				dynastat.health.check(motorComponent(name), err)
+				dynastat.Motors[name] = motor
+			}
 		}
 
-		var sensorBoards map[int]*SensorBoard
 		for name, conf := range config.Sensors {
-			board, exists := sensorBoards[conf.Address]
+			if dynastat.SensorBus == nil {
+				// sensors cannot be read without the bus
+				break
+			}
+			board, exists := dynastat.boards[conf.Address]
 
 			if !exists {
-				board = &SensorBoard{
-					dynastat.SensorBus,
-					conf.Address,
-					make([]byte, sb_ROWS*sb_COLS*2),
+				board = NewSensorBoard(dynastat.SensorBus, conf.Address)
+				if rate := config.Boards[conf.Address].SampleRate; rate != 0 {
+					if err = board.SetSampleRate(rate); err != nil {
+						return nil, errors.New(fmt.Sprintf("Unable to set sample rate of board 0x%x: %v", conf.Address, err))
+					}
 				}
-				board.SetMode(conf.Mode)
-				go board.Update()
+				dynastat.health.check(boardModeComponent(conf.Address), board.SetMode(conf.Mode))
+				dynastat.boards[conf.Address] = board
 			}
 
-			dynastat.sensors[name], _ = NewSensor(
+			sensor, err := NewSensor(
 				board,
 				conf.Registry,
 				conf.Mirror,
@@ -638,7 +1166,32 @@ func NewDynastat(config *DynastatConfig) (dynastat *Dynastat, err error) {
 				conf.ZeroValue,
 				conf.HalfValue,
 				conf.FullValue,
+				conf.FullScale,
 			)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Unable to create sensor %s: %v", name, err))
+			}
+			if err = sensor.SetEqualisation(conf.Equalisation); err != nil {
+				return nil, errors.New(fmt.Sprintf("Unable to equalise sensor %s: %v", name, err))
+			}
+			// the config keeps the prepared curve so its fit is reported as it is for new calibrations
+			if conf.Curve, err = conf.Curve.prepared(); err == nil {
+				err = sensor.SetCurve(conf.Curve)
+			}
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Unable to apply curve to sensor %s: %v", name, err))
+			}
+			config.Sensors[name] = conf
+			dynastat.sensors[name] = sensor
+		}
+
+		// read every board from a single timer so the frames line up
+		dynastat.scheduler = NewCaptureScheduler(dynastat.boards)
+		go dynastat.scheduler.Run()
+
+		if config.Tare.Auto {
+			dynastat.tareDone = make(chan struct{})
+			go dynastat.autoTare(config.Tare, dynastat.tareDone)
 		}
 
 		break
@@ -646,7 +1199,7 @@ func NewDynastat(config *DynastatConfig) (dynastat *Dynastat, err error) {
 	default:
 		return nil, errors.New("Unkown config version")
 	}
-	return
+	return dynastat, nil
 }
 
 // SetMotor issues the write command to the desired motor with an application level value.
@@ -655,8 +1208,7 @@ func (d *Dynastat) SetMotor(name string, position int) (err error) {
 	if ok == false {
 		return errors.New(fmt.Sprintf("Unkown motor %s", name))
 	}
-	motor.SetTarget(position)
-	return nil
+	return d.health.check(motorComponent(name), motor.SetTarget(position))
 }
 
 func (d *Dynastat) HomeMotor(name string) (err error) {
@@ -664,8 +1216,7 @@ func (d *Dynastat) HomeMotor(name string) (err error) {
 	if ok == false {
 		return errors.New(fmt.Sprintf("Unable to find motor %s", name))
 	}
-	err = motor.Home(d.config.Motors[name].Cal)
-	return
+	return d.health.check(motorComponent(name), motor.Home(d.config.Motors[name].Cal))
 }
 
 func (d *Dynastat) GotoMotorRaw(name string, position int) (err error) {
@@ -673,8 +1224,7 @@ func (d *Dynastat) GotoMotorRaw(name string, position int) (err error) {
 	if !ok {
 		return errors.New(fmt.Sprintf("Unkown motor %s", name))
 	}
-	motor.putRaw(m_REG_GOTO, position)
-	return nil
+	return d.health.check(motorComponent(name), motor.putRaw(m_REG_GOTO, position))
 }
 
 func (d *Dynastat) WriteMotorRaw(name string, position int) (err error) {
@@ -682,8 +1232,30 @@ func (d *Dynastat) WriteMotorRaw(name string, position int) (err error) {
 	if !ok {
 		return errors.New(fmt.Sprintf("Unkown motor %s", name))
 	}
-	motor.putRaw(m_REG_POSITION, position)
-	return nil
+	return d.health.check(motorComponent(name), motor.putRaw(m_REG_POSITION, position))
+}
+
+// reconfigureMotor sets the motor up again from its config once it has been calibrated.
+// A motor which can be configured in place is kept so it keeps any state of its own.
+func (d *Dynastat) reconfigureMotor(name string) (motor MotorInterface, err error) {
+	conf := d.config.Motors[name]
+	if configurable, ok := d.Motors[name].(configurableMotor); ok {
+		err = configurable.configure(conf.Low, conf.High, conf.Speed, conf.Damping)
+		return d.Motors[name], d.health.check(motorComponent(name), err)
+	}
+
+	motor, err = NewRMCS220xMotor(
+		d.motorBus,
+		d.switches,
+		conf.Control,
+		conf.Address,
+		conf.Low,
+		conf.High,
+		conf.Speed,
+		conf.Damping,
+	)
+	d.Motors[name] = motor
+	return motor, d.health.check(motorComponent(name), err)
 }
 
 func (d *Dynastat) RecordMotorLow(name string) (err error) {
@@ -706,19 +1278,8 @@ func (d *Dynastat) RecordMotorLow(name string) (err error) {
 	d.config.Motors[name] = conf
 
 	// recreate the motor with new values
-	motor = NewRMCS220xMotor(
-		d.motorBus,
-		d.switches,
-		conf.Control,
-		conf.Address,
-		conf.Low,
-		conf.High,
-		conf.Speed,
-		conf.Damping,
-	)
-	d.Motors[name] = motor
-
-	return nil
+	_, err = d.reconfigureMotor(name)
+	return err
 }
 
 func (d *Dynastat) RecordMotorHigh(name string) (err error) {
@@ -741,19 +1302,8 @@ func (d *Dynastat) RecordMotorHigh(name string) (err error) {
 	d.config.Motors[name] = conf
 
 	// recreate the motor with new values
-	motor = NewRMCS220xMotor(
-		d.motorBus,
-		d.switches,
-		conf.Control,
-		conf.Address,
-		conf.Low,
-		conf.High,
-		conf.Speed,
-		conf.Damping,
-	)
-	d.Motors[name] = motor
-
-	return nil
+	_, err = d.reconfigureMotor(name)
+	return err
 }
 
 func (d *Dynastat) RecordMotorHome(name string, reverse bool) (pos int, err error) {
@@ -765,7 +1315,9 @@ func (d *Dynastat) RecordMotorHome(name string, reverse bool) (pos int, err erro
 		return 0, errors.New(fmt.Sprintf("Unkown motor %s", name))
 	}
 
-	motor.findHome(reverse)
+	if err = motor.findHome(reverse); err != nil {
+		return
+	}
 
 	time.Sleep(time.Second / 2)
 
@@ -783,57 +1335,187 @@ func (d *Dynastat) RecordMotorHome(name string, reverse bool) (pos int, err erro
 	d.config.Motors[name] = conf
 
 	// recreate the motor with new values
-	motor = NewRMCS220xMotor(
-		d.motorBus,
-		d.switches,
-		conf.Control,
-		conf.Address,
-		conf.Low,
-		conf.High,
-		conf.Speed,
-		conf.Damping,
-	)
-	d.Motors[name] = motor
+	if motor, err = d.reconfigureMotor(name); err != nil {
+		return
+	}
 
 	time.Sleep(time.Second / 2)
 
 	// reset to a sensible position
-	motor.putRaw(m_REG_GOTO, 0)
-
+	err = motor.putRaw(m_REG_GOTO, 0)
 	return
 }
 
+// SetSensorUnits selects the units used for the sensor readings in the device state.
+// An empty value selects the 0-255 application range.
+func (d *Dynastat) SetSensorUnits(units PressureUnit) error {
+	switch units {
+	case "":
+		units = UNIT_SCALED
+	case UNIT_SCALED, UNIT_RAW, UNIT_KPA:
+	default:
+		return errors.New(fmt.Sprintf("Unkown sensor units %s", units))
+	}
+
+	d.lock.Lock()
+	d.units = units
+	d.lock.Unlock()
+	return nil
+}
+
 // readSensors calls GetState on each sensor to build a dictionary of the Current sensor readings.
-func (d *Dynastat) readSensors() (result map[string]SensorState) {
+// Sensors sharing a board are read from the same frame so the state is never torn between two reads of a board.
+// Sensors which are not on a board are sampled as they are read.
+// Frames published by the capture scheduler, keyed by board address, are used in place of the latest board frames
+// so every board in the state comes from the same capture. The frame each board sensor was read from is given so
+// anything else taken from the sensor agrees with the state.
+func (d *Dynastat) readSensors(published map[int]*SensorFrame) (result map[string]SensorState, samples map[string]Sample,
+	read map[string]*SensorFrame) {
 	result = make(map[string]SensorState)
+	samples = make(map[string]Sample)
+	read = make(map[string]*SensorFrame)
+	frames := make(map[*SensorBoard]*SensorFrame, len(d.boards))
 	for name, sensor := range d.sensors {
-		result[name] = sensor.GetState()
+		s, ok := sensor.(*Sensor)
+		if !ok {
+			result[name] = sensor.GetState(d.units)
+			if source, ok := sensor.(sensorSource); ok {
+				samples[name] = source.sample()
+			} else {
+				samples[name] = Sample{Seq: d.seq, Time: time.Now()}
+			}
+			continue
+		}
+
+		frame, ok := frames[s.board]
+		if !ok {
+			if frame, ok = published[s.board.address]; !ok {
+				frame = s.board.Frame()
+			}
+			frames[s.board] = frame
+		}
+		read[name] = frame
+		result[name] = s.frameState(frame, d.units)
+		samples[name] = Sample{Seq: frame.Seq, Time: frame.Time, Capture: frame.Capture}
 	}
 	return
 }
 
 // readMotors calls GetState on each motor to build a dictionary of the Current motor states.
-func (d *Dynastat) readMotors() (result map[string]MotorState, err error) {
-	result = make(map[string]MotorState)
+// Motors are only read at the motor rate however often the state is built, so a fast sensor sample rate does not
+// flood the UART, and the last state is given in between.
+// A motor which cannot be read is degraded and keeps the last state read from it, along with the sample it came from.
+// Degraded motors are only tried again every DEGRADED_POLL_INTERVAL.
+// The device is not held while the motors are read, as a motor which does not answer can take the full retry policy,
+// so the states are given without their units.
+func (d *Dynastat) readMotors() (result map[string]MotorState, samples map[string]Sample) {
+	d.lock.Lock()
+	motors := make(map[string]MotorInterface, len(d.Motors))
 	for name, motor := range d.Motors {
-		state, err := motor.GetState()
-		if err != nil {
-			return nil, err
+		motors[name] = motor
+	}
+	interval := d.motorInterval()
+	d.lock.Unlock()
+
+	d.motorLock.Lock()
+	defer d.motorLock.Unlock()
+	if d.motorStates == nil {
+		d.motorStates = make(map[string]MotorState, len(d.Motors))
+		d.motorSamples = make(map[string]Sample, len(d.Motors))
+		d.motorPolled = make(map[string]time.Time, len(d.Motors))
+	}
+
+	now := time.Now()
+	result = make(map[string]MotorState)
+	samples = make(map[string]Sample)
+	for name, motor := range motors {
+		due := interval
+		if d.health.degraded(motorComponent(name)) {
+			due = DEGRADED_POLL_INTERVAL
+		}
+		if polled, ok := d.motorPolled[name]; !ok || now.Sub(polled) >= due {
+			d.motorPolled[name] = now
+			state, err := motor.GetState()
+			if d.health.check(motorComponent(name), err) == nil {
+				d.motorStates[name] = state
+				d.motorSamples[name] = Sample{Seq: d.motorSamples[name].Seq + 1, Time: time.Now()}
+			}
 		}
-		result[name] = state
+		result[name] = d.motorStates[name]
+		samples[name] = d.motorSamples[name]
 	}
 	return
 }
 
+// motorInterval gives how often the motors are read for the state.
+func (d *Dynastat) motorInterval() time.Duration {
+	rate := FRAMERATE
+	if d.config != nil && d.config.UART.Rate > 0 {
+		rate = d.config.UART.Rate
+	}
+	return time.Second / time.Duration(rate)
+}
+
 // GetState builds a complete state of the device including sensor and motor states.
+// Failing hardware does not fail the state, it is listed in Degraded with the last good readings kept in its place.
 func (d *Dynastat) GetState() (result DynastatState, err error) {
+	motors, motorSamples := d.readMotors()
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	result.Motors, err = d.readMotors()
-	result.Sensors = d.readSensors()
+	d.seq++
+	result.Seq = d.seq
+	result.Motors, result.MotorSamples = motors, motorSamples
+	for name, state := range result.Motors {
+		state.Units = d.motorUnits(name, state)
+		result.Motors[name] = state
+	}
+	var frames map[int]*SensorFrame
+	if d.scheduler != nil {
+		result.Capture, frames = d.scheduler.Frames()
+	}
+	var read map[string]*SensorFrame
+	result.Sensors, result.SensorSamples, read = d.readSensors(frames)
+	d.checkBoards()
+	result.Time = time.Now()
+	for _, samples := range []map[string]Sample{result.MotorSamples, result.SensorSamples} {
+		for name, sample := range samples {
+			// boards which have not been read yet have no age
+			if !sample.Time.IsZero() {
+				sample.Age = result.Time.Sub(sample.Time)
+				samples[name] = sample
+			}
+		}
+	}
+	result.Faults = d.diagnoseSensors(result.Sensors, result.SensorSamples, read)
+	result.Units = d.units
+	result.CoP = d.calculateCentres(result.Sensors)
+	result.Degraded = d.health.snapshot()
+	result.Move = d.moveProgress()
+	return
+}
+
+// SampleRate gives the fastest rate in Hz any of the sensor boards are polled at, or FRAMERATE without any boards.
+// This is the rate the state needs to be read at to see every frame.
+func (d *Dynastat) SampleRate() (rate int) {
+	for _, board := range d.boards {
+		if board.rate > rate {
+			rate = board.rate
+		}
+	}
+	if rate == 0 {
+		rate = FRAMERATE
+	}
 	return
 }
 
 func (d *Dynastat) GetConfig() *DynastatConfig {
 	return d.config
 }
+
+// MarshalConfig gives the config as YAML, holding the device so the calibration can not change part way through.
+func (d *Dynastat) MarshalConfig() ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return yaml.Marshal(d.config)
+}
@@ -2,8 +2,10 @@ package onboard
 
 import (
 	"encoding/binary"
+	"errors"
 	. "github.com/smartystreets/goconvey/convey"
-	"sync"
+	"io"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,38 +20,86 @@ type MockI2CSensorBoard struct {
 	putAddr int
 	putCmd  uint16
 	buf     []byte
+	err     error
 }
 
-func (s *MockI2CSensorBoard) Get(i2cAddr int, cmd uint16, buf []byte) {
+func (s *MockI2CSensorBoard) Get(i2cAddr int, cmd uint16, buf []byte) error {
+	if s.err != nil {
+		return s.err
+	}
 	for i := range buf {
 		buf[i] = s.data[i]
 	}
+	return nil
 }
 
-func (s *MockI2CSensorBoard) Put(i2cAddr int, cmd uint16, buf []byte) {
+func (s *MockI2CSensorBoard) Put(i2cAddr int, cmd uint16, buf []byte) error {
+	if s.err != nil {
+		return s.err
+	}
 	s.putAddr = i2cAddr
 	s.putCmd = cmd
 	s.buf = buf
+	return nil
 }
 
 type MockUARTMCU struct {
 	i2cAddr int
 	cmd     uint8
 	value   int32
+	err     error
+	calls   int
 }
 
-func (b *MockUARTMCU) Put(i2cAddr int, cmd uint8, value int32) {
+func (b *MockUARTMCU) Put(i2cAddr int, cmd uint8, value int32) error {
+	b.calls++
+	if b.err != nil {
+		return b.err
+	}
 	b.i2cAddr = i2cAddr
 	b.cmd = cmd
 	b.value = value
+	return nil
 }
 
 func (b *MockUARTMCU) Get(i2cAddr int, cmd uint8) (value int32, err error) {
+	b.calls++
+	if b.err != nil {
+		return 0, b.err
+	}
 	b.i2cAddr = i2cAddr
 	b.cmd = cmd
 	return b.value, nil
 }
 
+// MockUARTPort plays the part of the MCU on the other end of the UART.
+// Requests written to it are passed on to the test, which writes the responses to reply.
+type MockUARTPort struct {
+	*io.PipeReader
+	reply    *io.PipeWriter
+	requests chan string
+}
+
+func NewMockUARTPort() *MockUARTPort {
+	r, w := io.Pipe()
+	return &MockUARTPort{r, w, make(chan string, 10)}
+}
+
+func (p *MockUARTPort) Write(b []byte) (int, error) {
+	p.requests <- string(b)
+	return len(b), nil
+}
+
+// respond waits for a request then replies with each response in turn.
+func (p *MockUARTPort) respond(responses ...string) {
+	go func() {
+		<-p.requests
+		for _, resp := range responses {
+			p.reply.Write([]byte(resp))
+		}
+	}()
+}
+
 type MockSwitchMCU struct {
 	mcu     *MockUARTMCU
 	trigger int32
@@ -59,10 +109,17 @@ type MockSwitchMCU struct {
 
 type MockMotor struct {
 	target int
+	err    error
+	polls  int
+	hold   chan struct{} // GetState waits for this to be closed if it is set
 }
 
-func (m *MockMotor) SetTarget(target int) {
+func (m *MockMotor) SetTarget(target int) error {
+	if m.err != nil {
+		return m.err
+	}
 	m.target = target
+	return nil
 }
 
 func (m *MockMotor) GetPosition() (int, error) {
@@ -78,6 +135,13 @@ func (m *MockMotor) findHome(_ bool) error {
 }
 
 func (m *MockMotor) GetState() (state MotorState, err error) {
+	if m.hold != nil {
+		<-m.hold
+	}
+	m.polls++
+	if m.err != nil {
+		return state, m.err
+	}
 	state.Target = m.target
 	state.Current = m.target
 	return
@@ -87,11 +151,11 @@ func (m *MockMotor) getRaw(_ uint8) (_ int, _ error) {
 	panic("MockMotor does not implement raw getters and setters")
 }
 
-func (m *MockMotor) putRaw(_ uint8, _ int) {
+func (m *MockMotor) putRaw(_ uint8, _ int) error {
 	panic("MockMotor does not implement raw getters and setters")
 }
 
-func (c *MockSwitchMCU) Get(i2cAddr int, cmd uint16, buf []byte) {
+func (c *MockSwitchMCU) Get(i2cAddr int, cmd uint16, buf []byte) error {
 	if i2cAddr != sm_ADDRESS || !(cmd == sm_REG_VALUES || cmd == sm_REG_ID) {
 		panic("Incorrect call to the control mcu")
 	}
@@ -105,9 +169,10 @@ func (c *MockSwitchMCU) Get(i2cAddr int, cmd uint16, buf []byte) {
 			binary.LittleEndian.PutUint16(buf, c.base)
 		}
 	}
+	return nil
 }
 
-func (c *MockSwitchMCU) Put(i2cAddr int, cmd uint16, buf []byte) {
+func (c *MockSwitchMCU) Put(i2cAddr int, cmd uint16, buf []byte) error {
 	panic("MockSwitchMCU does not implement Put")
 }
 
@@ -116,12 +181,8 @@ func TestSensorBoard(t *testing.T) {
 		data: make([]byte, sb_ROWS*sb_COLS*2),
 		buf:  make([]byte, 1),
 	}
-	sb := &SensorBoard{
-		msb,
-		0,
-		make([]byte, sb_COLS*sb_ROWS*2),
-	}
-	s, _ := NewSensor(sb, 1, false, sb_ROWS, s_BANK1_COLS, 0, 127, 255)
+	sb := NewSensorBoard(msb, 0)
+	s, _ := NewSensor(sb, 1, false, sb_ROWS, s_BANK1_COLS, 0, 127, 255, 0)
 
 	Convey("Setting the scale works as expected", t, func() {
 		Convey("1:1 scaling", func() {
@@ -150,54 +211,108 @@ func TestSensorBoard(t *testing.T) {
 		s.SetScale(0, 32768, 65535)
 
 		Convey("first two bytes", func() {
-			sb.buf[0] = 0x80
-			sb.buf[1] = 0x00
-			sb.buf[2] = 0xff
+			msb.data[0] = 0x80
+			msb.data[1] = 0x00
+			msb.data[2] = 0xff
+			sb.read()
 			So(s.GetValue(0, 0), ShouldEqual, 127)
 		})
 
 		Convey("somewhere in the middle of the array", func() {
-			sb.buf[391] = 0x88
-			sb.buf[392] = 0xff
-			sb.buf[393] = 0xff
-			sb.buf[394] = 0x88
+			msb.data[391] = 0x88
+			msb.data[392] = 0xff
+			msb.data[393] = 0xff
+			msb.data[394] = 0x88
+			sb.read()
 			So(s.GetValue(8, 4), ShouldAlmostEqual, 255, 1)
 		})
 
 		Convey("deliberately out of bounds", func() {
 			So(func() { s.GetValue(sb_ROWS+1, sb_COLS+1) }, ShouldPanic)
 		})
+
+		Convey("values beyond the full value are clamped rather than wrapping", func() {
+			s.SetScale(0, 2047, 4095)
+			msb.data[0] = 0xff
+			msb.data[1] = 0xff
+			sb.read()
+			So(s.GetValue(0, 0), ShouldEqual, 255)
+		})
+
+		Convey("values below the zero value are clamped", func() {
+			s.SetScale(100, 2047, 4095)
+			msb.data[0] = 0x00
+			msb.data[1] = 0x10
+			sb.read()
+			So(s.GetValue(0, 0), ShouldEqual, 0)
+			So(s.GetPressure(0, 0), ShouldEqual, 0)
+		})
 	})
 
-	Convey("Updater fetches new data", t, func() {
-		quit := make(chan bool)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go func() {
-			ticker := time.NewTicker(time.Second / 2)
-			for {
-				select {
-				case <-quit:
-					ticker.Stop()
-					wg.Done()
-					break
-				case <-ticker.C:
-					for i := range msb.data {
-						msb.data[i]++
-					}
-				}
-			}
-		}()
+	Convey("Raw and calibrated values are available at full resolution", t, func() {
+		s.SetScale(0, 2047, 4095)
+		msb.data[0] = 0x08
+		msb.data[1] = 0x01
+		sb.read()
+
+		So(s.GetRaw(0, 0), ShouldEqual, 0x0801)
+		So(s.GetPressure(0, 0), ShouldAlmostEqual, float64(0x0801)*DEFAULT_FULL_SCALE/4095, kScaleTolerance)
+
+		Convey("state is given in the requested units", func() {
+			So(s.GetState(UNIT_RAW)[0][0], ShouldEqual, 0x0801)
+			So(s.GetState(UNIT_SCALED)[0][0], ShouldEqual, s.GetValue(0, 0))
+			So(s.GetState(UNIT_KPA)[0][0], ShouldEqual, s.GetPressure(0, 0))
+		})
+	})
+
+	Convey("Each read swaps in a new frame", t, func() {
+		msb.data[0] = 0x01
+		msb.data[1] = 0x00
+		sb.read()
+		held := sb.Frame()
+
+		msb.data[0] = 0x02
+		sb.read()
+		So(sb.Frame().Seq, ShouldEqual, held.Seq+1)
+		So(sb.Frame().Time, ShouldHappenOnOrAfter, held.Time)
+		So(sb.Frame().values[0], ShouldEqual, 0x0200)
+
+		// frames already handed out are never modified
+		So(held.values[0], ShouldEqual, 0x0100)
+		So(s.frameState(held, UNIT_RAW)[0][0], ShouldEqual, 0x0100)
+	})
 
-		go sb.Update()              // start updater
-		time.Sleep(time.Second * 1) // Wait some time
+	Convey("Failed reads keep the previous frame", t, func() {
+		held := sb.Frame()
+		msb.err = errors.New("bus error")
+		defer func() { msb.err = nil }()
+
+		So(sb.read(), ShouldNotBeNil)
+		So(sb.Frame(), ShouldEqual, held)
+		So(sb.changeAddress(0x22), ShouldNotBeNil)
+	})
+
+	Convey("Sample rates are limited", t, func() {
+		board := NewSensorBoard(msb, 0)
+		So(board.SetSampleRate(0), ShouldNotBeNil)
+		So(board.SetSampleRate(MAX_SAMPLE_RATE+1), ShouldNotBeNil)
+		So(board.SetSampleRate(100), ShouldBeNil)
+
+		dynastat := new(Dynastat)
+		So(dynastat.SampleRate(), ShouldEqual, FRAMERATE)
+		dynastat.boards = map[int]*SensorBoard{0: sb, 1: board}
+		So(dynastat.SampleRate(), ShouldEqual, 100)
+	})
+
+	Convey("Captures fetch new data", t, func() {
+		scheduler := NewCaptureScheduler(map[int]*SensorBoard{sb.address: sb})
+		scheduler.Tick()
 		start := s.GetValue(0, 0)
-		time.Sleep(time.Second * 1) // Wait some time
+		for i := range msb.data {
+			msb.data[i]++
+		}
+		scheduler.Tick()
 		So(s.GetValue(0, 0), ShouldBeGreaterThan, start)
-
-		// tidy up update goroutine
-		quit <- true
-		wg.Wait()
 	})
 
 	Convey("set address sends the correct data", t, func() {
@@ -233,22 +348,88 @@ func TestSensorBoard(t *testing.T) {
 	Convey("Setting mode sends the correct data", t, func() {
 		sb.address = 0x21
 		msb.data[0] = 0x12
-		sb.SetMode(0x12)
+		So(sb.SetMode(0x12), ShouldBeNil)
 		So(msb.putAddr, ShouldEqual, sb.address)
 		So(msb.putCmd, ShouldEqual, sb_REG_MODE)
 		So(msb.buf[0], ShouldEqual, 0x12)
 
-		Convey("Should panic without the readback", func() {
-			So(func() { sb.SetMode(0x13) }, ShouldPanic)
+		Convey("Should error without the readback", func() {
+			So(sb.SetMode(0x13), ShouldNotBeNil)
+		})
+
+		Convey("Should error when the board does not respond", func() {
+			msb.err = errors.New("remote I/O error")
+			So(sb.SetMode(0x12), ShouldNotBeNil)
+			msb.err = nil
 		})
 	})
 
 	Convey("NewSensor constructor handles unknown reg mode", t, func() {
-		_, err := NewSensor(sb, 0, false, sb_ROWS, s_BANK1_COLS, 0, 127, 255)
+		_, err := NewSensor(sb, 0, false, sb_ROWS, s_BANK1_COLS, 0, 127, 255, 0)
 		So(err, ShouldNotBeNil)
 	})
 }
 
+func TestUARTMCU(t *testing.T) {
+	port := NewMockUARTPort()
+	mcu := NewUARTMCU(port, 20*time.Millisecond)
+
+	Convey("Reading from the UART MCU", t, func() {
+		Convey("parses the value in the response", func() {
+			var request string
+			go func() {
+				request = <-port.requests
+				port.reply.Write([]byte("-1234\r\n"))
+			}()
+			val, err := mcu.Get(0x10, m_REG_POSITION)
+			So(err, ShouldBeNil)
+			So(val, ShouldEqual, -1234)
+			So(request, ShouldEqual, "M16 3\n")
+		})
+
+		Convey("resynchronises after garbage on the line", func() {
+			port.respond("\x00\xff#12\n", strings.Repeat("9", uart_MAX_LINE*2)+"\n", "\x00\xff5\n")
+			val, err := mcu.Get(0x10, m_REG_POSITION)
+			So(err, ShouldBeNil)
+			So(val, ShouldEqual, 5)
+		})
+
+		Convey("recognises error responses", func() {
+			port.respond("ERROR NO RESPONSE\r\n")
+			_, err := mcu.Get(0x10, m_REG_POSITION)
+			So(err, ShouldEqual, ErrNoResponse)
+		})
+
+		Convey("times out without a response and ignores it if it arrives late", func() {
+			port.respond()
+			_, err := mcu.Get(0x10, m_REG_POSITION)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Timed out")
+
+			port.reply.Write([]byte("666\n"))
+			time.Sleep(5 * time.Millisecond)
+
+			port.respond("7\n")
+			val, err := mcu.Get(0x10, m_REG_POSITION)
+			So(err, ShouldBeNil)
+			So(val, ShouldEqual, 7)
+		})
+
+		Convey("retries failed requests with the retry policy", func() {
+			retry := NewRetryUARTMCU(mcu, RetryPolicy{Attempts: 2, Delay: -1})
+			go func() {
+				<-port.requests
+				port.reply.Write([]byte("ERROR NO RESPONSE\n"))
+				<-port.requests
+				port.reply.Write([]byte("99\n"))
+			}()
+			val, err := retry.Get(0x10, m_REG_POSITION)
+			So(err, ShouldBeNil)
+			So(val, ShouldEqual, 99)
+		})
+	})
+}
+
 func TestRMCS220xMotor(t *testing.T) {
 	mcu := &MockUARTMCU{}
 	control := &MockSwitchMCU{
@@ -262,7 +443,7 @@ func TestRMCS220xMotor(t *testing.T) {
 		panic(err) // should be impossible in a test
 	}
 
-	motor := NewRMCS220xMotor(
+	motor, err := NewRMCS220xMotor(
 		mcu,
 		switches,
 		2,
@@ -272,6 +453,9 @@ func TestRMCS220xMotor(t *testing.T) {
 		255,
 		42,
 	)
+	if err != nil {
+		panic(err)
+	}
 
 	Convey("constructor has worked", t, func() {
 		So(mcu.i2cAddr, ShouldEqual, motor.address)
@@ -431,14 +615,10 @@ func TestRMCS220xMotor(t *testing.T) {
 
 func TestDynastat(t *testing.T) {
 	motor := new(MockMotor)
-	sb := &SensorBoard{
-		&MockI2CSensorBoard{
-			data: make([]byte, sb_ROWS*sb_COLS*2),
-		},
-		0,
-		make([]byte, sb_COLS*sb_ROWS*2),
-	}
-	sensor, _ := NewSensor(sb, 2, true, 2, 4, 0, 127, 255)
+	sb := NewSensorBoard(&MockI2CSensorBoard{
+		data: make([]byte, sb_ROWS*sb_COLS*2),
+	}, 0)
+	sensor, _ := NewSensor(sb, 2, true, 2, 4, 0, 127, 255, 0)
 	dynastat := new(Dynastat)
 	dynastat.Motors = make(map[string]MotorInterface, 1)
 	dynastat.Motors["TestMotor"] = motor
@@ -465,7 +645,7 @@ func TestDynastat(t *testing.T) {
 		})
 
 		Convey("read sensors contains our test sensor", func() {
-			state := dynastat.readSensors()
+			state, _, _ := dynastat.readSensors(nil)
 			So(state, ShouldContainKey, "TestSensor")
 			So(state["TestSensor"], ShouldHaveLength, sensor.rows)
 			So(state["TestSensor"][0], ShouldHaveLength, sensor.cols)
@@ -476,5 +656,69 @@ func TestDynastat(t *testing.T) {
 			So(state.Motors, ShouldContainKey, "TestMotor")
 			So(state.Sensors, ShouldContainKey, "TestSensor")
 		})
+
+		Convey("states are numbered and carry the samples behind them", func() {
+			first, _ := dynastat.GetState()
+			sb.read()
+			time.Sleep(dynastat.motorInterval())
+			second, _ := dynastat.GetState()
+
+			So(second.Seq, ShouldEqual, first.Seq+1)
+			So(second.Time, ShouldHappenOnOrAfter, first.Time)
+			So(second.MotorSamples["TestMotor"].Seq, ShouldEqual, first.MotorSamples["TestMotor"].Seq+1)
+			So(second.SensorSamples["TestSensor"].Seq, ShouldEqual, sb.Frame().Seq)
+			So(second.SensorSamples["TestSensor"].Time, ShouldEqual, sb.Frame().Time)
+			So(second.SensorSamples["TestSensor"].Age, ShouldBeGreaterThanOrEqualTo, 0)
+		})
+
+		Convey("motors are only read at the motor rate", func() {
+			time.Sleep(dynastat.motorInterval())
+			polls := motor.polls
+			first, _ := dynastat.GetState()
+			second, _ := dynastat.GetState()
+
+			So(motor.polls, ShouldEqual, polls+1)
+			So(second.MotorSamples["TestMotor"].Seq, ShouldEqual, first.MotorSamples["TestMotor"].Seq)
+			So(second.Motors["TestMotor"], ShouldResemble, first.Motors["TestMotor"])
+		})
+
+		Convey("the device is not held while the motors are read", func() {
+			time.Sleep(dynastat.motorInterval())
+			motor.hold = make(chan struct{})
+			read := make(chan struct{})
+			go func() {
+				dynastat.GetState()
+				close(read)
+			}()
+
+			// waits for the device lock if the motor is being read under it
+			time.Sleep(10 * time.Millisecond)
+			units := make(chan error, 1)
+			go func() { units <- dynastat.SetSensorUnits(UNIT_KPA) }()
+			select {
+			case err := <-units:
+				So(err, ShouldBeNil)
+			case <-time.After(time.Second):
+				t.Error("device held while reading the motors")
+			}
+			close(motor.hold)
+			<-read
+			motor.hold = nil
+			So(dynastat.SetSensorUnits(""), ShouldBeNil)
+		})
+	})
+
+	Convey("sensor units can be selected", t, func() {
+		So(dynastat.SetSensorUnits(UNIT_KPA), ShouldBeNil)
+		state, _ := dynastat.GetState()
+		So(state.Units, ShouldEqual, UNIT_KPA)
+
+		So(dynastat.SetSensorUnits(""), ShouldBeNil)
+		state, _ = dynastat.GetState()
+		So(state.Units, ShouldEqual, UNIT_SCALED)
+
+		err := dynastat.SetSensorUnits("furlongs")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "furlongs")
 	})
 }
@@ -0,0 +1,330 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"math"
+	"time"
+)
+
+// FaultType describes how a sensel has been found to be faulty.
+type FaultType string
+
+const (
+	FAULT_DEAD         FaultType = "dead"         // stuck at zero
+	FAULT_SATURATED    FaultType = "saturated"    // stuck at the top of the range
+	FAULT_UNCORRELATED FaultType = "uncorrelated" // does not follow its neighbours as load changes
+
+	// DIAGNOSTIC_WINDOW is the length of history each sensel is judged over
+	DIAGNOSTIC_WINDOW = 30 * time.Second
+	// DIAGNOSTIC_MIN_HISTORY is the history needed before any sensel is flagged
+	DIAGNOSTIC_MIN_HISTORY = 5 * time.Second
+	// DIAGNOSTIC_INTERVAL is the time between each analysis of the history
+	DIAGNOSTIC_INTERVAL = time.Second
+	// DIAGNOSTIC_MIN_ACTIVITY is the standard deviation in counts the neighbours must reach before the correlation of
+	// a sensel with them means anything
+	DIAGNOSTIC_MIN_ACTIVITY = 20
+	// MIN_NEIGHBOUR_CORRELATION is the correlation with the neighbours below which a sensel is uncorrelated
+	MIN_NEIGHBOUR_CORRELATION = 0.2
+	// SATURATED_VALUE is the raw count at the top of the 12 bit range of the sensor boards
+	SATURATED_VALUE = 0x0FFF
+)
+
+// DiagnosticsConfig enables the search for faulty sensels.
+// With Interpolate set the faulty sensels are replaced in the state by the average of their working neighbours.
+type DiagnosticsConfig struct {
+	Enabled     bool
+	Interpolate bool
+}
+
+// SenselFault is a faulty sensel on a sensor.
+type SenselFault struct {
+	Row, Col int
+	Fault    FaultType
+}
+
+// SensorDiagnostics keeps a history of the raw frames from a sensor to find faulty sensels.
+// The history is kept by the time each frame was taken, so it covers the same time however often the frames come.
+type SensorDiagnostics struct {
+	rows, cols int
+	window     time.Duration
+	frames     [][]float64 // raw frames in the order they were taken indexed row*cols+col
+	times      []time.Time // when each of the frames was taken
+	analysed   time.Time   // when the frame the history was last analysed at was taken
+	faults     []SenselFault
+}
+
+// NewSensorDiagnostics keeps up to window of history for a sensor of the given size.
+func NewSensorDiagnostics(rows, cols int, window time.Duration) *SensorDiagnostics {
+	return &SensorDiagnostics{
+		rows:   rows,
+		cols:   cols,
+		window: window,
+	}
+}
+
+// Add records a raw frame taken at the given time, drops any history that has fallen out of the window and analyses
+// the history again every DIAGNOSTIC_INTERVAL. A frame taken no later than the last one is the same frame read again
+// and is ignored.
+func (s *SensorDiagnostics) Add(raw SensorState, taken time.Time) {
+	if n := len(s.times); n > 0 && !taken.After(s.times[n-1]) {
+		return
+	}
+
+	var drop int
+	for drop < len(s.times) && taken.Sub(s.times[drop]) > s.window {
+		drop++
+	}
+	// reuse an expired frame rather than allocating a new one
+	var frame []float64
+	if drop > 0 {
+		frame = s.frames[0]
+	} else {
+		frame = make([]float64, s.rows*s.cols)
+	}
+	for row := 0; row < s.rows; row++ {
+		copy(frame[row*s.cols:], raw[row])
+	}
+	s.frames = append(s.frames[drop:], frame)
+	s.times = append(s.times[drop:], taken)
+
+	if taken.Sub(s.analysed) >= DIAGNOSTIC_INTERVAL {
+		s.analysed = taken
+		s.faults = s.Analyse()
+	}
+}
+
+// Faults gives the faulty sensels found by the last analysis.
+func (s *SensorDiagnostics) Faults() []SenselFault {
+	return s.faults
+}
+
+// history gives the time covered by the frames kept.
+func (s *SensorDiagnostics) history() time.Duration {
+	if len(s.times) == 0 {
+		return 0
+	}
+	return s.times[len(s.times)-1].Sub(s.times[0])
+}
+
+// series gives the history of a sensel in the order the frames were taken.
+func (s *SensorDiagnostics) series(i int) []float64 {
+	series := make([]float64, len(s.frames))
+	for f, frame := range s.frames {
+		series[f] = frame[i]
+	}
+	return series
+}
+
+// Analyse looks through the history for sensels that are stuck at zero, saturated, or not following their neighbours.
+// Nothing is flagged until there is at least DIAGNOSTIC_MIN_HISTORY of history.
+// A sensel stuck at either end of the range is only flagged while most of its neighbours are moving and active, as an
+// unloaded part of the plate, or the edge of the load, reads zero just as a dead sensel does.
+func (s *SensorDiagnostics) Analyse() (faults []SenselFault) {
+	if len(s.frames) < 2 || s.history() < DIAGNOSTIC_MIN_HISTORY {
+		return nil
+	}
+
+	n := s.rows * s.cols
+	series := make([][]float64, n)
+	flat := make([]FaultType, n) // the fault each sensel would have if it is stuck at either end of the range
+	still := make([]bool, n)
+	for i := range series {
+		series[i] = s.series(i)
+
+		min, max := series[i][0], series[i][0]
+		for _, val := range series[i] {
+			min = math.Min(min, val)
+			max = math.Max(max, val)
+		}
+
+		switch {
+		case max == 0:
+			flat[i] = FAULT_DEAD
+		case min >= SATURATED_VALUE:
+			flat[i] = FAULT_SATURATED
+		}
+		still[i] = flat[i] != ""
+	}
+
+	neighbours := make([]float64, len(s.frames))
+	stuck := make([]bool, n)
+	for i := range series {
+		if flat[i] == "" {
+			continue
+		}
+		found, left := s.neighbours(series, still, i, neighbours)
+		if found > left && activity(neighbours) >= DIAGNOSTIC_MIN_ACTIVITY {
+			faults = append(faults, SenselFault{i / s.cols, i % s.cols, flat[i]})
+			stuck[i] = true
+		}
+	}
+
+	for i := range series {
+		if still[i] {
+			continue
+		}
+		if found, _ := s.neighbours(series, stuck, i, neighbours); found == 0 {
+			continue
+		}
+		if correlation(series[i], neighbours) < MIN_NEIGHBOUR_CORRELATION {
+			faults = append(faults, SenselFault{i / s.cols, i % s.cols, FAULT_UNCORRELATED})
+		}
+	}
+	return
+}
+
+// neighbours averages the series of the neighbours of sensel i into average frame by frame, leaving out any which are
+// excluded, and gives the number of neighbours averaged and left out.
+func (s *SensorDiagnostics) neighbours(series [][]float64, exclude []bool, i int, average []float64) (found, left int) {
+	for f := range average {
+		average[f] = 0
+	}
+
+	row, col := i/s.cols, i%s.cols
+	for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		r, c := row+d[0], col+d[1]
+		if r < 0 || r >= s.rows || c < 0 || c >= s.cols {
+			continue
+		}
+		if exclude[r*s.cols+c] {
+			left++
+			continue
+		}
+		for f, val := range series[r*s.cols+c] {
+			average[f] += val
+		}
+		found++
+	}
+	if found == 0 {
+		return
+	}
+	for f := range average {
+		average[f] /= float64(found)
+	}
+	return
+}
+
+// activity gives the standard deviation of a series.
+func activity(series []float64) float64 {
+	var mean float64
+	for _, val := range series {
+		mean += val
+	}
+	mean /= float64(len(series))
+
+	var v float64
+	for _, val := range series {
+		v += (val - mean) * (val - mean)
+	}
+	return math.Sqrt(v / float64(len(series)))
+}
+
+// correlation gives the Pearson correlation of a sensel with its neighbours.
+// Neighbours without enough activity give no evidence either way and count as correlated, while a sensel that does
+// not move at all when its neighbours do has no correlation.
+func correlation(sensel, neighbours []float64) float64 {
+	var ms, mn float64
+	for f := range sensel {
+		ms += sensel[f]
+		mn += neighbours[f]
+	}
+	ms /= float64(len(sensel))
+	mn /= float64(len(neighbours))
+
+	var cov, vs, vn float64
+	for f := range sensel {
+		ds, dn := sensel[f]-ms, neighbours[f]-mn
+		cov += ds * dn
+		vs += ds * ds
+		vn += dn * dn
+	}
+
+	if activity(neighbours) < DIAGNOSTIC_MIN_ACTIVITY {
+		return 1
+	}
+	if vs == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(vs*vn)
+}
+
+// interpolateFaults replaces each faulty sensel in the state with the average of its working neighbours.
+func interpolateFaults(state SensorState, faults []SenselFault) {
+	if len(faults) == 0 || len(state) == 0 {
+		return
+	}
+
+	rows, cols := len(state), len(state[0])
+	faulty := make([]bool, rows*cols)
+	for _, f := range faults {
+		faulty[f.Row*cols+f.Col] = true
+	}
+
+	for _, f := range faults {
+		var sum float64
+		var found int
+		for r := f.Row - 1; r <= f.Row+1; r++ {
+			for c := f.Col - 1; c <= f.Col+1; c++ {
+				if r < 0 || r >= rows || c < 0 || c >= cols || faulty[r*cols+c] {
+					continue
+				}
+				sum += state[r][c]
+				found++
+			}
+		}
+
+		state[f.Row][f.Col] = 0
+		if found > 0 {
+			state[f.Row][f.Col] = sum / float64(found)
+		}
+	}
+}
+
+// diagnoseSensors feeds the raw frame of each sensor into its diagnostics and gives the faults found so far,
+// interpolating over them in the sensor states if configured to.
+// Each frame is fed in once by the time in its sample, however many states are built from it. Board sensors are
+// diagnosed from the frame the state was read from so the values always match the time they are recorded at.
+func (d *Dynastat) diagnoseSensors(states map[string]SensorState, samples map[string]Sample,
+	read map[string]*SensorFrame) (result map[string][]SenselFault) {
+	if d.config == nil || !d.config.Diagnostics.Enabled {
+		return nil
+	}
+	if d.diagnostics == nil {
+		d.diagnostics = make(map[string]*SensorDiagnostics, len(d.sensors))
+	}
+
+	result = make(map[string][]SenselFault)
+	for name, sensor := range d.sensors {
+		raw := states[name]
+		if d.units != UNIT_RAW {
+			if s, ok := sensor.(*Sensor); ok && read[name] != nil {
+				raw = s.frameState(read[name], UNIT_RAW)
+			} else {
+				raw = sensor.GetState(UNIT_RAW)
+			}
+		}
+		if len(raw) == 0 {
+			continue
+		}
+
+		diag, ok := d.diagnostics[name]
+		if !ok {
+			diag = NewSensorDiagnostics(len(raw), len(raw[0]), DIAGNOSTIC_WINDOW)
+			d.diagnostics[name] = diag
+		}
+		if taken := samples[name].Time; !taken.IsZero() {
+			diag.Add(raw, taken)
+		}
+
+		faults := diag.Faults()
+		if len(faults) == 0 {
+			continue
+		}
+		result[name] = faults
+		if d.config.Diagnostics.Interpolate {
+			interpolateFaults(states[name], faults)
+		}
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package onboard
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"math"
+	"testing"
+	"time"
+)
+
+// diagnosticFrames is the number of frames at FRAMERATE covering DIAGNOSTIC_MIN_HISTORY
+const diagnosticFrames = int(DIAGNOSTIC_MIN_HISTORY/time.Second)*FRAMERATE + 1
+
+// diagnosticTime gives the time frame f is taken at FRAMERATE
+func diagnosticTime(f int) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(f) * time.Second / FRAMERATE)
+}
+
+// diagnosticFrame builds a 3x3 raw frame with a load that rises and falls over time
+func diagnosticFrame(f int) SensorState {
+	load := 1000 + 500*math.Sin(float64(f)/10)
+	state := make(SensorState, 3)
+	for r := range state {
+		state[r] = []float64{load, load + 10, load + 20}
+	}
+	return state
+}
+
+func TestSensorDiagnostics(t *testing.T) {
+	Convey("Finding faulty sensels", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_WINDOW)
+
+		for f := 0; f < diagnosticFrames; f++ {
+			frame := diagnosticFrame(f)
+			frame[0][0] = 0
+			frame[2][2] = SATURATED_VALUE
+			frame[1][1] = 800 + 500*math.Cos(float64(f)*7)
+			diag.Add(frame, diagnosticTime(f))
+		}
+
+		faults := diag.Faults()
+		So(faults, ShouldContain, SenselFault{0, 0, FAULT_DEAD})
+		So(faults, ShouldContain, SenselFault{2, 2, FAULT_SATURATED})
+		So(faults, ShouldContain, SenselFault{1, 1, FAULT_UNCORRELATED})
+		So(faults, ShouldHaveLength, 3)
+
+		Convey("the state can be interpolated over the faults", func() {
+			state := diagnosticFrame(0)
+			state[0][0] = 0
+			state[1][1] = 4000
+			interpolateFaults(state, []SenselFault{{0, 0, FAULT_DEAD}, {1, 1, FAULT_UNCORRELATED}})
+			So(state[0][0], ShouldAlmostEqual, (1010+1000)/2.0, kScaleTolerance)
+			So(state[1][1], ShouldAlmostEqual, (1010+1020+1000+1020+1000+1010+1020)/7.0, kScaleTolerance)
+		})
+	})
+
+	Convey("Nothing is flagged without enough history", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_WINDOW)
+		for f := 0; f < diagnosticFrames-1; f++ {
+			frame := diagnosticFrame(f)
+			frame[0][0] = 0
+			diag.Add(frame, diagnosticTime(f))
+		}
+		So(diag.Analyse(), ShouldBeEmpty)
+	})
+
+	Convey("A quiet plate says nothing about correlation", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_WINDOW)
+		for f := 0; f < diagnosticFrames; f++ {
+			frame := diagnosticFrame(0)
+			frame[1][1] = float64(100 + f%3)
+			diag.Add(frame, diagnosticTime(f))
+		}
+		So(diag.Analyse(), ShouldBeEmpty)
+	})
+
+	Convey("An all-zero quiet plate reports nothing", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_WINDOW)
+		for f := 0; f < diagnosticFrames; f++ {
+			diag.Add(SensorState{{0, 0, 0}, {0, 0, 0}, {0, 0, 0}}, diagnosticTime(f))
+		}
+		So(diag.Analyse(), ShouldBeEmpty)
+	})
+
+	Convey("Sensels off the edge of the load are not dead", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_WINDOW)
+		for f := 0; f < diagnosticFrames; f++ {
+			frame := diagnosticFrame(f)
+			frame[0] = []float64{0, 0, 0}
+			frame[1][1] = 0
+			diag.Add(frame, diagnosticTime(f))
+		}
+		So(diag.Analyse(), ShouldResemble, []SenselFault{{1, 1, FAULT_DEAD}})
+	})
+
+	Convey("Only the configured window is kept", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_MIN_HISTORY)
+		for f := 0; f < diagnosticFrames; f++ {
+			frame := diagnosticFrame(f)
+			frame[0][0] = 0
+			diag.Add(frame, diagnosticTime(f))
+		}
+		So(diag.Analyse(), ShouldContain, SenselFault{0, 0, FAULT_DEAD})
+
+		// the sensel recovers
+		for f := diagnosticFrames; f < 2*diagnosticFrames; f++ {
+			diag.Add(diagnosticFrame(f), diagnosticTime(f))
+		}
+		So(diag.Analyse(), ShouldBeEmpty)
+	})
+
+	Convey("The history covers a time rather than a number of frames", t, func() {
+		diag := NewSensorDiagnostics(3, 3, DIAGNOSTIC_WINDOW)
+		frame := diagnosticFrame(0)
+		frame[0][0] = 0
+
+		Convey("so the same frame read again is only kept once", func() {
+			for f := 0; f < diagnosticFrames; f++ {
+				diag.Add(frame, diagnosticTime(0))
+			}
+			So(diag.Analyse(), ShouldBeEmpty)
+		})
+
+		Convey("and frames coming faster still need the full history", func() {
+			for f := 0; f < diagnosticFrames; f++ {
+				diag.Add(frame, diagnosticTime(0).Add(time.Duration(f)*time.Millisecond))
+			}
+			So(diag.Analyse(), ShouldBeEmpty)
+		})
+	})
+}
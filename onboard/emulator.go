@@ -0,0 +1,609 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EMULATOR_TICK is how often the emulated motors are moved
+	EMULATOR_TICK = 10 * time.Millisecond
+	// EMULATOR_SPEED_SCALE is the encoder counts per second an emulated motor moves for each unit of max speed
+	EMULATOR_SPEED_SCALE = 100
+	// EMULATOR_GAIN is how quickly an emulated motor closes on its goto position per second with no damping.
+	// Damping slows the approach so the motor eases onto the position.
+	EMULATOR_GAIN = 20
+)
+
+// EmulatedMotor models the registers and motion of a RMCS-220x motor behind the UART MCU.
+type EmulatedMotor struct {
+	maxSpeed int32
+	damping  int32
+	position float64 // encoder counts
+	origin   float64 // encoder count at the physical position the motor powered up at
+	target   float64
+	manual   int32 // speed and direction while moving under manual control, 0 when following the target
+	lock     sync.Mutex
+}
+
+// NewEmulatedMotor creates a motor at rest at encoder position 0 with the max speed and damping of a powered up motor.
+func NewEmulatedMotor() *EmulatedMotor {
+	return &EmulatedMotor{maxSpeed: 255}
+}
+
+// get reads a register, ok is false if the register is unknown.
+func (m *EmulatedMotor) get(reg uint8) (value int32, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch reg {
+	case m_REG_MAX_SPEED:
+		return m.maxSpeed, true
+	case m_REG_MANUAL:
+		return m.manual, true
+	case m_REG_DAMPING:
+		return m.damping, true
+	case m_REG_POSITION:
+		return int32(math.Round(m.position)), true
+	case m_REG_GOTO, m_REG_RELATIVE:
+		return int32(math.Round(m.target)), true
+	}
+	return 0, false
+}
+
+// put writes a register, ok is false if the register is unknown.
+func (m *EmulatedMotor) put(reg uint8, value int32) (ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch reg {
+	case m_REG_MAX_SPEED:
+		m.maxSpeed = value
+	case m_REG_MANUAL:
+		m.manual = value
+		// stopping holds the motor where it is
+		m.target = m.position
+	case m_REG_DAMPING:
+		m.damping = value
+	case m_REG_POSITION:
+		// resets the encoder without moving, the motor holds at the new position
+		m.origin += float64(value) - m.position
+		m.position = float64(value)
+		m.target = m.position
+	case m_REG_GOTO:
+		m.manual = 0
+		m.target = float64(value)
+	case m_REG_RELATIVE:
+		m.manual = 0
+		m.target = m.position + float64(value)
+	default:
+		return false
+	}
+	return true
+}
+
+// step moves the motor on by dt.
+// Under manual control the motor runs at the set speed, otherwise it closes on the target no faster than max speed.
+func (m *EmulatedMotor) step(dt time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	vmax := float64(m.maxSpeed) * EMULATOR_SPEED_SCALE
+	if m.manual != 0 {
+		v := math.Max(-vmax, math.Min(float64(m.manual)*EMULATOR_SPEED_SCALE, vmax))
+		m.position += v * dt.Seconds()
+		m.target = m.position
+		return
+	}
+
+	dist := m.target - m.position
+	gain := EMULATOR_GAIN / (1 + float64(m.damping)/math.MaxUint8)
+	v := math.Max(-vmax, math.Min(dist*gain, vmax))
+	move := v * dt.Seconds()
+	if math.Abs(move) >= math.Abs(dist) || math.Abs(dist) < 0.5 {
+		m.position = m.target
+		return
+	}
+	m.position += move
+}
+
+// Position gives the encoder position of the motor.
+func (m *EmulatedMotor) Position() int32 {
+	value, _ := m.get(m_REG_POSITION)
+	return value
+}
+
+// physical gives the distance in encoder counts the motor has moved since it powered up.
+// Unlike the position this does not change when the encoder is reset.
+func (m *EmulatedMotor) physical() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.position - m.origin
+}
+
+// UARTMCUEmulator plays the part of the UART MCU on a pseudo-terminal so the real UARTMCU can be pointed at the
+// slave in place of the serial port on the device.
+// It answers the same `M<addr> <cmd> [value]` protocol for each of its motors and reports motors it does not have
+// as not responding.
+type UARTMCUEmulator struct {
+	master *os.File
+	slave  string
+	motors map[int]*EmulatedMotor
+	faults *faultInjector
+	done   chan struct{}
+}
+
+// NewUARTMCUEmulator starts an emulated MCU with a motor at each of the addresses.
+func NewUARTMCUEmulator(addresses ...int) (*UARTMCUEmulator, error) {
+	return newUARTMCUEmulator(nil, addresses...)
+}
+
+// newUARTMCUEmulator starts an emulated MCU whose motors time out and stall with the faults.
+func newUARTMCUEmulator(faults *faultInjector, addresses ...int) (*UARTMCUEmulator, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to open pseudo-terminal: %v", err))
+	}
+
+	e := &UARTMCUEmulator{
+		master: master,
+		slave:  slave,
+		motors: make(map[int]*EmulatedMotor, len(addresses)),
+		faults: faults,
+		done:   make(chan struct{}),
+	}
+	for _, address := range addresses {
+		e.motors[address] = NewEmulatedMotor()
+	}
+
+	go e.serve()
+	go e.run()
+	return e, nil
+}
+
+// Slave gives the path of the pseudo-terminal to open in place of the UART.
+func (e *UARTMCUEmulator) Slave() string {
+	return e.slave
+}
+
+// Motor gives the emulated motor at the address, nil if there is none.
+func (e *UARTMCUEmulator) Motor(address int) *EmulatedMotor {
+	return e.motors[address]
+}
+
+// Close stops the emulator and closes the pseudo-terminal.
+func (e *UARTMCUEmulator) Close() error {
+	close(e.done)
+	return e.master.Close()
+}
+
+// run moves the motors on in real time until the emulator is closed.
+func (e *UARTMCUEmulator) run() {
+	ticker := time.NewTicker(EMULATOR_TICK)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, motor := range e.motors {
+				motor.step(now.Sub(last))
+			}
+			last = now
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// serve answers each request written to the slave until the emulator is closed.
+// The master fails to read while the slave is closed so the slave can be closed and opened again.
+func (e *UARTMCUEmulator) serve() {
+	for {
+		scanner := bufio.NewScanner(e.master)
+		for scanner.Scan() {
+			if resp := e.handle(scanner.Text()); resp != "" {
+				e.master.Write([]byte(resp + "\r\n"))
+			}
+		}
+
+		select {
+		case <-e.done:
+			return
+		case <-time.After(EMULATOR_TICK):
+		}
+	}
+}
+
+// handle acts on a single request, giving the response if there is one.
+// Writes are not answered, reads are answered with the value of the register or an error.
+// A read which times out with an injected fault is not answered at all.
+func (e *UARTMCUEmulator) handle(request string) string {
+	var address int
+	var reg uint8
+	var value int32
+	n, _ := fmt.Sscanf(strings.TrimSpace(request), "M%d %d %d", &address, &reg, &value)
+	if n < 2 {
+		return "ERROR BAD REQUEST"
+	}
+
+	motor, ok := e.motors[address]
+	if !ok {
+		if n == 2 {
+			return "ERROR NO RESPONSE"
+		}
+		return ""
+	}
+
+	if n == 2 {
+		if e.faults.motorTimeout() != nil {
+			return ""
+		}
+		value, ok := motor.get(reg)
+		if !ok {
+			return "ERROR BAD REGISTER"
+		}
+		return fmt.Sprintf("%d", value)
+	}
+	if reg == m_REG_GOTO {
+		value = int32(e.faults.stall(int(motor.Position()), int(value)))
+	}
+	motor.put(reg, value)
+	return ""
+}
+
+// EmulatedI2CDevice is the register space of a device on an emulated I2C bus.
+type EmulatedI2CDevice interface {
+	Get(reg uint16, buf []byte) error
+	Put(reg uint16, buf []byte) error
+}
+
+// I2CBusEmulator is an I2CBusInterface which passes each transfer to the emulated device at the address.
+// Addresses without a device fail like a device which does not acknowledge.
+type I2CBusEmulator struct {
+	devices map[int]EmulatedI2CDevice
+	lock    sync.RWMutex
+}
+
+func NewI2CBusEmulator() *I2CBusEmulator {
+	return &I2CBusEmulator{devices: make(map[int]EmulatedI2CDevice)}
+}
+
+// Attach puts the device on the bus at the address, replacing any device already there.
+func (bus *I2CBusEmulator) Attach(address int, device EmulatedI2CDevice) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.devices[address] = device
+}
+
+func (bus *I2CBusEmulator) device(address int) (EmulatedI2CDevice, error) {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	device, ok := bus.devices[address]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No device at 0x%x", address))
+	}
+	return device, nil
+}
+
+func (bus *I2CBusEmulator) Get(i2cAddr int, reg uint16, buf []byte) error {
+	device, err := bus.device(i2cAddr)
+	if err != nil {
+		return err
+	}
+	return device.Get(reg, buf)
+}
+
+func (bus *I2CBusEmulator) Put(i2cAddr int, reg uint16, buf []byte) error {
+	device, err := bus.device(i2cAddr)
+	if err != nil {
+		return err
+	}
+	return device.Put(reg, buf)
+}
+
+// EmulatedSensorBoard models the mode, address and values registers of a sensor board.
+// The address register can be written but, as on the real board, only takes effect after a reboot which is not
+// emulated. Injected faults fail or corrupt reads of the values register.
+type EmulatedSensorBoard struct {
+	mode    uint8
+	address uint8
+	bus     int // address the board answers at until it reboots
+	values  []uint16
+	faults  *faultInjector
+	lock    sync.Mutex
+}
+
+// NewEmulatedSensorBoard creates a board at the address with every sensel at zero.
+func NewEmulatedSensorBoard(address int) *EmulatedSensorBoard {
+	return &EmulatedSensorBoard{
+		address: uint8(address),
+		bus:     address,
+		values:  make([]uint16, sb_ROWS*sb_COLS),
+	}
+}
+
+func (b *EmulatedSensorBoard) Get(reg uint16, buf []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch reg {
+	case sb_REG_MODE:
+		buf[0] = b.mode
+	case sb_REG_ADDR:
+		buf[0] = b.address
+	case sb_REG_VALUES:
+		if err := b.faults.boardErr(b.bus, time.Now()); err != nil {
+			return err
+		}
+		if b.faults.dropFrame() {
+			return errors.New("Remote I/O error")
+		}
+		values := b.values
+		if b.faults != nil {
+			values = append([]uint16(nil), b.values...)
+			b.faults.corruptCounts(values)
+		}
+		for i := 0; i < len(values) && i*2+1 < len(buf); i++ {
+			binary.BigEndian.PutUint16(buf[i*2:], values[i])
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unkown sensor board register 0x%x", reg))
+	}
+	return nil
+}
+
+func (b *EmulatedSensorBoard) Put(reg uint16, buf []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch reg {
+	case sb_REG_MODE:
+		b.mode = buf[0]
+	case sb_REG_ADDR:
+		b.address = buf[0]
+	default:
+		return errors.New(fmt.Sprintf("Unable to write sensor board register 0x%x", reg))
+	}
+	return nil
+}
+
+// Mode gives the mode last written to the board.
+func (b *EmulatedSensorBoard) Mode() uint8 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.mode
+}
+
+// Set puts a count into the values register at the row and col of the board.
+func (b *EmulatedSensorBoard) Set(row, col int, value uint16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.values[row*sb_COLS+col] = value
+}
+
+// Fill puts the same count into every value on the board.
+func (b *EmulatedSensorBoard) Fill(value uint16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i := range b.values {
+		b.values[i] = value
+	}
+}
+
+// emulatedSensor is a sensor on an emulated board, used to turn synthesised pressure into the counts on the board.
+type emulatedSensor struct {
+	layout   *Sensor // maps the sensels to registers and the scale of the sensor
+	zero     uint16
+	foot     string
+	geometry SensorGeometry
+}
+
+// counts gives the register value which the sensor reads back as the pressure in kPa, as if perfectly equalised.
+// Sensors with a calibration curve are written using their linear full scale.
+func (s emulatedSensor) counts(pressure float64) uint16 {
+	counts := float64(s.zero) + pressure*math.MaxUint8/s.layout.fullScale*s.layout.scaleFactor
+	return uint16(math.Min(counts, SATURATED_VALUE))
+}
+
+// synthesise writes the pressure under each of the sensors on the board each interval until done is closed.
+// Registers which are not under a sensor read zero, as unloaded sensels do on the real boards.
+func (b *EmulatedSensorBoard) synthesise(gait *GaitSynthesiser, sensors []emulatedSensor, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	values := make([]uint16, sb_ROWS*sb_COLS)
+	for {
+		t := time.Since(start).Seconds()
+		for i := range values {
+			values[i] = 0
+		}
+		for _, s := range sensors {
+			pressure := gait.PressureMap(s.foot, t)
+			for row := 0; row < s.layout.rows; row++ {
+				for col := 0; col < s.layout.cols; col++ {
+					p := pressure(s.geometry.PlatePoint(Point{float64(col), float64(row)}))
+					values[s.layout.reg(row, col)] += s.counts(p)
+				}
+			}
+		}
+
+		b.lock.Lock()
+		copy(b.values, values)
+		b.lock.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// emulatedSwitch is a limit switch which closes once its motor has moved past the home position.
+type emulatedSwitch struct {
+	motor *EmulatedMotor
+	home  float64
+}
+
+// closed reports if the motor has reached the switch, travelling away from where it powered up.
+func (s emulatedSwitch) closed() bool {
+	pos := s.motor.physical()
+	if s.home < 0 {
+		return pos <= s.home
+	}
+	return pos >= s.home
+}
+
+// EmulatedSwitchMCU models the ID and input registers of the switch MCU.
+// Inputs are active low, each input bit is cleared while its limit switch is closed.
+type EmulatedSwitchMCU struct {
+	switches map[uint16]emulatedSwitch // keyed by input bit
+	lock     sync.Mutex
+}
+
+func NewEmulatedSwitchMCU() *EmulatedSwitchMCU {
+	return &EmulatedSwitchMCU{switches: make(map[uint16]emulatedSwitch)}
+}
+
+// Attach wires the limit switch on the control input of the MCU to the motor.
+// The switch closes when the motor has moved home encoder counts from where it powered up, matching the calibration
+// value the motor is homed with.
+func (mcu *EmulatedSwitchMCU) Attach(control uint16, motor *EmulatedMotor, home int) {
+	mcu.lock.Lock()
+	defer mcu.lock.Unlock()
+	mcu.switches[1<<(control-1)] = emulatedSwitch{motor, float64(home)}
+}
+
+// inputs gives the value of the input register.
+func (mcu *EmulatedSwitchMCU) inputs() uint16 {
+	mcu.lock.Lock()
+	defer mcu.lock.Unlock()
+	inputs := uint16(0xFFFF)
+	for bit, s := range mcu.switches {
+		if s.closed() {
+			inputs &^= bit
+		}
+	}
+	return inputs
+}
+
+func (mcu *EmulatedSwitchMCU) Get(reg uint16, buf []byte) error {
+	switch reg {
+	case sm_REG_ID:
+		binary.LittleEndian.PutUint16(buf, sm_KNOWN_ID)
+	case sm_REG_VALUES:
+		binary.LittleEndian.PutUint16(buf, mcu.inputs())
+	default:
+		return errors.New(fmt.Sprintf("Unkown switch MCU register 0x%x", reg))
+	}
+	return nil
+}
+
+func (mcu *EmulatedSwitchMCU) Put(reg uint16, buf []byte) error {
+	return errors.New("Switch MCU registers are read only")
+}
+
+// DeviceEmulator is the emulated hardware for a config, connected the same way as the hardware on the device.
+// Sensor boards and the switch MCU share an emulated I2C bus while the motors are behind an emulated UART MCU.
+type DeviceEmulator struct {
+	SensorBus *I2CBusEmulator
+	Boards    map[int]*EmulatedSensorBoard
+	Switches  *EmulatedSwitchMCU
+	UART      *UARTMCUEmulator
+	mcu       *UARTMCU
+	done      chan struct{}
+}
+
+// NewDeviceEmulator emulates a sensor board at each address used by the sensors, a motor at each motor address
+// wired to its limit switch, and the switch MCU. The sensor boards read the pressure synthesised for the simulator.
+// The faults in the simulator config are injected into the transfers on the emulated buses.
+func NewDeviceEmulator(config *DynastatConfig) (e *DeviceEmulator, err error) {
+	gait, err := NewGaitSynthesiser(config.Simulator.GaitConfig)
+	if err != nil {
+		return nil, err
+	}
+	faults, err := newFaultInjector(config.Simulator.Faults)
+	if err != nil {
+		return nil, err
+	}
+
+	e = &DeviceEmulator{
+		SensorBus: NewI2CBusEmulator(),
+		Boards:    make(map[int]*EmulatedSensorBoard),
+		Switches:  NewEmulatedSwitchMCU(),
+		done:      make(chan struct{}),
+	}
+	if faults.switchesErr() == nil {
+		e.SensorBus.Attach(sm_ADDRESS, e.Switches)
+	}
+
+	sensors := make(map[int][]emulatedSensor)
+	for name, conf := range config.Sensors {
+		layout, err := NewSensor(nil, conf.Registry, conf.Mirror, conf.Rows, conf.Cols,
+			conf.ZeroValue, conf.HalfValue, conf.FullValue, conf.FullScale)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unable to emulate sensor %s: %v", name, err))
+		}
+		sensors[conf.Address] = append(sensors[conf.Address], emulatedSensor{layout, conf.ZeroValue, conf.Foot, conf.Geometry})
+	}
+	for address := range sensors {
+		board := NewEmulatedSensorBoard(address)
+		board.faults = faults
+		e.Boards[address] = board
+		e.SensorBus.Attach(address, board)
+	}
+
+	addresses := make([]int, 0, len(config.Motors))
+	for _, conf := range config.Motors {
+		addresses = append(addresses, conf.Address)
+	}
+	if e.UART, err = newUARTMCUEmulator(faults, addresses...); err != nil {
+		return nil, err
+	}
+	for _, conf := range config.Motors {
+		e.Switches.Attach(conf.Control, e.UART.Motor(conf.Address), conf.Cal)
+	}
+
+	if e.mcu, err = OpenUARTMCU(e.UART.Slave(), config.UART.Timeout); err != nil {
+		e.UART.Close()
+		return nil, err
+	}
+
+	// only started once nothing else can fail so they are always stopped by Close
+	for address, board := range e.Boards {
+		go board.synthesise(gait, sensors[address], SENSOR_INTERVAL, e.done)
+	}
+	return e, nil
+}
+
+// MotorBus gives the real UART MCU connected to the emulated one.
+func (e *DeviceEmulator) MotorBus() UARTMCUInterface {
+	return e.mcu
+}
+
+// Close stops the emulated hardware.
+func (e *DeviceEmulator) Close() {
+	close(e.done)
+	e.mcu.Close()
+	e.UART.Close()
+}
+
+// NewEmulatedDynastat runs the real device code against emulated hardware for the config.
+func NewEmulatedDynastat(config *DynastatConfig) (*Dynastat, *DeviceEmulator, error) {
+	emulator, err := NewDeviceEmulator(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dynastat, err := NewDynastatWithBuses(config, emulator.SensorBus, emulator.MotorBus())
+	if err != nil {
+		emulator.Close()
+		return nil, nil, err
+	}
+	return dynastat, emulator, nil
+}
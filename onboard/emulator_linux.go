@@ -0,0 +1,44 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+//go:build linux
+
+package onboard
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// EMULATOR_AVAILABLE reports whether the hardware can be emulated behind the real drivers on this platform.
+const EMULATOR_AVAILABLE = true
+
+// openPty opens a new pseudo-terminal, giving the master and the path of the slave.
+func openPty() (master *os.File, slave string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var n, unlock uint32
+	var t syscall.Termios
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	}
+	if err == nil {
+		err = ioctl(master.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	}
+	if err == nil {
+		// raw so nothing is echoed or translated before the slave is opened as a serial port
+		t.Iflag, t.Oflag, t.Lflag = 0, 0, 0
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		err = ioctl(master.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	}
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n), nil
+}
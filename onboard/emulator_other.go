@@ -0,0 +1,19 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+//go:build !linux
+
+package onboard
+
+import (
+	"errors"
+	"os"
+)
+
+// EMULATOR_AVAILABLE reports whether the hardware can be emulated behind the real drivers on this platform.
+// Only linux can open the pseudo-terminal the UART MCU is emulated on.
+const EMULATOR_AVAILABLE = false
+
+// openPty is only available on linux, elsewhere the UART MCU can not be emulated.
+func openPty() (master *os.File, slave string, err error) {
+	return nil, "", errors.New("Pseudo-terminals can only be opened on linux")
+}
@@ -0,0 +1,246 @@
+package onboard
+
+import (
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// waitForPosition polls the motor until it reaches the position or the timeout passes, giving the last position.
+func waitForPosition(motor MotorInterface, position int, timeout time.Duration) (pos int) {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(EMULATOR_TICK) {
+		if pos, _ = motor.GetPosition(); pos == position {
+			return
+		}
+	}
+	return
+}
+
+func TestUARTMCUEmulator(t *testing.T) {
+	emulator, err := NewUARTMCUEmulator(0x10, 0x11)
+	if err != nil {
+		t.Skipf("Unable to emulate the UART MCU: %v", err)
+	}
+	defer emulator.Close()
+
+	mcu, err := OpenUARTMCU(emulator.Slave(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Close()
+
+	Convey("Driving emulated motors through the real UART MCU", t, func() {
+		motor, err := NewRMCS220xMotor(mcu, nil, 1, 0x10, 0, 2550, 200, 10)
+		So(err, ShouldBeNil)
+
+		Convey("the motor parameters are written", func() {
+			speed, err := mcu.Get(0x10, m_REG_MAX_SPEED)
+			So(err, ShouldBeNil)
+			So(speed, ShouldEqual, 200)
+			damping, err := mcu.Get(0x10, m_REG_DAMPING)
+			So(err, ShouldBeNil)
+			So(damping, ShouldEqual, 10)
+		})
+
+		Convey("the motor moves to its target over time", func() {
+			So(motor.SetTarget(128), ShouldBeNil)
+			pos, _ := motor.GetPosition()
+			So(pos, ShouldBeLessThan, 128)
+			So(waitForPosition(motor, 128, time.Second), ShouldEqual, 128)
+			So(emulator.Motor(0x10).Position(), ShouldEqual, 1275)
+
+			Convey("and can be moved relative to where it is", func() {
+				So(motor.putRaw(m_REG_RELATIVE, -1275), ShouldBeNil)
+				So(waitForPosition(motor, 0, time.Second), ShouldEqual, 0)
+			})
+
+			Convey("and holds when the encoder is reset", func() {
+				So(motor.putRaw(m_REG_POSITION, 0), ShouldBeNil)
+				time.Sleep(5 * EMULATOR_TICK)
+				So(emulator.Motor(0x10).Position(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("a missing motor does not respond", func() {
+			_, err := mcu.Get(0x12, m_REG_POSITION)
+			So(err, ShouldEqual, ErrNoResponse)
+		})
+	})
+}
+
+func TestI2CEmulators(t *testing.T) {
+	bus := NewI2CBusEmulator()
+	board := NewEmulatedSensorBoard(0x15)
+	switches := NewEmulatedSwitchMCU()
+	bus.Attach(0x15, board)
+	bus.Attach(sm_ADDRESS, switches)
+
+	Convey("Driving an emulated sensor board through the real sensor board", t, func() {
+		sb := NewSensorBoard(bus, 0x15)
+
+		Convey("the mode is written and read back", func() {
+			So(sb.SetMode(0x12), ShouldBeNil)
+			So(board.Mode(), ShouldEqual, 0x12)
+		})
+
+		Convey("values are read in a frame", func() {
+			board.Set(2, 3, 1234)
+			So(sb.read(), ShouldBeNil)
+			So(sb.getValue(2*sb_COLS+3), ShouldEqual, 1234)
+		})
+
+		Convey("the address register can be changed", func() {
+			So(sb.changeAddress(0x16), ShouldBeNil)
+			buf := make([]byte, 1)
+			board.Get(sb_REG_ADDR, buf)
+			So(buf[0], ShouldEqual, 0x16)
+		})
+
+		Convey("a board which is not on the bus fails", func() {
+			So(NewSensorBoard(bus, 0x25).read(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Reading the limit switches through the real switch MCU", t, func() {
+		motor := NewEmulatedMotor()
+		switches.Attach(2, motor, -100)
+		mcu, err := NewSwitchMCU(bus, sm_ADDRESS)
+		So(err, ShouldBeNil)
+
+		home, err := mcu.ReadInput(1 << 1)
+		So(err, ShouldBeNil)
+		So(home, ShouldBeFalse)
+
+		motor.put(m_REG_GOTO, -150)
+		motor.step(time.Second)
+		home, err = mcu.ReadInput(1 << 1)
+		So(err, ShouldBeNil)
+		So(home, ShouldBeTrue)
+
+		Convey("resetting the encoder does not move the switch", func() {
+			motor.put(m_REG_POSITION, 0)
+			home, _ = mcu.ReadInput(1 << 1)
+			So(home, ShouldBeTrue)
+		})
+	})
+}
+
+func TestEmulatedDynastat(t *testing.T) {
+	config := &DynastatConfig{
+		Version: 2,
+		Motors: map[string]MotorConfig{
+			"TestMotor": {Address: 0x10, Cal: -200, Low: 0, High: 2550, Speed: 255, Damping: 0, Control: 2},
+		},
+		Sensors: map[string]SensorConfig{
+			"TestSensor": {Address: 0x15, Mode: 0x12, Registry: 1, Rows: 16, Cols: 16, ZeroValue: 100, HalfValue: 127, FullValue: 255, Geometry: SensorGeometry{Pitch: DEFAULT_PITCH}},
+		},
+	}
+
+	dynastat, emulator, err := NewEmulatedDynastat(config)
+	if err != nil {
+		t.Skipf("Unable to emulate the device: %v", err)
+	}
+	defer emulator.Close()
+
+	Convey("Running the real device code on emulated hardware", t, func() {
+		So(emulator.Boards[0x15].Mode(), ShouldEqual, 0x12)
+		So(dynastat.switches, ShouldNotBeNil)
+
+		time.Sleep(time.Second / FRAMERATE * 2)
+		state, err := dynastat.GetState()
+		So(err, ShouldBeNil)
+		So(state.Degraded, ShouldBeNil)
+		So(state.Sensors["TestSensor"], ShouldHaveLength, 16)
+		So(state.SensorSamples["TestSensor"].Seq, ShouldBeGreaterThan, 0)
+
+		Convey("motors move to their targets", func() {
+			So(dynastat.SetMotor("TestMotor", 128), ShouldBeNil)
+			So(waitForPosition(dynastat.Motors["TestMotor"], 128, time.Second), ShouldEqual, 128)
+		})
+
+		Convey("motors are homed against their limit switch", func() {
+			So(dynastat.HomeMotor("TestMotor"), ShouldBeNil)
+
+			// the switch is at the calibration value so the encoder lines up with where the motor powered up,
+			// give or take the overshoot of the last step towards the switch
+			motor := emulator.UART.Motor(0x10)
+			So(float64(motor.Position())-motor.physical(), ShouldBeBetweenOrEqual, 0, 2550/10)
+		})
+	})
+}
+
+func TestEmulatorFaults(t *testing.T) {
+	config := func(faults FaultConfig) *DynastatConfig {
+		config := &DynastatConfig{
+			Version: 2,
+			Retry:   RetryPolicy{Attempts: 2, Delay: -1},
+			Motors: map[string]MotorConfig{
+				"TestMotor": {Address: 0x10, Cal: -200, Low: 0, High: 2550, Speed: 255, Control: 2},
+			},
+			Sensors: map[string]SensorConfig{
+				"TestSensor": {Address: 0x15, Registry: 1, Rows: 16, Cols: 16, ZeroValue: 100, HalfValue: 127, FullValue: 255, Geometry: SensorGeometry{Pitch: DEFAULT_PITCH}},
+			},
+		}
+		config.UART.Timeout = 20 * time.Millisecond
+		config.Simulator.Faults = faults
+		return config
+	}
+
+	Convey("Emulated boards fail and corrupt their reads", t, func() {
+		f, _ := newFaultInjector(FaultConfig{CorruptFrames: 1})
+		board := NewEmulatedSensorBoard(0x15)
+		board.faults = f
+		buf := make([]byte, sb_ROWS*sb_COLS*2)
+		So(board.Get(sb_REG_VALUES, buf), ShouldBeNil)
+		var corrupt int
+		for i := 0; i < len(buf); i += 2 {
+			if binary.BigEndian.Uint16(buf[i:]) != 0 {
+				corrupt++
+			}
+		}
+		So(corrupt, ShouldBeGreaterThan, 0)
+
+		f, _ = newFaultInjector(FaultConfig{DropFrames: 1})
+		board.faults = f
+		So(board.Get(sb_REG_VALUES, buf), ShouldNotBeNil)
+		So(board.Get(sb_REG_MODE, buf), ShouldBeNil)
+	})
+
+	Convey("Running the real device code on failing emulated hardware", t, func() {
+		Convey("reports boards which go offline through the retries", func() {
+			dynastat, emulator, err := NewEmulatedDynastat(config(FaultConfig{OfflineEvery: time.Hour, OfflineFor: time.Hour - time.Nanosecond}))
+			if err != nil {
+				t.Skipf("Unable to emulate the device: %v", err)
+			}
+			defer emulator.Close()
+
+			time.Sleep(time.Second / FRAMERATE * 2)
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Degraded, ShouldContainKey, "board 0x15")
+		})
+
+		Convey("reports motors which do not answer through the UART", func() {
+			dynastat, emulator, err := NewEmulatedDynastat(config(FaultConfig{MotorTimeouts: 1}))
+			if err != nil {
+				t.Skipf("Unable to emulate the device: %v", err)
+			}
+			defer emulator.Close()
+
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Degraded, ShouldContainKey, "motor TestMotor")
+		})
+
+		Convey("can not home without the switches", func() {
+			dynastat, emulator, err := NewEmulatedDynastat(config(FaultConfig{NoSwitches: true}))
+			if err != nil {
+				t.Skipf("Unable to emulate the device: %v", err)
+			}
+			defer emulator.Close()
+
+			So(dynastat.Degraded(), ShouldContainKey, COMPONENT_SWITCHES)
+		})
+	})
+}
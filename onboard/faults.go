@@ -0,0 +1,164 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+/*
+	Fault injection for the simulator and the emulated hardware, so the rest of the application can be run against
+	hardware which fails. The simulator fails its sensor and motor objects directly while the emulated hardware fails
+	the transfers on its buses, so the retries and the UART parser are exercised too.
+*/
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultConfig sets up the hardware failures injected by the simulator. Chances are from 0 for never to 1 for always.
+type FaultConfig struct {
+	DropFrames    float64       // chance a sensor misses a frame, a failed read of an emulated board
+	CorruptFrames float64       // chance a sensor frame has some sensels replaced with noise
+	MotorTimeouts float64       // chance reading the state of a motor times out, an unanswered emulated request
+	MotorStalls   float64       // chance a motor stalls part of the way to a new target
+	NoSwitches    bool          // run without the switch MCU so the motors can not be homed
+	OfflineBoards []int         // addresses of the boards which go offline, every board if empty
+	OfflineEvery  time.Duration // how often the boards go offline, never if 0
+	OfflineFor    time.Duration // how long the boards stay offline for
+	Seed          int64         // seed for the chances, taken from the clock if 0
+}
+
+// SimulatorConfig sets up the simulated device. The gait settings sit at the top level so older configs still load.
+type SimulatorConfig struct {
+	GaitConfig `yaml:",inline"`
+	Faults     FaultConfig
+}
+
+// ErrBoardOffline is given for the sensors on a simulated board while it is offline.
+var ErrBoardOffline = errors.New("Sensor board offline")
+
+// faultInjector decides when the simulated hardware fails. A nil faultInjector never fails.
+type faultInjector struct {
+	conf    FaultConfig
+	offline map[int]bool
+	start   time.Time
+	rand    *rand.Rand
+	lock    sync.Mutex
+}
+
+// newFaultInjector checks the config, giving nil if it does not inject any faults.
+func newFaultInjector(conf FaultConfig) (*faultInjector, error) {
+	for name, chance := range map[string]float64{
+		"drop frames":    conf.DropFrames,
+		"corrupt frames": conf.CorruptFrames,
+		"motor timeouts": conf.MotorTimeouts,
+		"motor stalls":   conf.MotorStalls,
+	} {
+		if chance < 0 || chance > 1 {
+			return nil, errors.New(fmt.Sprintf("Chance of %s must be between 0 and 1, not %v", name, chance))
+		}
+	}
+	if conf.OfflineEvery < 0 || conf.OfflineFor < 0 || (conf.OfflineEvery > 0 && conf.OfflineFor >= conf.OfflineEvery) {
+		return nil, errors.New(fmt.Sprintf("Boards can not go offline for %v every %v", conf.OfflineFor, conf.OfflineEvery))
+	}
+
+	if conf.DropFrames == 0 && conf.CorruptFrames == 0 && conf.MotorTimeouts == 0 && conf.MotorStalls == 0 &&
+		!conf.NoSwitches && conf.OfflineEvery == 0 {
+		return nil, nil
+	}
+
+	f := &faultInjector{conf: conf, start: time.Now()}
+	seed := conf.Seed
+	if seed == 0 {
+		seed = f.start.UnixNano()
+	}
+	f.rand = rand.New(rand.NewSource(seed))
+	if len(conf.OfflineBoards) > 0 {
+		f.offline = make(map[int]bool, len(conf.OfflineBoards))
+		for _, address := range conf.OfflineBoards {
+			f.offline[address] = true
+		}
+	}
+	return f, nil
+}
+
+// chance gives true with the chance.
+func (f *faultInjector) chance(chance float64) bool {
+	if f == nil || chance <= 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.rand.Float64() < chance
+}
+
+// boardErr gives ErrBoardOffline while the board at the address is offline.
+// Boards go offline at the end of each period so the device starts with everything working.
+func (f *faultInjector) boardErr(address int, now time.Time) error {
+	if f == nil || f.conf.OfflineEvery == 0 || (f.offline != nil && !f.offline[address]) {
+		return nil
+	}
+	if now.Sub(f.start)%f.conf.OfflineEvery >= f.conf.OfflineEvery-f.conf.OfflineFor {
+		return ErrBoardOffline
+	}
+	return nil
+}
+
+// dropFrame tells whether a sensor misses its next frame.
+func (f *faultInjector) dropFrame() bool {
+	return f != nil && f.chance(f.conf.DropFrames)
+}
+
+// corrupt replaces some of the pressures in a frame with noise up to the full scale.
+func (f *faultInjector) corrupt(pressure []float64) {
+	f.scramble(len(pressure), func(i int, noise float64) { pressure[i] = noise * DEFAULT_FULL_SCALE })
+}
+
+// corruptCounts replaces some of the counts read from an emulated board with noise up to saturation.
+func (f *faultInjector) corruptCounts(values []uint16) {
+	f.scramble(len(values), func(i int, noise float64) { values[i] = uint16(noise * SATURATED_VALUE) })
+}
+
+// scramble replaces some of the n values in a corrupted frame with noise from 0 to 1.
+func (f *faultInjector) scramble(n int, replace func(i int, noise float64)) {
+	if f == nil || n == 0 || !f.chance(f.conf.CorruptFrames) {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// about one value in eight, and always at least one
+	for k := n/8 + 1; k > 0; k-- {
+		replace(f.rand.Intn(n), f.rand.Float64())
+	}
+}
+
+// motorTimeout gives ErrNoResponse when reading a motor times out.
+func (f *faultInjector) motorTimeout() error {
+	if f != nil && f.chance(f.conf.MotorTimeouts) {
+		return ErrNoResponse
+	}
+	return nil
+}
+
+// stall gives the position a motor moving from current to target stalls at, or target if it does not stall.
+func (f *faultInjector) stall(current, target int) int {
+	if f == nil || current == target || !f.chance(f.conf.MotorStalls) {
+		return target
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// stop somewhere short of the target without reaching it
+	if target > current {
+		return current + f.rand.Intn(target-current)
+	}
+	return current - f.rand.Intn(current-target)
+}
+
+// switchesErr gives the error from setting up the switch MCU, nil if it is there.
+func (f *faultInjector) switchesErr() error {
+	if f != nil && f.conf.NoSwitches {
+		return errors.New("Switch MCU not found")
+	}
+	return nil
+}
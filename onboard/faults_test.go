@@ -0,0 +1,130 @@
+package onboard
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	Convey("Setting up fault injection", t, func() {
+		Convey("injects nothing without any faults", func() {
+			f, err := newFaultInjector(FaultConfig{Seed: 42})
+			So(err, ShouldBeNil)
+			So(f, ShouldBeNil)
+			So(f.dropFrame(), ShouldBeFalse)
+			So(f.motorTimeout(), ShouldBeNil)
+			So(f.stall(0, 100), ShouldEqual, 100)
+			So(f.boardErr(0x15, time.Now()), ShouldBeNil)
+		})
+
+		Convey("rejects chances out of range", func() {
+			_, err := newFaultInjector(FaultConfig{DropFrames: 1.5})
+			So(err, ShouldNotBeNil)
+			_, err = newFaultInjector(FaultConfig{MotorStalls: -0.1})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("rejects boards which never come back", func() {
+			_, err := newFaultInjector(FaultConfig{OfflineEvery: time.Second, OfflineFor: time.Second})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Injecting faults", t, func() {
+		f, err := newFaultInjector(FaultConfig{
+			CorruptFrames: 1,
+			MotorStalls:   1,
+			OfflineBoards: []int{0x15},
+			OfflineEvery:  100 * time.Millisecond,
+			OfflineFor:    20 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("stalls motors short of the target", func() {
+			So(f.stall(0, 100), ShouldBeBetweenOrEqual, 0, 99)
+			So(f.stall(100, 0), ShouldBeBetweenOrEqual, 1, 100)
+		})
+
+		Convey("corrupts frames", func() {
+			pressure := make([]float64, 64)
+			f.corrupt(pressure)
+			var corrupt int
+			for _, p := range pressure {
+				if p != 0 {
+					corrupt++
+				}
+			}
+			So(corrupt, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("takes the boards offline at the end of each period", func() {
+			So(f.boardErr(0x15, f.start.Add(50*time.Millisecond)), ShouldBeNil)
+			So(f.boardErr(0x15, f.start.Add(90*time.Millisecond)), ShouldEqual, ErrBoardOffline)
+			So(f.boardErr(0x15, f.start.Add(150*time.Millisecond)), ShouldBeNil)
+			So(f.boardErr(0x16, f.start.Add(90*time.Millisecond)), ShouldBeNil)
+		})
+	})
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	config := func(faults FaultConfig) *DynastatConfig {
+		config := &DynastatConfig{
+			Version: 2,
+			Motors:  map[string]MotorConfig{"TestMotor": {}},
+			Sensors: map[string]SensorConfig{"TestSensor": {Address: 0x15, Rows: 2, Cols: 2, Geometry: SensorGeometry{Pitch: DEFAULT_PITCH}}},
+		}
+		config.Simulator.Faults = faults
+		return config
+	}
+
+	Convey("Faults are read from the simulator section of the config", t, func() {
+		var config DynastatConfig
+		err := yaml.Unmarshal([]byte(`
+simulator:
+  mode: walk
+  faults:
+    dropframes: 0.1
+    offlineboards: [0x15]
+    offlineevery: 10s
+    offlinefor: 2s
+`), &config)
+		So(err, ShouldBeNil)
+		So(config.Simulator.Mode, ShouldEqual, GAIT_WALK)
+		So(config.Simulator.Faults.DropFrames, ShouldEqual, 0.1)
+		So(config.Simulator.Faults.OfflineBoards, ShouldResemble, []int{0x15})
+		So(config.Simulator.Faults.OfflineFor, ShouldEqual, 2*time.Second)
+	})
+
+	Convey("A simulated device with failing hardware", t, func() {
+		Convey("reports motors which time out", func() {
+			dynastat := NewDynastatSimulator(config(FaultConfig{MotorTimeouts: 1}))
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Degraded, ShouldContainKey, "motor TestMotor")
+		})
+
+		Convey("can not home without the switches", func() {
+			dynastat := NewDynastatSimulator(config(FaultConfig{NoSwitches: true}))
+			So(dynastat.Degraded(), ShouldContainKey, COMPONENT_SWITCHES)
+			So(dynastat.HomeMotor("TestMotor"), ShouldNotBeNil)
+		})
+
+		Convey("keeps the last frame from a board which is offline", func() {
+			dynastat := NewDynastatSimulator(config(FaultConfig{OfflineEvery: time.Hour, OfflineFor: time.Hour - time.Nanosecond}))
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Degraded, ShouldContainKey, "board 0x15")
+			So(state.SensorSamples["TestSensor"].Seq, ShouldEqual, 0)
+		})
+
+		Convey("does not count dropped frames", func() {
+			dynastat := NewDynastatSimulator(config(FaultConfig{DropFrames: 1}))
+			time.Sleep(SENSOR_INTERVAL * count)
+			state, _ := dynastat.GetState()
+			So(state.Degraded, ShouldBeNil)
+			So(state.SensorSamples["TestSensor"].Seq, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,267 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+/*
+	Synthesis of plantar pressure for the simulators.
+*/
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// GaitMode selects what the simulated person on the plate is doing.
+type GaitMode string
+
+const (
+	GAIT_STANCE GaitMode = "stance" // quiet standing with a little postural sway
+	GAIT_SHIFT  GaitMode = "shift"  // shifting weight from foot to foot and from heel to toe
+	GAIT_WALK   GaitMode = "walk"   // walking on the spot, each foot rolling from heel strike to toe off
+)
+
+// FootType selects the arch of the simulated feet.
+type FootType string
+
+const (
+	FOOT_NEUTRAL FootType = "neutral"
+	FOOT_FLAT    FootType = "flat"  // low arch, the midfoot carries load
+	FOOT_CAVUS   FootType = "cavus" // high arch, the load is carried by the heel and forefoot
+)
+
+const (
+	DEFAULT_BODY_WEIGHT  = 70              // kg
+	DEFAULT_CADENCE      = 100             // steps per minute
+	DEFAULT_SHIFT_PERIOD = 4 * time.Second // time to shift from one foot to the other and back
+
+	gait_STANCE_RATIO = 0.6 // part of each gait cycle a foot is on the ground
+	gait_SWAY_LATERAL = 0.03
+	gait_SWAY_AP      = 0.05
+	gait_SWAY_PERIOD  = 7 // seconds
+	gait_SHIFT_SIDE   = 0.3
+	gait_SHIFT_AP     = 0.4
+	gait_PLATE_WIDTH  = 80 // mm across the plate of a foot, the right foot is laid out as the mirror image of the left
+)
+
+// GaitConfig sets up the pressure synthesised for the simulated feet. Zero values are replaced by the defaults.
+type GaitConfig struct {
+	Mode        GaitMode
+	BodyWeight  float64 // kg
+	Cadence     float64 // steps per minute while walking
+	FootType    FootType
+	ShiftPeriod time.Duration
+}
+
+// The parts of the foot which take turns to carry the load as the foot rolls over.
+const (
+	part_HEEL = iota
+	part_MIDFOOT
+	part_FOREFOOT
+	part_TOES
+	gait_PARTS
+)
+
+// footRegion is an area of the sole which carries load, shaped as an elliptical gaussian.
+// Centres are in mm on the plate of the left foot with the heel at the bottom and the medial side towards +X.
+// They are mirrored across the plate for the right foot, which has the medial side towards 0.
+type footRegion struct {
+	centre Point
+	sx, sy float64 // spread in mm
+	share  float64 // share of the load on its part of the foot
+}
+
+// footRegions are laid out for an adult foot of about 260mm on the plate used by the device.
+var footRegions = [gait_PARTS][]footRegion{
+	part_HEEL: {
+		{Point{40, 25}, 14, 16, 1},
+	},
+	part_MIDFOOT: {
+		{Point{22, 100}, 10, 30, 1}, // lateral column, moved medially for a flat foot
+	},
+	part_FOREFOOT: {
+		{Point{62, 175}, 9, 9, 0.25}, // first metatarsal head
+		{Point{50, 182}, 8, 8, 0.25},
+		{Point{40, 180}, 8, 8, 0.2},
+		{Point{30, 175}, 8, 8, 0.17},
+		{Point{20, 165}, 8, 8, 0.13}, // fifth metatarsal head
+	},
+	part_TOES: {
+		{Point{64, 228}, 9, 10, 0.75}, // hallux
+		{Point{40, 222}, 12, 7, 0.25}, // lesser toes
+	},
+}
+
+// GaitSynthesiser gives the pressure under each foot of a simulated person.
+type GaitSynthesiser struct {
+	conf    GaitConfig
+	midfoot float64 // midfoot load relative to a neutral foot
+	arch    float64 // X of the midfoot region
+}
+
+// NewGaitSynthesiser checks the config and fills in any defaults.
+func NewGaitSynthesiser(conf GaitConfig) (*GaitSynthesiser, error) {
+	g := new(GaitSynthesiser)
+
+	switch conf.Mode {
+	case "":
+		conf.Mode = GAIT_STANCE
+	case GAIT_STANCE, GAIT_SHIFT, GAIT_WALK:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unkown gait mode %s", conf.Mode))
+	}
+
+	switch conf.FootType {
+	case "", FOOT_NEUTRAL:
+		conf.FootType = FOOT_NEUTRAL
+		g.midfoot, g.arch = 1, 22
+	case FOOT_FLAT:
+		g.midfoot, g.arch = 3, 32
+	case FOOT_CAVUS:
+		g.midfoot, g.arch = 0.2, 18
+	default:
+		return nil, errors.New(fmt.Sprintf("Unkown foot type %s", conf.FootType))
+	}
+
+	if conf.BodyWeight <= 0 {
+		conf.BodyWeight = DEFAULT_BODY_WEIGHT
+	}
+	if conf.Cadence <= 0 {
+		conf.Cadence = DEFAULT_CADENCE
+	}
+	if conf.ShiftPeriod <= 0 {
+		conf.ShiftPeriod = DEFAULT_SHIFT_PERIOD
+	}
+
+	g.conf = conf
+	return g, nil
+}
+
+// side gives +1 for the left foot and -1 for the right. Sensors not on either foot are treated as the left.
+func side(foot string) float64 {
+	if foot == "right" {
+		return -1
+	}
+	return 1
+}
+
+// standing gives the shares of the load over the parts of a foot flat on the ground.
+func (g *GaitSynthesiser) standing() [gait_PARTS]float64 {
+	return [gait_PARTS]float64{
+		part_HEEL:     0.55,
+		part_MIDFOOT:  0.08 * g.midfoot,
+		part_FOREFOOT: 0.30,
+		part_TOES:     0.07,
+	}
+}
+
+// rollover gives the shares of the load over the parts of the foot s of the way through its stance phase.
+// The load moves from the heel at heel strike, through the midfoot and forefoot, to the toes at toe off.
+func (g *GaitSynthesiser) rollover(s float64) [gait_PARTS]float64 {
+	bump := func(centre, width float64) float64 {
+		return math.Exp(-math.Pow((s-centre)/width, 2))
+	}
+	return [gait_PARTS]float64{
+		part_HEEL:     bump(0.1, 0.2),
+		part_MIDFOOT:  0.3 * g.midfoot * bump(0.4, 0.2),
+		part_FOREFOOT: bump(0.7, 0.18),
+		part_TOES:     0.6 * bump(0.92, 0.1),
+	}
+}
+
+// stanceForce gives the vertical force on a foot s of the way through its stance phase as a fraction of body weight.
+// It has the two peaks of loading response and push off either side of a trough at mid stance.
+func stanceForce(s float64) float64 {
+	f := 1.05*math.Exp(-math.Pow((s-0.22)/0.14, 2)) +
+		1.0*math.Exp(-math.Pow((s-0.78)/0.14, 2)) +
+		0.6*math.Exp(-math.Pow((s-0.5)/0.2, 2))
+	// taper to nothing at heel strike and toe off
+	return f * math.Min(1, math.Min(s, 1-s)/0.05)
+}
+
+// load gives the force in N on the foot t seconds into the simulation and how it is shared over the parts of the foot.
+func (g *GaitSynthesiser) load(foot string, t float64) (force float64, shares [gait_PARTS]float64) {
+	weight := g.conf.BodyWeight * GRAVITY
+	sign := side(foot)
+
+	switch g.conf.Mode {
+	case GAIT_WALK:
+		// a stride is two steps, the right foot half a stride behind the left
+		stride := 120 / g.conf.Cadence
+		phase := t / stride
+		if sign < 0 {
+			phase += 0.5
+		}
+		phase -= math.Floor(phase)
+		if phase >= gait_STANCE_RATIO {
+			// swing
+			return 0, shares
+		}
+		s := phase / gait_STANCE_RATIO
+		force = weight * stanceForce(s)
+		shares = g.rollover(s)
+
+	case GAIT_SHIFT:
+		period := g.conf.ShiftPeriod.Seconds()
+		force = weight * (0.5 + sign*gait_SHIFT_SIDE*math.Sin(2*math.Pi*t/period))
+		shares = g.standing()
+		ap := gait_SHIFT_AP * math.Sin(math.Pi*t/period)
+		shares[part_HEEL] *= 1 + ap
+		shares[part_FOREFOOT] *= 1 - ap
+		shares[part_TOES] *= 1 - ap
+
+	default:
+		force = weight * 0.5 * (1 + sign*gait_SWAY_LATERAL*math.Sin(2*math.Pi*t/gait_SWAY_PERIOD))
+		shares = g.standing()
+		ap := gait_SWAY_AP * math.Sin(2*math.Pi*t/(gait_SWAY_PERIOD*0.7))
+		shares[part_HEEL] *= 1 + ap
+		shares[part_FOREFOOT] *= 1 - ap
+	}
+
+	var total float64
+	for _, share := range shares {
+		total += share
+	}
+	for i := range shares {
+		shares[i] /= total
+	}
+	return
+}
+
+// PressureMap gives the pressure in kPa at any point on the plate of the foot t seconds into the simulation.
+// The force on each region of the sole is spread over it so the pressure integrates back to the force on the foot.
+func (g *GaitSynthesiser) PressureMap(foot string, t float64) func(p Point) float64 {
+	type peak struct {
+		centre    Point
+		sx, sy    float64
+		amplitude float64 // kPa
+	}
+
+	force, shares := g.load(foot, t)
+	var peaks []peak
+	for part, regions := range footRegions {
+		for _, r := range regions {
+			if part == part_MIDFOOT {
+				r.centre.X = g.arch
+			}
+			if side(foot) < 0 {
+				r.centre.X = gait_PLATE_WIDTH - r.centre.X
+			}
+			f := force * shares[part] * r.share
+			if f <= 0 {
+				continue
+			}
+			// N/mm² to kPa
+			peaks = append(peaks, peak{r.centre, r.sx, r.sy, f * 1000 / (2 * math.Pi * r.sx * r.sy)})
+		}
+	}
+
+	return func(p Point) (pressure float64) {
+		for _, pk := range peaks {
+			dx, dy := (p.X-pk.centre.X)/pk.sx, (p.Y-pk.centre.Y)/pk.sy
+			pressure += pk.amplitude * math.Exp(-(dx*dx+dy*dy)/2)
+		}
+		return
+	}
+}
@@ -0,0 +1,143 @@
+package onboard
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// footForce integrates the pressure map over the plate of a foot to give the force on it in N.
+func footForce(pressure func(p Point) float64) (force float64) {
+	for x := -50.0; x < 150; x++ {
+		for y := -50.0; y < 300; y++ {
+			force += pressure(Point{x, y}) / 1000 // kPa over 1mm²
+		}
+	}
+	return
+}
+
+// sensorPeak gives the highest pressure under any sensel of a sensor laid out on the plate.
+func sensorPeak(pressure func(p Point) float64, conf SensorConfig) (peak float64) {
+	for row := 0; row < conf.Rows; row++ {
+		for col := 0; col < conf.Cols; col++ {
+			if p := pressure(conf.Geometry.PlatePoint(Point{float64(col), float64(row)})); p > peak {
+				peak = p
+			}
+		}
+	}
+	return
+}
+
+// regionPressure gives the pressure at the centre of the first region of a part of the foot.
+func regionPressure(pressure func(p Point) float64, part int) float64 {
+	return pressure(footRegions[part][0].centre)
+}
+
+func TestGaitSynthesiser(t *testing.T) {
+	Convey("Creating a gait synthesiser", t, func() {
+		_, err := NewGaitSynthesiser(GaitConfig{Mode: "hopping"})
+		So(err, ShouldNotBeNil)
+		_, err = NewGaitSynthesiser(GaitConfig{FootType: "webbed"})
+		So(err, ShouldNotBeNil)
+
+		g, err := NewGaitSynthesiser(GaitConfig{})
+		So(err, ShouldBeNil)
+		So(g.conf.Mode, ShouldEqual, GAIT_STANCE)
+		So(g.conf.BodyWeight, ShouldEqual, DEFAULT_BODY_WEIGHT)
+	})
+
+	Convey("Standing still", t, func() {
+		g, _ := NewGaitSynthesiser(GaitConfig{BodyWeight: 80})
+		left, right := g.PressureMap("left", 0), g.PressureMap("right", 0)
+
+		Convey("each foot carries half of the body weight", func() {
+			So(footForce(left), ShouldAlmostEqual, 40*GRAVITY, 40*GRAVITY*0.02)
+			So(footForce(right), ShouldAlmostEqual, 40*GRAVITY, 40*GRAVITY*0.02)
+		})
+
+		Convey("the heel carries the highest pressure at a plausible level", func() {
+			heel := regionPressure(left, part_HEEL)
+			So(heel, ShouldBeBetween, 100, 300)
+			So(heel, ShouldBeGreaterThan, regionPressure(left, part_FOREFOOT))
+			So(heel, ShouldBeGreaterThan, regionPressure(left, part_TOES))
+		})
+
+		Convey("a flat foot loads the midfoot more than a high arch", func() {
+			flat, _ := NewGaitSynthesiser(GaitConfig{FootType: FOOT_FLAT})
+			cavus, _ := NewGaitSynthesiser(GaitConfig{FootType: FOOT_CAVUS})
+			arch := Point{30, 100}
+			So(flat.PressureMap("left", 0)(arch), ShouldBeGreaterThan, 2*cavus.PressureMap("left", 0)(arch))
+		})
+	})
+
+	Convey("Shifting weight", t, func() {
+		g, _ := NewGaitSynthesiser(GaitConfig{Mode: GAIT_SHIFT, ShiftPeriod: 4 * time.Second})
+
+		// a quarter of the way through the weight is over the left foot
+		So(footForce(g.PressureMap("left", 1)), ShouldBeGreaterThan, 2*footForce(g.PressureMap("right", 1)))
+		// and half a period later over the right
+		So(footForce(g.PressureMap("right", 3)), ShouldBeGreaterThan, 2*footForce(g.PressureMap("left", 3)))
+	})
+
+	Convey("Walking", t, func() {
+		// a stride of 1.2s with each foot on the ground for the first 0.72s of its stride
+		g, _ := NewGaitSynthesiser(GaitConfig{Mode: GAIT_WALK, Cadence: 100})
+
+		Convey("the load rolls from the heel to the toes", func() {
+			strike := g.PressureMap("left", 0.1)
+			So(regionPressure(strike, part_HEEL), ShouldBeGreaterThan, regionPressure(strike, part_FOREFOOT))
+
+			pushOff := g.PressureMap("left", 0.62)
+			So(regionPressure(pushOff, part_TOES), ShouldBeGreaterThan, regionPressure(pushOff, part_HEEL))
+			So(regionPressure(pushOff, part_FOREFOOT), ShouldBeGreaterThan, regionPressure(pushOff, part_HEEL))
+		})
+
+		Convey("the foot is off the plate during swing", func() {
+			So(footForce(g.PressureMap("left", 0.9)), ShouldEqual, 0)
+		})
+
+		Convey("the feet are half a stride apart", func() {
+			So(footForce(g.PressureMap("right", 0.9)), ShouldBeGreaterThan, 0)
+			So(footForce(g.PressureMap("right", 0.3)), ShouldEqual, 0)
+		})
+
+		Convey("the force peaks above body weight during loading", func() {
+			So(footForce(g.PressureMap("left", 0.16)), ShouldBeGreaterThan, DEFAULT_BODY_WEIGHT*GRAVITY)
+		})
+	})
+}
+
+func TestGaitLayout(t *testing.T) {
+	yml, err := ioutil.ReadFile("../bbb_config.yaml")
+	if err != nil {
+		panic(err)
+	}
+	var config DynastatConfig
+	if err = yaml.Unmarshal(yml, &config); err != nil {
+		panic(err)
+	}
+
+	Convey("The right foot is laid out as the mirror image of the left", t, func() {
+		for _, part := range []string{"heel", "mtp", "hallux"} {
+			left, right := config.Sensors["left_"+part], config.Sensors["right_"+part]
+			far := Point{float64(left.Cols - 1), float64(left.Rows - 1)}
+			So(right.Geometry.PlatePoint(Point{}).X, ShouldAlmostEqual,
+				gait_PLATE_WIDTH-left.Geometry.PlatePoint(far).X, 0.01)
+			So(right.Geometry.PlatePoint(far).Y, ShouldAlmostEqual, left.Geometry.PlatePoint(far).Y, 0.01)
+		}
+
+		g, _ := NewGaitSynthesiser(GaitConfig{Mode: GAIT_WALK})
+		// pushing off through the toes
+		left, right := g.PressureMap("left", 0.62), g.PressureMap("right", 0.62+0.6)
+
+		leftHallux := sensorPeak(left, config.Sensors["left_hallux"])
+		rightHallux := sensorPeak(right, config.Sensors["right_hallux"])
+		So(leftHallux, ShouldBeGreaterThan, 20)
+		So(rightHallux, ShouldAlmostEqual, leftHallux, leftHallux*0.1)
+
+		So(sensorPeak(right, config.Sensors["right_mtp"]), ShouldAlmostEqual,
+			sensorPeak(left, config.Sensors["left_mtp"]), sensorPeak(left, config.Sensors["left_mtp"])*0.1)
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+/*
+	Physical layout of the sensors on the foot plate.
+*/
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SensorGeometry describes where a sensor sits on the foot plate.
+// Pitch is the distance between the centres of neighbouring sensels in mm. Origin is the plate position of the centre
+// of the first sensel (row 0, col 0) in mm and Rotation is the counter-clockwise angle of the sensor columns from the
+// plate X axis in degrees.
+type SensorGeometry struct {
+	Pitch    float64
+	Origin   Point
+	Rotation float64
+}
+
+// PlatePoint maps a point on the sensor, in sensel units with X along the columns and Y along the rows, to a point on
+// the plate in mm.
+func (g SensorGeometry) PlatePoint(p Point) Point {
+	x := p.X * g.Pitch
+	y := p.Y * g.Pitch
+
+	rad := g.Rotation * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+
+	return Point{
+		X: g.Origin.X + x*cos - y*sin,
+		Y: g.Origin.Y + x*sin + y*cos,
+	}
+}
+
+// SenselArea gives the area covered by a single sensel in mm².
+func (g SensorGeometry) SenselArea() float64 {
+	return g.Pitch * g.Pitch
+}
+
+// PlateCoordinate maps a sensel on the named sensor to its position on the plate in mm.
+func (d *Dynastat) PlateCoordinate(name string, row, col int) (point Point, err error) {
+	conf, ok := d.config.Sensors[name]
+	if !ok {
+		return point, errors.New(fmt.Sprintf("Unkown sensor %s", name))
+	}
+
+	if row < 0 || row >= conf.Rows || col < 0 || col >= conf.Cols {
+		return point, errors.New(fmt.Sprintf("Sensel %d,%d is outside of sensor %s", row, col, name))
+	}
+
+	return conf.Geometry.PlatePoint(Point{float64(col), float64(row)}), nil
+}
@@ -0,0 +1,98 @@
+package onboard
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const kGeometryTolerance = 0.0001
+
+func TestSensorGeometry(t *testing.T) {
+	Convey("Sensor points map on to the plate", t, func() {
+		Convey("Pitch scales from sensels to mm", func() {
+			g := SensorGeometry{Pitch: 5}
+			p := g.PlatePoint(Point{2, 3})
+			So(p.X, ShouldAlmostEqual, 10, kGeometryTolerance)
+			So(p.Y, ShouldAlmostEqual, 15, kGeometryTolerance)
+			So(g.SenselArea(), ShouldEqual, 25)
+		})
+
+		Convey("Origin offsets the sensor", func() {
+			g := SensorGeometry{Pitch: 5, Origin: Point{100, 200}}
+			p := g.PlatePoint(Point{2, 3})
+			So(p.X, ShouldAlmostEqual, 110, kGeometryTolerance)
+			So(p.Y, ShouldAlmostEqual, 215, kGeometryTolerance)
+		})
+
+		Convey("Rotation turns the sensor about its origin", func() {
+			g := SensorGeometry{Pitch: 5, Origin: Point{100, 200}, Rotation: 90}
+			p := g.PlatePoint(Point{2, 0})
+			So(p.X, ShouldAlmostEqual, 100, kGeometryTolerance)
+			So(p.Y, ShouldAlmostEqual, 210, kGeometryTolerance)
+		})
+	})
+
+	Convey("Device maps sensels to plate coordinates", t, func() {
+		config := new(DynastatConfig)
+		config.Sensors = map[string]SensorConfig{
+			"TestSensor": {Rows: 2, Cols: 4, Geometry: SensorGeometry{Pitch: 2, Origin: Point{10, 0}}},
+		}
+		dynastat := &Dynastat{config: config}
+
+		p, err := dynastat.PlateCoordinate("TestSensor", 1, 3)
+		So(err, ShouldBeNil)
+		So(p.X, ShouldAlmostEqual, 16, kGeometryTolerance)
+		So(p.Y, ShouldAlmostEqual, 2, kGeometryTolerance)
+
+		_, err = dynastat.PlateCoordinate("TestSensor", 2, 0)
+		So(err, ShouldNotBeNil)
+
+		_, err = dynastat.PlateCoordinate("whoami", 0, 0)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "whoami")
+	})
+}
+
+func TestConfigUpgrade(t *testing.T) {
+	Convey("Version 1 configs gain a default geometry", t, func() {
+		var config DynastatConfig
+		err := yaml.Unmarshal([]byte(`---
+version: 1
+sensors:
+  TESTS:
+    rows: 2
+    cols: 2
+`), &config)
+		So(err, ShouldBeNil)
+
+		So(config.Upgrade(), ShouldBeNil)
+		So(config.Version, ShouldEqual, CONFIG_VERSION)
+
+		conf := config.Sensors["TESTS"]
+		So(conf.Geometry.Pitch, ShouldEqual, DEFAULT_PITCH)
+		So(conf.Geometry.Origin, ShouldResemble, Point{})
+	})
+
+	Convey("Current configs are left alone", t, func() {
+		config := &DynastatConfig{Version: CONFIG_VERSION}
+		So(config.Upgrade(), ShouldBeNil)
+		So(config.Version, ShouldEqual, CONFIG_VERSION)
+	})
+
+	Convey("Sensors without a pitch are rejected", t, func() {
+		config := &DynastatConfig{
+			Version: CONFIG_VERSION,
+			Sensors: map[string]SensorConfig{"TestSensor": {Rows: 2, Cols: 2, Geometry: SensorGeometry{Origin: Point{10, 0}}}},
+		}
+		So(config.Upgrade(), ShouldNotBeNil)
+
+		config.Sensors["TestSensor"] = SensorConfig{Rows: 2, Cols: 2, Geometry: SensorGeometry{Pitch: -1}}
+		So(config.Upgrade(), ShouldNotBeNil)
+	})
+
+	Convey("Unknown versions are rejected", t, func() {
+		So((&DynastatConfig{Version: 0}).Upgrade(), ShouldNotBeNil)
+		So((&DynastatConfig{Version: CONFIG_VERSION + 1}).Upgrade(), ShouldNotBeNil)
+	})
+}
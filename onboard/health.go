@@ -0,0 +1,204 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_RETRY_ATTEMPTS is the number of times a transfer is tried when no retry policy is configured
+	DEFAULT_RETRY_ATTEMPTS = 3
+	// DEFAULT_RETRY_DELAY is the wait between attempts when no retry policy is configured
+	DEFAULT_RETRY_DELAY = 5 * time.Millisecond
+	// DEGRADED_POLL_INTERVAL is how often failing hardware is tried again, so it does not hold up every state with
+	// the full retry policy
+	DEGRADED_POLL_INTERVAL = time.Second
+
+	// Names of the hardware which is not tied to a single board or motor
+	COMPONENT_I2C      = "i2c"
+	COMPONENT_UART     = "uart"
+	COMPONENT_SWITCHES = "switches"
+)
+
+// RetryPolicy controls how many times a failed transfer with the hardware is tried before the error is passed up.
+// Attempts includes the first try. Zero values are replaced by the defaults and a negative Delay retries straight away.
+type RetryPolicy struct {
+	Attempts int
+	Delay    time.Duration
+}
+
+// Do calls fn until it succeeds or has been tried for every attempt, giving the error from the last attempt.
+func (p RetryPolicy) Do(fn func() error) (err error) {
+	if p.Attempts <= 0 {
+		p.Attempts = DEFAULT_RETRY_ATTEMPTS
+	}
+	if p.Delay < 0 {
+		p.Delay = 0
+	} else if p.Delay == 0 {
+		p.Delay = DEFAULT_RETRY_DELAY
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= p.Attempts {
+			return
+		}
+		time.Sleep(p.Delay)
+	}
+}
+
+// retryI2CBus retries every transfer on the bus it wraps with the policy.
+type retryI2CBus struct {
+	bus    I2CBusInterface
+	policy RetryPolicy
+}
+
+// NewRetryI2CBus wraps the bus so failed transfers are retried with the policy.
+func NewRetryI2CBus(bus I2CBusInterface, policy RetryPolicy) I2CBusInterface {
+	return &retryI2CBus{bus: bus, policy: policy}
+}
+
+func (r *retryI2CBus) Get(i2cAddr int, reg uint16, buf []byte) error {
+	return r.policy.Do(func() error { return r.bus.Get(i2cAddr, reg, buf) })
+}
+
+func (r *retryI2CBus) Put(i2cAddr int, reg uint16, buf []byte) error {
+	return r.policy.Do(func() error { return r.bus.Put(i2cAddr, reg, buf) })
+}
+
+// retryUARTMCU retries the transfers on the MCU it wraps with the policy.
+// A relative move is never retried, as a write whose reply timed out may still have moved the motor and trying it again
+// would move it twice. Reads and writes of absolute values are safe to repeat.
+type retryUARTMCU struct {
+	mcu    UARTMCUInterface
+	policy RetryPolicy
+}
+
+// NewRetryUARTMCU wraps the MCU so failed transfers are retried with the policy.
+func NewRetryUARTMCU(mcu UARTMCUInterface, policy RetryPolicy) UARTMCUInterface {
+	return &retryUARTMCU{mcu: mcu, policy: policy}
+}
+
+func (r *retryUARTMCU) Put(i2cAddr int, cmd uint8, value int32) error {
+	if cmd == m_REG_RELATIVE {
+		return r.mcu.Put(i2cAddr, cmd, value)
+	}
+	return r.policy.Do(func() error { return r.mcu.Put(i2cAddr, cmd, value) })
+}
+
+func (r *retryUARTMCU) Get(i2cAddr int, cmd uint8) (value int32, err error) {
+	err = r.policy.Do(func() (err error) {
+		value, err = r.mcu.Get(i2cAddr, cmd)
+		return
+	})
+	return
+}
+
+// boardComponent names a sensor board in the degraded hardware.
+func boardComponent(address int) string {
+	return fmt.Sprintf("board 0x%x", address)
+}
+
+// boardModeComponent names the mode of a sensor board in the degraded hardware.
+// It is kept apart from the board as reading frames again does not mean the mode has been set.
+func boardModeComponent(address int) string {
+	return fmt.Sprintf("board 0x%x mode", address)
+}
+
+// motorComponent names a motor in the degraded hardware.
+func motorComponent(name string) string {
+	return fmt.Sprintf("motor %s", name)
+}
+
+// hardwareHealth records the hardware which is failing, with the last error from each component.
+// The device keeps running without degraded hardware rather than stopping, and components recover as soon as
+// they respond again.
+type hardwareHealth struct {
+	faults map[string]string
+	lock   sync.Mutex
+}
+
+// degrade marks the component as failing with the error.
+func (h *hardwareHealth) degrade(component string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.faults == nil {
+		h.faults = make(map[string]string)
+	}
+	h.faults[component] = err.Error()
+}
+
+// restore marks the component as working again.
+func (h *hardwareHealth) restore(component string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.faults, component)
+}
+
+// check degrades or restores the component depending on the error, passing the error on.
+func (h *hardwareHealth) check(component string, err error) error {
+	if err != nil {
+		h.degrade(component, err)
+	} else {
+		h.restore(component)
+	}
+	return err
+}
+
+// degraded tells whether the component is failing.
+func (h *hardwareHealth) degraded(component string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, ok := h.faults[component]
+	return ok
+}
+
+// snapshot copies the failing components, nil if everything is working.
+func (h *hardwareHealth) snapshot() map[string]string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.faults) == 0 {
+		return nil
+	}
+	faults := make(map[string]string, len(h.faults))
+	for component, err := range h.faults {
+		faults[component] = err
+	}
+	return faults
+}
+
+// MotorDegraded reports whether the state of a motor is the last one read from it rather than a current reading,
+// either because the motor or the whole motor bus is failing.
+func (s DynastatState) MotorDegraded(name string) bool {
+	_, motor := s.Degraded[motorComponent(name)]
+	_, uart := s.Degraded[COMPONENT_UART]
+	return motor || uart
+}
+
+// Degraded gives the hardware which is currently failing with the last error from each, nil if everything is working.
+func (d *Dynastat) Degraded() map[string]string {
+	return d.health.snapshot()
+}
+
+// checkBoards degrades the sensor boards whose last read failed and restores those read since.
+func (d *Dynastat) checkBoards() {
+	for address, board := range d.boards {
+		d.health.check(boardComponent(address), board.Err())
+	}
+
+	// boards behind sensors which make their own frames, which may be shared by several sensors
+	failing := make(map[int]error)
+	for _, sensor := range d.sensors {
+		if source, ok := sensor.(sensorSource); ok {
+			address, err := source.boardErr()
+			if err != nil || failing[address] == nil {
+				failing[address] = err
+			}
+		}
+	}
+	for address, err := range failing {
+		d.health.check(boardComponent(address), err)
+	}
+}
@@ -0,0 +1,163 @@
+package onboard
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// FlakyI2CSensorBoard fails a number of transfers before answering like a working board
+type FlakyI2CSensorBoard struct {
+	MockI2CSensorBoard
+	failures int
+	calls    int
+}
+
+func (s *FlakyI2CSensorBoard) Get(i2cAddr int, cmd uint16, buf []byte) error {
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("remote I/O error")
+	}
+	return s.MockI2CSensorBoard.Get(i2cAddr, cmd, buf)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("Retrying a failed transfer", t, func() {
+		policy := RetryPolicy{Attempts: 3, Delay: -1}
+		var calls int
+
+		Convey("stops as soon as it succeeds", func() {
+			err := policy.Do(func() error {
+				calls++
+				if calls < 2 {
+					return errors.New("busy")
+				}
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(calls, ShouldEqual, 2)
+		})
+
+		Convey("gives the last error after every attempt has failed", func() {
+			err := policy.Do(func() error {
+				calls++
+				return errors.New("busy")
+			})
+			So(err, ShouldNotBeNil)
+			So(calls, ShouldEqual, 3)
+		})
+
+		Convey("uses the default attempts when none are set", func() {
+			RetryPolicy{Delay: -1}.Do(func() error {
+				calls++
+				return errors.New("busy")
+			})
+			So(calls, ShouldEqual, DEFAULT_RETRY_ATTEMPTS)
+		})
+	})
+
+	Convey("Retrying motor transfers", t, func() {
+		mcu := &MockUARTMCU{err: errors.New("Timed out")}
+		retry := NewRetryUARTMCU(mcu, RetryPolicy{Attempts: 3, Delay: -1})
+
+		Convey("repeats reads and absolute writes", func() {
+			retry.Get(0x10, m_REG_POSITION)
+			So(mcu.calls, ShouldEqual, 3)
+			retry.Put(0x10, m_REG_GOTO, 100)
+			So(mcu.calls, ShouldEqual, 6)
+		})
+
+		Convey("never repeats a relative move", func() {
+			So(retry.Put(0x10, m_REG_RELATIVE, 100), ShouldNotBeNil)
+			So(mcu.calls, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Retrying a sensor board read", t, func() {
+		flaky := &FlakyI2CSensorBoard{MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}, 2, 0}
+		flaky.data[1] = 42
+		sb := NewSensorBoard(NewRetryI2CBus(flaky, RetryPolicy{Attempts: 3, Delay: -1}), 0)
+
+		So(sb.read(), ShouldBeNil)
+		So(sb.getValue(0), ShouldEqual, 42)
+		So(flaky.calls, ShouldEqual, 3)
+	})
+}
+
+func TestDegradedHardware(t *testing.T) {
+	Convey("A device with failing hardware", t, func() {
+		motor := new(MockMotor)
+		msb := &MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}
+		sb := NewSensorBoard(msb, 0x15)
+		sensor, _ := NewSensor(sb, 1, false, 2, 2, 0, 127, 255, 0)
+		dynastat := &Dynastat{
+			Motors:  map[string]MotorInterface{"TestMotor": motor},
+			sensors: map[string]SensorInterface{"TestSensor": sensor},
+			boards:  map[int]*SensorBoard{0x15: sb},
+		}
+
+		So(dynastat.SetMotor("TestMotor", 42), ShouldBeNil)
+		state, err := dynastat.GetState()
+		So(err, ShouldBeNil)
+		So(state.Degraded, ShouldBeNil)
+
+		Convey("keeps the last motor state while the motor is failing", func() {
+			motor.err = errors.New("No response from motor")
+			So(dynastat.SetMotor("TestMotor", 100), ShouldNotBeNil)
+
+			failing, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(failing.Degraded, ShouldContainKey, "motor TestMotor")
+			So(failing.MotorDegraded("TestMotor"), ShouldBeTrue)
+			So(state.MotorDegraded("TestMotor"), ShouldBeFalse)
+			So(failing.Motors["TestMotor"].Target, ShouldEqual, 42)
+			So(failing.MotorSamples["TestMotor"].Seq, ShouldEqual, state.MotorSamples["TestMotor"].Seq)
+
+			Convey("without trying it again on every state", func() {
+				polls := motor.polls
+				time.Sleep(dynastat.motorInterval())
+				dynastat.GetState()
+				dynastat.GetState()
+				So(motor.polls, ShouldEqual, polls)
+			})
+
+			Convey("and recovers once it responds", func() {
+				motor.err = nil
+				// as if the degraded interval had passed
+				dynastat.motorPolled["TestMotor"] = time.Now().Add(-DEGRADED_POLL_INTERVAL)
+				recovered, _ := dynastat.GetState()
+				So(recovered.Degraded, ShouldBeNil)
+				So(recovered.MotorSamples["TestMotor"].Seq, ShouldEqual, state.MotorSamples["TestMotor"].Seq+1)
+			})
+		})
+
+		Convey("keeps the last frame while a sensor board is failing", func() {
+			msb.data[1] = 200
+			sb.read()
+			msb.err = errors.New("remote I/O error")
+			So(sb.read(), ShouldNotBeNil)
+			So(sb.Err(), ShouldNotBeNil)
+
+			failing, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(failing.Degraded, ShouldContainKey, "board 0x15")
+			So(failing.Sensors, ShouldContainKey, "TestSensor")
+
+			Convey("and recovers once it responds", func() {
+				msb.err = nil
+				So(sb.read(), ShouldBeNil)
+				recovered, _ := dynastat.GetState()
+				So(recovered.Degraded, ShouldBeNil)
+			})
+		})
+
+		Convey("reports a motor which could not be set up", func() {
+			mcu := &MockUARTMCU{err: errors.New("UART write failed")}
+			m, err := NewRMCS220xMotor(mcu, nil, 1, 0x10, 0, 100, 255, 255)
+			So(err, ShouldNotBeNil)
+			So(m, ShouldNotBeNil)
+			So(m.SetTarget(10), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_MOVE_TOLERANCE is how close in the 0-255 application range a motor must be to its target to have arrived
+	DEFAULT_MOVE_TOLERANCE = 2
+	// DEFAULT_MOVE_TIMEOUT is how long the motors in a move have to arrive when no timeout is given
+	DEFAULT_MOVE_TIMEOUT = 30 * time.Second
+
+	move_POLL = 100 * time.Millisecond // how often the motors in a move are checked
+)
+
+// MoveStatus is how far a move of several motors together has got.
+type MoveStatus string
+
+const (
+	MOVE_MOVING    MoveStatus = "moving"
+	MOVE_DONE      MoveStatus = "done"      // every motor is within tolerance of its target
+	MOVE_TIMEOUT   MoveStatus = "timeout"   // the motors did not all arrive in time
+	MOVE_FAILED    MoveStatus = "failed"    // a motor could not be set
+	MOVE_CANCELLED MoveStatus = "cancelled" // replaced by a newer move
+)
+
+// MoveProgress reports a move of several motors together. Remaining holds how far each motor which has not arrived
+// is from its target in the 0-255 application range, or -1 if it could not be read.
+type MoveProgress struct {
+	ID        uint64
+	Status    MoveStatus
+	Targets   map[string]int
+	Remaining map[string]int
+	Started   time.Time
+	Elapsed   time.Duration
+	Error     string `json:",omitempty"`
+}
+
+// Finished tells whether the move has stopped, whether or not the motors arrived.
+func (p MoveProgress) Finished() bool {
+	return p.Status != MOVE_MOVING
+}
+
+// MotorMove tracks several motors set together until they are all within tolerance of their targets.
+type MotorMove struct {
+	motors    map[string]MotorInterface
+	tolerance int
+	deadline  time.Time
+	progress  MoveProgress
+	done      chan struct{}
+	lock      sync.RWMutex
+}
+
+// Progress gives how far the move has got.
+func (m *MotorMove) Progress() MoveProgress {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	progress := m.progress
+	progress.Remaining = make(map[string]int, len(m.progress.Remaining))
+	for name, distance := range m.progress.Remaining {
+		progress.Remaining[name] = distance
+	}
+	if !progress.Finished() {
+		progress.Elapsed = time.Since(progress.Started)
+	}
+	return progress
+}
+
+// Done is closed once the move has finished.
+func (m *MotorMove) Done() <-chan struct{} {
+	return m.done
+}
+
+// Wait blocks until the move has finished and gives how it ended.
+func (m *MotorMove) Wait() MoveProgress {
+	<-m.done
+	return m.Progress()
+}
+
+// finish stops the move with the status if it has not already finished.
+func (m *MotorMove) finish(status MoveStatus, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.progress.Finished() {
+		return
+	}
+	m.progress.Status = status
+	m.progress.Elapsed = time.Since(m.progress.Started)
+	if err != nil {
+		m.progress.Error = err.Error()
+	}
+	close(m.done)
+}
+
+// check reads every motor, finishing the move once they have all arrived or time has run out.
+// A motor which cannot be read counts as still moving so a brief fault does not end the move.
+func (m *MotorMove) check(now time.Time) {
+	remaining := make(map[string]int)
+	var lastErr error
+	for name, motor := range m.motors {
+		target := m.progress.Targets[name]
+		position, err := motor.GetPosition()
+		if err != nil {
+			lastErr = errors.New(fmt.Sprintf("Unable to read motor %s: %v", name, err))
+			remaining[name] = -1
+			continue
+		}
+		distance := target - position
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance > m.tolerance {
+			remaining[name] = distance
+		}
+	}
+
+	m.lock.Lock()
+	m.progress.Remaining = remaining
+	m.lock.Unlock()
+
+	switch {
+	case len(remaining) == 0:
+		m.finish(MOVE_DONE, nil)
+	case now.After(m.deadline):
+		if lastErr == nil {
+			lastErr = errors.New(fmt.Sprintf("%d motors did not reach their targets", len(remaining)))
+		}
+		m.finish(MOVE_TIMEOUT, lastErr)
+	}
+}
+
+// track checks the motors until the move has finished.
+func (m *MotorMove) track() {
+	ticker := time.NewTicker(move_POLL)
+	defer ticker.Stop()
+	for {
+		m.check(time.Now())
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MoveMotors sets several motors together, such as every motor under a foot, and tracks them until each is within
+// tolerance of its target in the 0-255 application range. Zero tolerance and timeout use the defaults.
+// A move in progress is cancelled by the next one. The progress of the latest move is included in the device state.
+// If a motor cannot be set the move fails, but the motors which were set carry on to their targets.
+func (d *Dynastat) MoveMotors(targets map[string]int, tolerance int, timeout time.Duration) (move *MotorMove, err error) {
+	if len(targets) == 0 {
+		return nil, errors.New("No motors to move")
+	}
+	motors := make(map[string]MotorInterface, len(targets))
+	for name := range targets {
+		motor, ok := d.Motors[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unkown motor %s", name))
+		}
+		motors[name] = motor
+	}
+	if tolerance <= 0 {
+		tolerance = DEFAULT_MOVE_TOLERANCE
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_MOVE_TIMEOUT
+	}
+
+	move = &MotorMove{motors: motors, tolerance: tolerance, done: make(chan struct{})}
+	move.progress = MoveProgress{Status: MOVE_MOVING, Targets: make(map[string]int, len(targets)), Started: time.Now()}
+	for name, target := range targets {
+		move.progress.Targets[name] = target
+	}
+	move.deadline = move.progress.Started.Add(timeout)
+
+	d.moveLock.Lock()
+	d.moves++
+	move.progress.ID = d.moves
+	previous := d.move
+	d.move = move
+	d.moveLock.Unlock()
+	if previous != nil {
+		previous.finish(MOVE_CANCELLED, nil)
+	}
+
+	for name, target := range targets {
+		if serr := d.SetMotor(name, target); serr != nil && err == nil {
+			err = errors.New(fmt.Sprintf("Unable to set motor %s: %v", name, serr))
+		}
+	}
+	if err != nil {
+		move.finish(MOVE_FAILED, err)
+		return move, err
+	}
+
+	go move.track()
+	return move, nil
+}
+
+// moveProgress gives the progress of the latest move, nil if no motors have been moved together yet.
+func (d *Dynastat) moveProgress() *MoveProgress {
+	d.moveLock.Lock()
+	move := d.move
+	d.moveLock.Unlock()
+	if move == nil {
+		return nil
+	}
+	progress := move.Progress()
+	return &progress
+}
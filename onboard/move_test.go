@@ -0,0 +1,73 @@
+package onboard
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestMoveMotors(t *testing.T) {
+	Convey("Moving several motors together", t, func() {
+		fast := NewSimulatedMotor("fast", 0, 0, 0, 255, 0)
+		slow := NewSimulatedMotor("slow", 0, 0, 0, 1, 0) // 100 encoder counts per second
+		dynastat := &Dynastat{
+			Motors:  map[string]MotorInterface{"fast": fast, "slow": slow},
+			sensors: map[string]SensorInterface{},
+		}
+
+		Convey("finishes once every motor has arrived", func() {
+			move, err := dynastat.MoveMotors(map[string]int{"fast": 100, "slow": 10}, 0, time.Second)
+			So(err, ShouldBeNil)
+
+			progress := move.Wait()
+			So(progress.Status, ShouldEqual, MOVE_DONE)
+			So(progress.Remaining, ShouldBeEmpty)
+			So(progress.Elapsed, ShouldBeLessThan, time.Second)
+
+			pos, _ := slow.GetPosition()
+			So(pos, ShouldBeBetweenOrEqual, 10-DEFAULT_MOVE_TOLERANCE, 10+DEFAULT_MOVE_TOLERANCE)
+
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Move, ShouldNotBeNil)
+			So(state.Move.ID, ShouldEqual, progress.ID)
+			So(state.Move.Status, ShouldEqual, MOVE_DONE)
+		})
+
+		Convey("times out with the motors which did not arrive", func() {
+			move, err := dynastat.MoveMotors(map[string]int{"fast": 100, "slow": 200}, 0, 200*time.Millisecond)
+			So(err, ShouldBeNil)
+
+			progress := move.Wait()
+			So(progress.Status, ShouldEqual, MOVE_TIMEOUT)
+			So(progress.Remaining, ShouldContainKey, "slow")
+			So(progress.Remaining, ShouldNotContainKey, "fast")
+			So(progress.Error, ShouldNotBeBlank)
+		})
+
+		Convey("is cancelled by the next move", func() {
+			first, _ := dynastat.MoveMotors(map[string]int{"slow": 200}, 0, 0)
+			second, err := dynastat.MoveMotors(map[string]int{"fast": 50}, 0, 0)
+			So(err, ShouldBeNil)
+			So(first.Wait().Status, ShouldEqual, MOVE_CANCELLED)
+			So(second.Wait().Status, ShouldEqual, MOVE_DONE)
+			So(second.Progress().ID, ShouldEqual, first.Progress().ID+1)
+		})
+
+		Convey("sets nothing when a motor is unknown", func() {
+			move, err := dynastat.MoveMotors(map[string]int{"fast": 100, "missing": 10}, 0, 0)
+			So(err, ShouldNotBeNil)
+			So(move, ShouldBeNil)
+			So(dynastat.moveProgress(), ShouldBeNil)
+		})
+
+		Convey("fails when a motor can not be set", func() {
+			dynastat.Motors["broken"] = &MockMotor{err: errors.New("No response from motor")}
+			move, err := dynastat.MoveMotors(map[string]int{"fast": 100, "broken": 10}, 0, 0)
+			So(err, ShouldNotBeNil)
+			So(move.Progress().Status, ShouldEqual, MOVE_FAILED)
+			So(dynastat.Degraded(), ShouldContainKey, "motor broken")
+		})
+	})
+}
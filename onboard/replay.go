@@ -0,0 +1,367 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+/*
+	Simulation driven from a recorded session, so problems seen on a device can be reproduced away from it.
+*/
+
+package onboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionFrame is a single state in a session file. Offset is the time since the start of the session.
+type SessionFrame struct {
+	Offset time.Duration
+	State  DynastatState
+}
+
+// ReplayConfig sets up the playback of a session file.
+type ReplayConfig struct {
+	Loop  bool          // start again from the beginning once the end of the session is reached
+	Speed float64       // multiple of the recorded speed, 1 if not set
+	Seek  time.Duration // position in the session to start playing from
+}
+
+var (
+	ErrEmptySession = errors.New("Session has no frames")
+	ErrReplayMotor  = errors.New("Motors follow the recorded session during replay")
+)
+
+// ReadSession reads a session file of one JSON encoded SessionFrame per line, as exported by the recorder.
+// The offsets are moved so the session starts at zero.
+func ReadSession(r io.Reader) (frames []SessionFrame, err error) {
+	decoder := json.NewDecoder(r)
+	for {
+		var frame SessionFrame
+		if err = decoder.Decode(&frame); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unable to read frame %d of session: %v", len(frames)+1, err))
+		}
+		if len(frames) > 0 && frame.Offset < frames[len(frames)-1].Offset {
+			return nil, errors.New(fmt.Sprintf("Frame %d of session is out of order", len(frames)+1))
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) == 0 {
+		return nil, ErrEmptySession
+	}
+	start := frames[0].Offset
+	for i := range frames {
+		frames[i].Offset -= start
+	}
+	return frames, nil
+}
+
+// ReadSessionFile reads the session file with the filename.
+func ReadSessionFile(filename string) ([]SessionFrame, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadSession(file)
+}
+
+// SessionPlayer plays the frames of a session back against the wall clock.
+// The position is worked out from the time since the last change to the playback, so it never drifts.
+type SessionPlayer struct {
+	frames []SessionFrame
+	period time.Duration // length of a pass through the session, with the last frame shown as long as the others
+	loop   bool
+	speed  float64
+	offset time.Duration // position in the session at the mark
+	mark   time.Time
+	now    func() time.Time
+	lock   sync.RWMutex
+}
+
+// NewSessionPlayer starts playing the frames with the config.
+func NewSessionPlayer(frames []SessionFrame, conf ReplayConfig) (*SessionPlayer, error) {
+	if len(frames) == 0 {
+		return nil, ErrEmptySession
+	}
+
+	p := &SessionPlayer{frames: frames, loop: conf.Loop, speed: 1, now: time.Now}
+	p.mark = p.now()
+	p.period = frames[len(frames)-1].Offset
+	if len(frames) > 1 {
+		p.period += p.period / time.Duration(len(frames)-1)
+	}
+
+	if conf.Speed != 0 {
+		if err := p.SetSpeed(conf.Speed); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.Seek(conf.Seek); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// position works out where the playback is at now, the caller must hold the lock.
+func (p *SessionPlayer) position(now time.Time) time.Duration {
+	pos := p.offset + time.Duration(float64(now.Sub(p.mark))*p.speed)
+	if p.loop && p.period > 0 {
+		return pos % p.period
+	}
+	if end := p.frames[len(p.frames)-1].Offset; pos > end {
+		return end
+	}
+	return pos
+}
+
+// rebase moves the mark to now so the playback can be changed without jumping, the caller must hold the lock.
+func (p *SessionPlayer) rebase() {
+	now := p.now()
+	p.offset = p.position(now)
+	p.mark = now
+}
+
+// Position gives the time into the session being shown.
+func (p *SessionPlayer) Position() time.Duration {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.position(p.now())
+}
+
+// Duration gives the offset of the last frame in the session.
+func (p *SessionPlayer) Duration() time.Duration {
+	return p.frames[len(p.frames)-1].Offset
+}
+
+// Done is set once the last frame has been reached without looping.
+func (p *SessionPlayer) Done() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return !p.loop && p.position(p.now()) >= p.Duration()
+}
+
+// Frame gives the frame being shown, the last one at or before the position.
+func (p *SessionPlayer) Frame() SessionFrame {
+	pos := p.Position()
+	i := sort.Search(len(p.frames), func(i int) bool { return p.frames[i].Offset > pos })
+	if i > 0 {
+		i--
+	}
+	return p.frames[i]
+}
+
+// Seek jumps to the offset into the session.
+func (p *SessionPlayer) Seek(offset time.Duration) error {
+	if offset < 0 || offset > p.Duration() {
+		return errors.New(fmt.Sprintf("Seek to %v is outside of the session of %v", offset, p.Duration()))
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.offset = offset
+	p.mark = p.now()
+	return nil
+}
+
+// Speed gives the multiple of the recorded speed the session is played at.
+func (p *SessionPlayer) Speed() float64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.speed
+}
+
+// SetSpeed plays the session at a multiple of the recorded speed from the current position.
+func (p *SessionPlayer) SetSpeed(speed float64) error {
+	if speed <= 0 || math.IsInf(speed, 0) || math.IsNaN(speed) {
+		return errors.New(fmt.Sprintf("Invalid replay speed %v", speed))
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rebase()
+	p.speed = speed
+	return nil
+}
+
+// Loop tells whether the session starts again once the end is reached.
+func (p *SessionPlayer) Loop() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.loop
+}
+
+// SetLoop turns looping on or off from the current position.
+func (p *SessionPlayer) SetLoop(loop bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rebase()
+	p.loop = loop
+}
+
+// convertPressure moves a value between units through the application range, using the same linear scale as the
+// simulated sensors. States recorded without units are in the application range.
+func convertPressure(value float64, from, to PressureUnit) float64 {
+	if from == to {
+		return value
+	}
+
+	scaled := value
+	switch from {
+	case UNIT_RAW:
+		scaled = value / 16
+	case UNIT_KPA:
+		scaled = value * math.MaxUint8 / DEFAULT_FULL_SCALE
+	}
+
+	switch to {
+	case UNIT_RAW:
+		return scaled * 16
+	case UNIT_KPA:
+		return scaled * DEFAULT_FULL_SCALE / math.MaxUint8
+	}
+	return scaled
+}
+
+// ReplaySensor gives the values recorded for the sensor in the frame being shown.
+// Sensels missing from the recording, or a sensor missing from the frame, read as zero.
+type ReplaySensor struct {
+	name       string
+	rows, cols int
+	player     *SessionPlayer
+}
+
+// NewReplaySensor reads the sensor with the name from the session being played.
+func NewReplaySensor(name string, rows, cols int, player *SessionPlayer) *ReplaySensor {
+	return &ReplaySensor{name: name, rows: rows, cols: cols, player: player}
+}
+
+// SetScale does nothing as the recorded values have already been scaled.
+func (s *ReplaySensor) SetScale(zero, half, full uint16) {}
+
+func (s *ReplaySensor) SetEqualisation(eq SensorEqualisation) error {
+	return errors.New("[NotImplemented][ReplaySensor] SetEqualisation is not implemented on ReplaySensor")
+}
+
+func (s *ReplaySensor) SetCurve(curve *CalibrationCurve) error {
+	return errors.New("[NotImplemented][ReplaySensor] SetCurve is not implemented on ReplaySensor")
+}
+
+// value gives the sensel in the frame being shown in the units.
+func (s *ReplaySensor) value(row, col int, units PressureUnit) float64 {
+	state := s.player.Frame().State
+	recorded := state.Sensors[s.name]
+	if row >= len(recorded) || col >= len(recorded[row]) {
+		return 0
+	}
+	return convertPressure(recorded[row][col], state.Units, units)
+}
+
+func (s *ReplaySensor) GetValue(row, col int) uint8 {
+	return uint8(math.Max(0, math.Min(s.value(row, col, UNIT_SCALED), math.MaxUint8)))
+}
+
+func (s *ReplaySensor) GetRaw(row, col int) uint16 {
+	return uint16(math.Max(0, math.Min(s.value(row, col, UNIT_RAW), math.MaxUint16)))
+}
+
+func (s *ReplaySensor) GetPressure(row, col int) float64 {
+	return s.value(row, col, UNIT_KPA)
+}
+
+func (s *ReplaySensor) GetState(units PressureUnit) (state SensorState) {
+	// read a single frame so the whole sensor comes from the same point in the session
+	frame := s.player.Frame().State
+	recorded := frame.Sensors[s.name]
+
+	state = make(SensorState, s.rows)
+	for i := 0; i < s.rows; i++ {
+		state[i] = make([]float64, s.cols)
+		for j := 0; j < s.cols && i < len(recorded) && j < len(recorded[i]); j++ {
+			state[i][j] = convertPressure(recorded[i][j], frame.Units, units)
+		}
+	}
+	return state
+}
+
+// ReplayMotor gives the state recorded for the motor in the frame being shown.
+// It can not be moved as it follows the recording.
+type ReplayMotor struct {
+	name   string
+	player *SessionPlayer
+}
+
+// NewReplayMotor reads the motor with the name from the session being played.
+func NewReplayMotor(name string, player *SessionPlayer) *ReplayMotor {
+	return &ReplayMotor{name: name, player: player}
+}
+
+func (m *ReplayMotor) GetState() (state MotorState, err error) {
+	state, ok := m.player.Frame().State.Motors[m.name]
+	if !ok {
+		return state, errors.New(fmt.Sprintf("Motor %s is not in the recorded frame", m.name))
+	}
+	return state, nil
+}
+
+func (m *ReplayMotor) GetPosition() (position int, err error) {
+	state, err := m.GetState()
+	return state.Current, err
+}
+
+func (m *ReplayMotor) SetTarget(target int) error {
+	return ErrReplayMotor
+}
+
+func (m *ReplayMotor) Home(calibrationValue int) error {
+	return ErrReplayMotor
+}
+
+func (m *ReplayMotor) getRaw(reg uint8) (int, error) {
+	return 0, ErrReplayMotor
+}
+
+func (m *ReplayMotor) putRaw(reg uint8, val int) error {
+	return ErrReplayMotor
+}
+
+func (m *ReplayMotor) findHome(reverse bool) error {
+	return ErrReplayMotor
+}
+
+// NewDynastatReplay sets up a device with the sensors and motors in the config driven from the session being played.
+// Everything worked out from the sensors, such as the centres of pressure and faults, is worked out again from the
+// recorded values.
+func NewDynastatReplay(config *DynastatConfig, player *SessionPlayer) (dynastat *Dynastat, err error) {
+	if err = config.Upgrade(); err != nil {
+		return nil, err
+	}
+
+	dynastat = new(Dynastat)
+	dynastat.config = config
+	if err = dynastat.SetSensorUnits(config.SensorUnits); err != nil {
+		return nil, err
+	}
+
+	switch config.Version {
+	case 2:
+		dynastat.Motors = make(map[string]MotorInterface, len(config.Motors))
+		dynastat.sensors = make(map[string]SensorInterface, len(config.Sensors))
+
+		for name, conf := range config.Sensors {
+			dynastat.sensors[name] = NewReplaySensor(name, conf.Rows, conf.Cols, player)
+		}
+		for name := range config.Motors {
+			dynastat.Motors[name] = NewReplayMotor(name, player)
+		}
+	default:
+		return nil, errors.New("Unkown version number")
+	}
+
+	return dynastat, nil
+}
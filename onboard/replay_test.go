@@ -0,0 +1,145 @@
+package onboard
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionFile builds a session file of frames a second apart, starting 5 seconds in as a real recording would
+func sessionFile(count int) string {
+	var lines []string
+	for i := 0; i < count; i++ {
+		lines = append(lines, fmt.Sprintf(
+			`{"Offset":%d,"State":{"Units":"scaled","Motors":{"TestMotor":{"Target":%d,"Current":%d}},"Sensors":{"TestSensor":[[%d,0],[0,255]]}}}`,
+			(5+i)*int(time.Second), i, i, i*10))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stoppedClock lets a test move the clock of a player by hand
+type stoppedClock struct {
+	t time.Time
+}
+
+func (c *stoppedClock) now() time.Time {
+	return c.t
+}
+
+func TestReadSession(t *testing.T) {
+	Convey("Reading a session file", t, func() {
+		Convey("moves the session to start at zero", func() {
+			frames, err := ReadSession(strings.NewReader(sessionFile(3)))
+			So(err, ShouldBeNil)
+			So(frames, ShouldHaveLength, 3)
+			So(frames[0].Offset, ShouldEqual, 0)
+			So(frames[2].Offset, ShouldEqual, 2*time.Second)
+			So(frames[2].State.Motors["TestMotor"].Current, ShouldEqual, 2)
+		})
+
+		Convey("rejects an empty session", func() {
+			_, err := ReadSession(strings.NewReader(""))
+			So(err, ShouldEqual, ErrEmptySession)
+		})
+
+		Convey("rejects frames out of order", func() {
+			lines := strings.Split(sessionFile(3), "\n")
+			lines[1], lines[2] = lines[2], lines[1]
+			_, err := ReadSession(strings.NewReader(strings.Join(lines, "\n")))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("rejects a corrupt frame", func() {
+			_, err := ReadSession(strings.NewReader(sessionFile(2) + "\n{\"Offset\":"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSessionPlayer(t *testing.T) {
+	Convey("Playing a session of 10 frames", t, func() {
+		frames, _ := ReadSession(strings.NewReader(sessionFile(10)))
+		clock := &stoppedClock{time.Now()}
+		player, err := NewSessionPlayer(frames, ReplayConfig{})
+		So(err, ShouldBeNil)
+		player.now = clock.now
+		player.Seek(0)
+
+		current := func() int {
+			return player.Frame().State.Motors["TestMotor"].Current
+		}
+
+		So(player.Duration(), ShouldEqual, 9*time.Second)
+		So(current(), ShouldEqual, 0)
+
+		Convey("follows the clock", func() {
+			clock.t = clock.t.Add(2500 * time.Millisecond)
+			So(player.Position(), ShouldEqual, 2500*time.Millisecond)
+			So(current(), ShouldEqual, 2)
+		})
+
+		Convey("stops on the last frame", func() {
+			clock.t = clock.t.Add(time.Minute)
+			So(current(), ShouldEqual, 9)
+			So(player.Done(), ShouldBeTrue)
+		})
+
+		Convey("loops back to the start", func() {
+			player.SetLoop(true)
+			clock.t = clock.t.Add(12 * time.Second)
+			So(current(), ShouldEqual, 2)
+			So(player.Done(), ShouldBeFalse)
+		})
+
+		Convey("seeks within the session", func() {
+			So(player.Seek(7*time.Second), ShouldBeNil)
+			So(current(), ShouldEqual, 7)
+			So(player.Seek(10*time.Second), ShouldNotBeNil)
+			So(player.Seek(-time.Second), ShouldNotBeNil)
+		})
+
+		Convey("changes speed without jumping", func() {
+			clock.t = clock.t.Add(2 * time.Second)
+			So(player.SetSpeed(2), ShouldBeNil)
+			So(player.Position(), ShouldEqual, 2*time.Second)
+			clock.t = clock.t.Add(2 * time.Second)
+			So(current(), ShouldEqual, 6)
+			So(player.SetSpeed(0), ShouldNotBeNil)
+		})
+
+		Convey("drives the sensors and motors of a device", func() {
+			config := &DynastatConfig{
+				Version:     2,
+				SensorUnits: UNIT_KPA,
+				Sensors:     map[string]SensorConfig{"TestSensor": {Rows: 2, Cols: 2, Geometry: SensorGeometry{Pitch: DEFAULT_PITCH}}},
+				Motors:      map[string]MotorConfig{"TestMotor": {}},
+			}
+			dynastat, err := NewDynastatReplay(config, player)
+			So(err, ShouldBeNil)
+
+			clock.t = clock.t.Add(3 * time.Second)
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Motors["TestMotor"].Current, ShouldEqual, 3)
+			So(state.Sensors["TestSensor"][0][0], ShouldAlmostEqual, 30*DEFAULT_FULL_SCALE/255.0)
+			So(state.Sensors["TestSensor"][1][1], ShouldAlmostEqual, DEFAULT_FULL_SCALE)
+
+			So(dynastat.SetMotor("TestMotor", 100), ShouldEqual, ErrReplayMotor)
+		})
+	})
+
+	Convey("Creating a player with bad settings", t, func() {
+		frames, _ := ReadSession(strings.NewReader(sessionFile(3)))
+
+		_, err := NewSessionPlayer(frames, ReplayConfig{Speed: -1})
+		So(err, ShouldNotBeNil)
+
+		_, err = NewSessionPlayer(frames, ReplayConfig{Seek: time.Hour})
+		So(err, ShouldNotBeNil)
+
+		_, err = NewSessionPlayer(nil, ReplayConfig{})
+		So(err, ShouldEqual, ErrEmptySession)
+	})
+}
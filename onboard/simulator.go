@@ -3,142 +3,337 @@ package onboard
 import (
 	"errors"
 	"fmt"
-	"math/rand"
+	"math"
+	"sync"
 	"time"
 )
 
-const SENSOR_DELTA = 5
-const SENSOR_INTERVAL = time.Second / 10
+const SENSOR_INTERVAL = time.Second / FRAMERATE
 
-const MOTOR_DELTA = 5
-const MOTOR_INTERVAL = time.Second / 5
+// SIMULATOR_HOME_TIMEOUT is how long a simulated motor searches for its home switch before giving up
+const SIMULATOR_HOME_TIMEOUT = 30 * time.Second
 
+// SimulatedSensor gives the pressure synthesised for the part of the foot it sits under on the plate.
 type SimulatedSensor struct {
-	values     []uint8
+	values     []uint8   // 0-255 application range
+	pressure   []float64 // kPa
 	rows, cols int
+	foot       string
+	geometry   SensorGeometry
+	gait       *GaitSynthesiser
+	address    int // board the sensor is on, for taking it offline
+	faults     *faultInjector
+	seq        uint64 // frames synthesised so far
+	updated    time.Time
+	err        error // why the last frame was missed
+	lock       sync.RWMutex
 }
 
+// SimulatedMotor drives the model of a RMCS-220x motor used by the emulator in raw encoder counts.
+// It is scaled to the application range between its low and high positions in the same way as the real motor and has
+// a limit switch at its home position, so the motors can be calibrated and homed without the hardware.
 type SimulatedMotor struct {
 	name            string
-	current, target int
+	motor           *EmulatedMotor
+	home            emulatedSwitch
+	rawLow, rawHigh int
+	target          int // 0-255 application range
+	faults          *faultInjector
+	lock            sync.Mutex
 }
 
 func (s *SimulatedSensor) SetScale(zero, half, full uint16) {
 	panic("[NotImplemented][SimulatedSensor] SetScale is not implemented nor required on SimulatedSensor")
 }
 
+func (s *SimulatedSensor) SetEqualisation(eq SensorEqualisation) error {
+	return errors.New("[NotImplemented][SimulatedSensor] SetEqualisation is not implemented on SimulatedSensor")
+}
+
+func (s *SimulatedSensor) SetCurve(curve *CalibrationCurve) error {
+	return errors.New("[NotImplemented][SimulatedSensor] SetCurve is not implemented on SimulatedSensor")
+}
+
 func (s *SimulatedSensor) GetValue(row, col int) uint8 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.values[(row*s.cols)+col]
 }
 
-func (s *SimulatedSensor) GetState() (state SensorState) {
+// GetRaw scales the simulated value up to the 12 bit range of the sensor boards.
+func (s *SimulatedSensor) GetRaw(row, col int) uint16 {
+	return uint16(s.GetValue(row, col)) << 4
+}
+
+func (s *SimulatedSensor) GetPressure(row, col int) float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.pressure[(row*s.cols)+col]
+}
+
+func (s *SimulatedSensor) GetState(units PressureUnit) (state SensorState) {
+	var value func(row, col int) float64
+	switch units {
+	case UNIT_RAW:
+		value = func(row, col int) float64 { return float64(s.GetRaw(row, col)) }
+	case UNIT_KPA:
+		value = s.GetPressure
+	default:
+		value = func(row, col int) float64 { return float64(s.GetValue(row, col)) }
+	}
+
 	state = make(SensorState, s.rows)
 	for i := 0; i < s.rows; i++ {
-		state[i] = make([]int, s.cols)
+		state[i] = make([]float64, s.cols)
 		for j := 0; j < s.cols; j++ {
-			if i == j {
-				state[i][j] = 0
-			} else {
-				state[i][j] = int(s.GetValue(i, j))
-			}
+			state[i][j] = value(i, j)
 		}
 	}
 	return state
 }
 
+// synthesise fills in the pressure under each sensel t seconds into the simulation.
+// Values are clamped to the application range rather than being allowed to wrap around.
+// A frame missed because of an injected fault keeps the previous one.
+func (s *SimulatedSensor) synthesise(t float64) {
+	if err := s.faults.boardErr(s.address, time.Now()); err != nil || s.faults.dropFrame() {
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+		return
+	}
+
+	pressure := s.gait.PressureMap(s.foot, t)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for row := 0; row < s.rows; row++ {
+		for col := 0; col < s.cols; col++ {
+			s.pressure[row*s.cols+col] = pressure(s.geometry.PlatePoint(Point{float64(col), float64(row)}))
+		}
+	}
+	s.faults.corrupt(s.pressure)
+	for i, p := range s.pressure {
+		s.values[i] = uint8(math.Min(p*math.MaxUint8/DEFAULT_FULL_SCALE, math.MaxUint8))
+	}
+	s.seq++
+	s.updated = time.Now()
+	s.err = nil
+}
+
+// sample describes the last frame synthesised.
+func (s *SimulatedSensor) sample() Sample {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return Sample{Seq: s.seq, Time: s.updated}
+}
+
+// boardErr gives the address of the board the sensor is on and the error if it is offline.
+func (s *SimulatedSensor) boardErr() (address int, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.address, s.err
+}
+
 func (s *SimulatedSensor) update() {
+	start := time.Now()
 	for {
-		for i := 0; i < len(s.values); i++ {
-			s.values[i] += uint8(rand.Intn(SENSOR_DELTA*2) - SENSOR_DELTA)
-		}
+		s.synthesise(time.Since(start).Seconds())
 		time.Sleep(SENSOR_INTERVAL)
 	}
 }
 
-func NewSimulatedSensor(rows, cols int) (sensor *SimulatedSensor) {
+// NewSimulatedSensor places a sensor with the geometry under the foot and starts synthesising its pressure.
+func NewSimulatedSensor(rows, cols int, foot string, geometry SensorGeometry, gait *GaitSynthesiser) (sensor *SimulatedSensor) {
+	return newSimulatedSensor(rows, cols, foot, geometry, gait, 0, nil)
+}
+
+// newSimulatedSensor places a sensor on the board at the address which fails with the faults.
+func newSimulatedSensor(rows, cols int, foot string, geometry SensorGeometry, gait *GaitSynthesiser,
+	address int, faults *faultInjector) (sensor *SimulatedSensor) {
 	sensor = new(SimulatedSensor)
 	sensor.rows = rows
 	sensor.cols = cols
+	sensor.foot = foot
+	sensor.geometry = geometry
+	sensor.gait = gait
+	sensor.address = address
+	sensor.faults = faults
 	sensor.values = make([]uint8, rows*cols)
+	sensor.pressure = make([]float64, rows*cols)
+	sensor.synthesise(0)
 	go sensor.update()
 	return
 }
 
-func (m *SimulatedMotor) SetTarget(target int) {
-	fmt.Printf("Setting motor %s target to %d\n", m.name, target)
+// NewSimulatedMotor creates a motor at rest at encoder position 0 with its home switch cal encoder counts away.
+// A motor without a range between rawLow and rawHigh works in encoder counts, and a speed of 0 keeps the full speed
+// the motor powers up with.
+func NewSimulatedMotor(name string, cal, rawLow, rawHigh int, speed, damping int32) *SimulatedMotor {
+	return newSimulatedMotor(name, cal, rawLow, rawHigh, speed, damping, nil)
+}
+
+// newSimulatedMotor creates a motor which fails with the faults.
+func newSimulatedMotor(name string, cal, rawLow, rawHigh int, speed, damping int32, faults *faultInjector) *SimulatedMotor {
+	m := &SimulatedMotor{name: name, motor: NewEmulatedMotor(), faults: faults}
+	m.home = emulatedSwitch{m.motor, float64(cal)}
+	m.configure(rawLow, rawHigh, speed, damping)
+	m.target = m.scalePos(0, false)
+	go m.update()
+	return m
+}
+
+// configure sets the range and the speed and damping registers of the motor.
+// It is changed in place once calibrated so it keeps its physical position.
+func (m *SimulatedMotor) configure(rawLow, rawHigh int, speed, damping int32) error {
+	if rawLow == rawHigh {
+		rawLow, rawHigh = 0, 1<<m_BITS
+	}
+	m.lock.Lock()
+	m.rawLow, m.rawHigh = rawLow, rawHigh
+	m.lock.Unlock()
+
+	if speed != 0 {
+		m.motor.put(m_REG_MAX_SPEED, speed)
+	}
+	m.motor.put(m_REG_DAMPING, damping)
+	return nil
+}
+
+// scalePos takes in a value and either scales it up to the encoder range or down to 0-255 application range.
+func (m *SimulatedMotor) scalePos(val int, up bool) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return scaleMotorPos(val, m.rawLow, m.rawHigh, up)
+}
+
+// SetTarget moves the motor to the scaled target, stopping short of it if an injected stall is due.
+func (m *SimulatedMotor) SetTarget(target int) error {
+	m.lock.Lock()
 	m.target = target
-	return
+	m.lock.Unlock()
+
+	raw := m.scalePos(target, true)
+	m.motor.put(m_REG_GOTO, int32(m.faults.stall(int(m.motor.Position()), raw)))
+	return nil
 }
 
 func (m *SimulatedMotor) GetPosition() (position int, err error) {
-	return m.current, nil
+	raw, err := m.getRaw(m_REG_POSITION)
+	if err != nil {
+		return
+	}
+	return m.scalePos(raw, false), nil
 }
 
+// Home finds the home switch and resets the encoder to the calibration value there before going to raw zero,
+// in the same way as the real motor.
 func (m *SimulatedMotor) Home(calibrationValue int) error {
-	fmt.Printf("Homing to %d \n", calibrationValue)
+	if err := m.findHome(calibrationValue < 0); err != nil {
+		return err
+	}
+	m.motor.put(m_REG_POSITION, int32(calibrationValue))
+	m.motor.put(m_REG_GOTO, 0)
 	return nil
 }
 
 func (m *SimulatedMotor) GetState() (state MotorState, err error) {
-	state.Current = m.current
+	m.lock.Lock()
 	state.Target = m.target
-	return state, nil
+	m.lock.Unlock()
+	state.Current, err = m.GetPosition()
+	return
 }
 
 func (m *SimulatedMotor) getRaw(reg uint8) (int, error) {
-	panic("[NotImplemented][SimulatedMotor] getRaw not implemented in SimulatedMotor")
+	if err := m.faults.motorTimeout(); err != nil {
+		return 0, err
+	}
+	value, ok := m.motor.get(reg)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unkown motor register %d", reg))
+	}
+	return int(value), nil
 }
 
-func (m *SimulatedMotor) putRaw(reg uint8, val int) {
-	panic("[NotImplemented][SimulatedMotor] putRaw not implemented in SimulatedMotor")
+func (m *SimulatedMotor) putRaw(reg uint8, val int) error {
+	if !m.motor.put(reg, int32(val)) {
+		return errors.New(fmt.Sprintf("Unkown motor register %d", reg))
+	}
+	return nil
 }
 
-func (m *SimulatedMotor) findHome(reverse bool) error {
-	return errors.New("[NotImplemented][SimulatedMotor] findHome not implemented in SimulatedMotor")
-}
+// findHome moves the motor in small steps until its home switch closes, the same as the real motor.
+func (m *SimulatedMotor) findHome(reverse bool) (err error) {
+	if m.faults.switchesErr() != nil {
+		return errors.New("Control switches not found")
+	}
 
-func (m *SimulatedMotor) update() {
-	for {
-		if m.current != m.target {
-			delta := m.target - m.current
-			// make sure we go in the correct direction and value is less than the const in the respective direction
-			if delta > 0 {
-				if delta > MOTOR_DELTA {
-					delta = MOTOR_DELTA
-				}
-
-			} else {
-				if delta < -MOTOR_DELTA {
-					delta = -MOTOR_DELTA
-				}
-			}
-
-			// apply movement
-			m.current += delta
+	m.lock.Lock()
+	inc := int32(math.Abs(float64(m.rawHigh-m.rawLow))) / 10
+	m.lock.Unlock()
+	if reverse {
+		inc = -inc
+	}
+
+	deadline := time.Now().Add(SIMULATOR_HOME_TIMEOUT)
+	for !m.home.closed() {
+		if time.Now().After(deadline) {
+			err = errors.New(fmt.Sprintf("Home switch of motor %s not found", m.name))
+			break
 		}
+		m.motor.put(m_REG_RELATIVE, inc)
+		time.Sleep(time.Millisecond * 5)
+	}
+	// all stop, even if the search failed
+	m.motor.put(m_REG_MANUAL, 0)
+	return
+}
 
-		time.Sleep(MOTOR_INTERVAL)
+// update moves the motor on, it does not return.
+func (m *SimulatedMotor) update() {
+	ticker := time.NewTicker(EMULATOR_TICK)
+	for range ticker.C {
+		m.motor.step(EMULATOR_TICK)
 	}
 }
 
 func NewDynastatSimulator(config *DynastatConfig) (dynastat *Dynastat) {
+	if err := config.Upgrade(); err != nil {
+		panic(err)
+	}
+
 	dynastat = new(Dynastat)
 	dynastat.config = config
+	if err := dynastat.SetSensorUnits(config.SensorUnits); err != nil {
+		panic(err)
+	}
+
+	gait, err := NewGaitSynthesiser(config.Simulator.GaitConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	faults, err := newFaultInjector(config.Simulator.Faults)
+	if err != nil {
+		panic(err)
+	}
+	if err = faults.switchesErr(); err != nil {
+		dynastat.health.degrade(COMPONENT_SWITCHES, err)
+	}
 
 	switch config.Version {
-	case 1:
+	case 2:
 		// initialise
 		dynastat.Motors = make(map[string]MotorInterface, len(config.Motors))
 		dynastat.sensors = make(map[string]SensorInterface, len(config.Sensors))
 
 		for name, conf := range config.Sensors {
-			dynastat.sensors[name] = NewSimulatedSensor(conf.Rows, conf.Cols)
+			dynastat.sensors[name] = newSimulatedSensor(conf.Rows, conf.Cols, conf.Foot, conf.Geometry, gait, conf.Address, faults)
 		}
 
-		for name := range config.Motors {
-			m := &SimulatedMotor{name: name, target: 127}
-			go m.update()
-			dynastat.Motors[name] = m
+		for name, conf := range config.Motors {
+			dynastat.Motors[name] = newSimulatedMotor(name, conf.Cal, conf.Low, conf.High, conf.Speed, conf.Damping, faults)
 		}
 	default:
 		panic("Unkown version number")
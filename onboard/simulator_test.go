@@ -17,15 +17,19 @@ const (
 
 func TestSimulatedSensor(t *testing.T) {
 	Convey("General simulated sensor", t, func() {
-		sensor := NewSimulatedSensor(rows, cols)
+		gait, _ := NewGaitSynthesiser(GaitConfig{})
+		// under the heel of the left foot
+		sensor := NewSimulatedSensor(rows, cols, "left", SensorGeometry{Pitch: DEFAULT_PITCH, Origin: Point{20, 10}}, gait)
 
 		So(len(sensor.values), ShouldEqual, rows*cols)
 
 		Convey("Values change over time", func() {
+			before := sensor.GetState(UNIT_KPA)
 			time.Sleep(SENSOR_INTERVAL * count) // give the goroutine time to do some changes
+			So(sensor.GetState(UNIT_KPA), ShouldNotResemble, before)
 
 			zeros := 0
-			state := sensor.GetState()
+			state := sensor.GetState(UNIT_SCALED)
 			for r := 0; r < rows; r++ {
 				for c := 0; c < cols; c++ {
 					if state[r][c] == 0 {
@@ -55,50 +59,62 @@ func TestSimulatedSensor(t *testing.T) {
 }
 
 func TestSimulatedMotor(t *testing.T) {
-	motor := &SimulatedMotor{name: "TEST"}
+	Convey("A simulated motor scaled over 2550 encoder counts", t, func() {
+		motor := NewSimulatedMotor("TEST", 300, 0, 2550, 255, 0)
+
+		Convey("starts at rest at raw zero", func() {
+			state, err := motor.GetState()
+			So(err, ShouldBeNil)
+			So(state.Target, ShouldEqual, 0)
+			So(state.Current, ShouldEqual, 0)
+		})
 
-	Convey("GetPosition returns current value", t, func() {
-		motor.current = 42
-		pos, _ := motor.GetPosition()
-		So(pos, ShouldEqual, 42)
-	})
+		Convey("moves to the scaled target", func() {
+			So(motor.SetTarget(128), ShouldBeNil)
+			So(waitForPosition(motor, 128, time.Second), ShouldEqual, 128)
 
-	Convey("SetTarget updates correctly", t, func() {
-		motor.SetTarget(42)
-		So(motor.target, ShouldEqual, 42)
-	})
+			raw, err := motor.getRaw(m_REG_POSITION)
+			So(err, ShouldBeNil)
+			So(raw, ShouldEqual, 1275)
 
-	Convey("GetState gives the correct values in the state object", t, func() {
-		motor.target = 12
-		motor.current = 24
-		state, err := motor.GetState()
-		So(err, ShouldBeNil)
-		So(state.Target, ShouldEqual, 12)
-		So(state.Current, ShouldEqual, 24)
-	})
+			state, _ := motor.GetState()
+			So(state.Target, ShouldEqual, 128)
+		})
 
-	Convey("Updater moves towards the target", t, func() {
-		motor.current = 0
-		motor.target = 255
-		go motor.update()
+		Convey("moves no faster than its max speed", func() {
+			So(motor.putRaw(m_REG_MAX_SPEED, 1), ShouldBeNil)
+			So(motor.SetTarget(255), ShouldBeNil)
+			time.Sleep(EMULATOR_TICK * 10)
+			raw, _ := motor.getRaw(m_REG_POSITION)
+			So(raw, ShouldBeBetweenOrEqual, 1, EMULATOR_SPEED_SCALE)
+		})
 
-		time.Sleep(MOTOR_INTERVAL * count)
-		So(motor.current, ShouldBeBetweenOrEqual, MOTOR_DELTA*(count-1), MOTOR_DELTA*(count+1))
+		Convey("writes raw registers", func() {
+			So(motor.putRaw(m_REG_GOTO, 500), ShouldBeNil)
+			raw, _ := motor.getRaw(m_REG_POSITION)
+			for start := time.Now(); raw != 500 && time.Since(start) < time.Second; raw, _ = motor.getRaw(m_REG_POSITION) {
+				time.Sleep(EMULATOR_TICK)
+			}
+			So(raw, ShouldEqual, 500)
 
-		Convey("Test in reverse", func() {
-			motor.current = 255
-			motor.target = 0
+			// resetting the encoder does not move the motor
+			So(motor.putRaw(m_REG_POSITION, 0), ShouldBeNil)
+			raw, _ = motor.getRaw(m_REG_POSITION)
+			So(raw, ShouldEqual, 0)
+			So(motor.motor.physical(), ShouldAlmostEqual, 500, 1)
 
-			time.Sleep(MOTOR_INTERVAL * count)
-			So(motor.current, ShouldBeBetweenOrEqual, 255-MOTOR_DELTA*(count-1), 255-MOTOR_DELTA*(count+1))
+			So(motor.putRaw(42, 1), ShouldNotBeNil)
+			_, err := motor.getRaw(42)
+			So(err, ShouldNotBeNil)
 		})
-	})
 
-	Convey("Not implemented methods panic correctly", t, func() {
-		So(func() { motor.getRaw(4) }, ShouldPanic)
-		So(func() { motor.putRaw(4, 28) }, ShouldPanic)
-		err := motor.findHome(true)
-		So(err, ShouldNotBeNil)
+		Convey("homes on its limit switch", func() {
+			So(motor.Home(300), ShouldBeNil)
+
+			// the encoder read the calibration value at the switch, so raw zero is just past where it powered up
+			So(waitForPosition(motor, 0, time.Second), ShouldEqual, 0)
+			So(motor.motor.physical(), ShouldBeBetweenOrEqual, 0, 255)
+		})
 	})
 }
 
@@ -135,11 +151,20 @@ sensors:
 
 			motor := dynastat.Motors["TESTM"]
 			pos, _ := motor.GetPosition()
-			target := pos + MOTOR_DELTA*count
+			target := pos + 10*count
 			motor.SetTarget(target)
-			time.Sleep(MOTOR_INTERVAL * (count + 1))
-			pos, _ = motor.GetPosition()
-			So(pos, ShouldEqual, target)
+			So(waitForPosition(motor, target, time.Second), ShouldEqual, target)
+		})
+
+		Convey("Motors can be calibrated", func() {
+			So(dynastat.GotoMotorRaw("TESTM", 100), ShouldBeNil)
+			So(waitForPosition(dynastat.Motors["TESTM"], 100, time.Second), ShouldEqual, 100)
+			So(dynastat.RecordMotorHigh("TESTM"), ShouldBeNil)
+			So(config.Motors["TESTM"].High, ShouldEqual, 100)
+
+			// the full range now covers the 100 encoder counts
+			pos, _ := dynastat.Motors["TESTM"].GetPosition()
+			So(pos, ShouldEqual, 256)
 		})
 	})
 
@@ -0,0 +1,199 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// TARE_FRAMES is the number of frames averaged to build the baseline of a sensor board
+	TARE_FRAMES = FRAMERATE
+	// DEFAULT_TARE_IDLE is the time the plate must be unloaded before an automatic re-tare when none is configured
+	DEFAULT_TARE_IDLE = 5 * time.Minute
+	// DEFAULT_TARE_THRESHOLD is the pressure in kPa above which a sensel is treated as loaded when none is configured
+	DEFAULT_TARE_THRESHOLD = 5
+	// tare_CHECK_INTERVAL is how often the plate is checked for a foot while waiting to re-tare
+	tare_CHECK_INTERVAL = time.Second
+)
+
+// TareConfig controls the automatic re-tare of the sensor boards.
+// When Auto is set the boards are tared again whenever no sensel has gone over Threshold (kPa) for IdleTime.
+type TareConfig struct {
+	Auto      bool
+	IdleTime  time.Duration
+	Threshold float64
+}
+
+// Tare averages the new frames read from the board while the plate is unloaded and stores them as the baseline for
+// each register. Sensors on the board use the baseline in place of their zero value and offsets until the tare is
+// cleared. Each frame is only counted once however slowly the board is read, and as many as arrive in twice the time
+// the board should take to give them are used. The baseline is left as it was if no new frames arrive.
+func (sb *SensorBoard) Tare(frames int) error {
+	sb.lock.RLock()
+	rate := sb.rate
+	sb.lock.RUnlock()
+	if rate <= 0 {
+		rate = FRAMERATE
+	}
+
+	interval := time.Second / time.Duration(rate)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	deadline := time.Now().Add(2 * time.Duration(frames) * interval)
+
+	sum := make([]float64, sb_ROWS*sb_COLS)
+	seq := sb.Frame().Seq
+	var count int
+	for count < frames && time.Now().Before(deadline) {
+		<-ticker.C
+		frame := sb.Frame()
+		if frame.Seq == seq {
+			continue
+		}
+		seq = frame.Seq
+		for i := range sum {
+			sum[i] += float64(frame.values[i])
+		}
+		count++
+	}
+	if count == 0 {
+		return errors.New(fmt.Sprintf("No new frames from sensor board 0x%x to tare", sb.address))
+	}
+
+	for i := range sum {
+		sum[i] /= float64(count)
+	}
+
+	sb.lock.Lock()
+	sb.baseline = sum
+	sb.lock.Unlock()
+	return nil
+}
+
+// ClearTare removes the baseline so sensors return to their configured zero value.
+func (sb *SensorBoard) ClearTare() {
+	sb.lock.Lock()
+	sb.baseline = nil
+	sb.lock.Unlock()
+}
+
+// getBaseline returns the tared value for the register, ok is false if the board has not been tared.
+func (sb *SensorBoard) getBaseline(reg int) (value float64, ok bool) {
+	sb.lock.RLock()
+	defer sb.lock.RUnlock()
+	if sb.baseline == nil {
+		return 0, false
+	}
+	return sb.baseline[reg], true
+}
+
+// Tare captures a new baseline on every sensor board at once. The plate must be unloaded.
+func (d *Dynastat) Tare() error {
+	if len(d.boards) == 0 {
+		return errors.New("No sensor boards to tare")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(d.boards))
+	for _, board := range d.boards {
+		wg.Add(1)
+		go func(board *SensorBoard) {
+			defer wg.Done()
+			errs <- board.Tare(TARE_FRAMES)
+		}(board)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	d.lock.Lock()
+	d.tared = time.Now()
+	d.lock.Unlock()
+	return nil
+}
+
+// ClearTare returns every sensor board to its configured zero values.
+func (d *Dynastat) ClearTare() {
+	for _, board := range d.boards {
+		board.ClearTare()
+	}
+
+	d.lock.Lock()
+	d.tared = time.Time{}
+	d.lock.Unlock()
+}
+
+// loaded reports if any sensel on the plate is over the threshold in kPa.
+// The device is locked so the sensors are not recalibrated part way through.
+func (d *Dynastat) loaded(threshold float64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for name, sensor := range d.sensors {
+		conf := d.config.Sensors[name]
+		for row := 0; row < conf.Rows; row++ {
+			for col := 0; col < conf.Cols; col++ {
+				if sensor.GetPressure(row, col) > threshold {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// autoTare watches the plate and re-tares the boards each time it has been unloaded for the configured idle time.
+// The plate is tared once it first becomes idle and again after each further idle period without a foot on it.
+// It returns once done is closed.
+func (d *Dynastat) autoTare(conf TareConfig, done <-chan struct{}) {
+	if conf.IdleTime <= 0 {
+		conf.IdleTime = DEFAULT_TARE_IDLE
+	}
+	if conf.Threshold <= 0 {
+		conf.Threshold = DEFAULT_TARE_THRESHOLD
+	}
+
+	ticker := time.NewTicker(tare_CHECK_INTERVAL)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		now := time.Now()
+		if d.loaded(conf.Threshold) {
+			idleSince = now
+			continue
+		}
+
+		d.lock.Lock()
+		tared := d.tared
+		d.lock.Unlock()
+
+		if now.Sub(idleSince) >= conf.IdleTime && now.Sub(tared) >= conf.IdleTime {
+			if err := d.Tare(); err != nil {
+				fmt.Printf("Unable to re-tare: %v\n", err)
+			}
+		}
+	}
+}
+
+// StopAutoTare stops the automatic re-tare of the boards if it is running.
+func (d *Dynastat) StopAutoTare() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.tareDone != nil {
+		close(d.tareDone)
+		d.tareDone = nil
+	}
+}
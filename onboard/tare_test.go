@@ -0,0 +1,94 @@
+package onboard
+
+import (
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestTare(t *testing.T) {
+	Convey("Taring a sensor board", t, func() {
+		msb := &MockI2CSensorBoard{data: make([]byte, sb_ROWS*sb_COLS*2)}
+		sb := NewSensorBoard(msb, 0)
+		sensor, _ := NewSensor(sb, 1, false, 2, 2, 100, 2047, 4095, 0)
+		dynastat := &Dynastat{
+			sensors: map[string]SensorInterface{"TestSensor": sensor},
+			boards:  map[int]*SensorBoard{0: sb},
+			config:  &DynastatConfig{Sensors: map[string]SensorConfig{"TestSensor": {Rows: 2, Cols: 2}}},
+		}
+		sb.SetSampleRate(MAX_SAMPLE_RATE)
+		fill := func(val uint16) {
+			for i := 0; i < sb_ROWS*sb_COLS; i++ {
+				binary.BigEndian.PutUint16(msb.data[i*2:], val)
+			}
+			sb.read()
+		}
+
+		// the baseline has drifted above the configured zero value
+		fill(300)
+		So(sensor.GetPressure(0, 0), ShouldBeGreaterThan, 0)
+		So(dynastat.loaded(DEFAULT_TARE_THRESHOLD), ShouldBeTrue)
+
+		Convey("fails without new frames from the boards", func() {
+			So(dynastat.Tare(), ShouldNotBeNil)
+			So(dynastat.tared.IsZero(), ShouldBeTrue)
+		})
+
+		// the boards are read at a quarter of their rate
+		done, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			ticker := time.NewTicker(4 * time.Second / MAX_SAMPLE_RATE)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					sb.read()
+				case <-done:
+					return
+				}
+			}
+		}()
+		So(dynastat.Tare(), ShouldBeNil)
+		close(done)
+		<-stopped
+		So(dynastat.tared.IsZero(), ShouldBeFalse)
+		So(sensor.GetPressure(0, 0), ShouldEqual, 0)
+		So(sensor.GetRaw(0, 0), ShouldEqual, 300)
+		So(dynastat.loaded(DEFAULT_TARE_THRESHOLD), ShouldBeFalse)
+
+		Convey("later readings have the baseline removed", func() {
+			fill(1300)
+			So(sensor.counts(sb.Frame(), 1, 1), ShouldAlmostEqual, 1000, kScaleTolerance)
+		})
+
+		Convey("clearing the tare returns to the zero value", func() {
+			dynastat.ClearTare()
+			So(dynastat.tared.IsZero(), ShouldBeTrue)
+			So(sensor.counts(sb.Frame(), 0, 0), ShouldAlmostEqual, 200, kScaleTolerance)
+		})
+	})
+
+	Convey("The automatic re-tare can be stopped", t, func() {
+		done := make(chan struct{})
+		dynastat := &Dynastat{tareDone: done}
+		stopped := make(chan struct{})
+		go func() {
+			dynastat.autoTare(TareConfig{Auto: true}, done)
+			close(stopped)
+		}()
+
+		dynastat.StopAutoTare()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("automatic re-tare still running")
+		}
+		dynastat.StopAutoTare()
+	})
+
+	Convey("Taring without any sensor boards fails", t, func() {
+		So(new(Dynastat).Tare(), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Coded Internet Ltd. All rights reserved.
+
+package onboard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MotorUnit maps the 0-255 application range of a motor onto a physical unit such as degrees of tilt, mm of foot
+// length or shoe size. Low and High are the physical positions at either end of the full scale of the motor, either way
+// round, with the positions in between taken as linear. As with the raw range of the motor, High is at 256 so the top
+// position of 255 is one step short of it.
+type MotorUnit struct {
+	Low, High float64
+}
+
+// MotorUnitState is the target and current position of a motor in a physical unit.
+type MotorUnitState struct {
+	Target, Current float64
+}
+
+// MotorPosition is a position for a motor in one of its configured units.
+type MotorPosition struct {
+	Value float64
+	Unit  string
+}
+
+// toUnit converts a position in the application range into the unit.
+func (u MotorUnit) toUnit(position int) float64 {
+	return u.Low + (u.High-u.Low)*float64(position)/(1<<m_BITS)
+}
+
+// fromUnit converts a position in the unit into the nearest position in the application range.
+// Anything up to High is allowed, with the last step up to it given as the top position.
+func (u MotorUnit) fromUnit(value float64) (int, error) {
+	if u.Low == u.High {
+		return 0, errors.New("Unit covers no range")
+	}
+	position := math.Floor((value-u.Low)*(1<<m_BITS)/(u.High-u.Low) + 0.5)
+	if position < 0 || position > 1<<m_BITS {
+		return 0, errors.New(fmt.Sprintf("%v is outside of %v to %v", value, u.Low, u.High))
+	}
+	return int(math.Min(position, math.MaxUint8)), nil
+}
+
+// motorUnit finds a unit configured for the motor.
+func (d *Dynastat) motorUnit(name, unit string) (MotorUnit, error) {
+	if _, ok := d.Motors[name]; !ok {
+		return MotorUnit{}, errors.New(fmt.Sprintf("Unkown motor %s", name))
+	}
+	if d.config != nil {
+		if u, ok := d.config.Motors[name].Units[unit]; ok {
+			return u, nil
+		}
+	}
+	return MotorUnit{}, errors.New(fmt.Sprintf("Unkown unit %s for motor %s", unit, name))
+}
+
+// motorUnits gives the target and current position of a motor in each of its configured units, nil if it has none.
+func (d *Dynastat) motorUnits(name string, state MotorState) map[string]MotorUnitState {
+	if d.config == nil || len(d.config.Motors[name].Units) == 0 {
+		return nil
+	}
+	units := make(map[string]MotorUnitState, len(d.config.Motors[name].Units))
+	for unit, u := range d.config.Motors[name].Units {
+		units[unit] = MotorUnitState{Target: u.toUnit(state.Target), Current: u.toUnit(state.Current)}
+	}
+	return units
+}
+
+// MotorToUnits converts a position in the application range of a motor into one of its units.
+func (d *Dynastat) MotorToUnits(name, unit string, position int) (float64, error) {
+	u, err := d.motorUnit(name, unit)
+	if err != nil {
+		return 0, err
+	}
+	return u.toUnit(position), nil
+}
+
+// MotorFromUnits converts a position in one of the units of a motor into its application range.
+func (d *Dynastat) MotorFromUnits(name string, position MotorPosition) (int, error) {
+	u, err := d.motorUnit(name, position.Unit)
+	if err != nil {
+		return 0, err
+	}
+	target, err := u.fromUnit(position.Value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Position %s for motor %s: %v", position.Unit, name, err))
+	}
+	return target, nil
+}
+
+// MotorTargets converts physical positions for several motors into targets in the application range for MoveMotors.
+// Nothing is converted if any of the positions can not be.
+func (d *Dynastat) MotorTargets(positions map[string]MotorPosition) (targets map[string]int, err error) {
+	targets = make(map[string]int, len(positions))
+	for name, position := range positions {
+		if targets[name], err = d.MotorFromUnits(name, position); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// SetMotorPosition sets a motor to a position in one of its units.
+func (d *Dynastat) SetMotorPosition(name string, position MotorPosition) error {
+	target, err := d.MotorFromUnits(name, position)
+	if err != nil {
+		return err
+	}
+	return d.SetMotor(name, target)
+}
@@ -0,0 +1,102 @@
+package onboard
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+func TestMotorUnit(t *testing.T) {
+	Convey("Converting between the application range and a unit", t, func() {
+		u := MotorUnit{Low: -15, High: 15}
+		So(u.toUnit(0), ShouldEqual, -15)
+		So(u.toUnit(128), ShouldEqual, 0)
+		So(u.toUnit(255), ShouldAlmostEqual, 15-30.0/256)
+		So(u.toUnit(51), ShouldAlmostEqual, -9, 30.0/256)
+
+		position, err := u.fromUnit(0)
+		So(err, ShouldBeNil)
+		So(position, ShouldEqual, 128)
+		position, err = u.fromUnit(-9)
+		So(err, ShouldBeNil)
+		So(position, ShouldEqual, 51)
+
+		Convey("on the same full scale as the raw range of the motor", func() {
+			So(u.toUnit(1<<m_BITS), ShouldEqual, 15)
+			So(scaleMotorPos(128, -1000, 1000, true), ShouldEqual, 0)
+			position, err := u.fromUnit(15)
+			So(err, ShouldBeNil)
+			So(position, ShouldEqual, 255)
+		})
+
+		Convey("works either way round", func() {
+			u := MotorUnit{Low: 300, High: 220}
+			position, err := u.fromUnit(300)
+			So(err, ShouldBeNil)
+			So(position, ShouldEqual, 0)
+			So(u.toUnit(1<<m_BITS), ShouldEqual, 220)
+		})
+
+		Convey("rejects positions out of range", func() {
+			_, err := u.fromUnit(16)
+			So(err, ShouldNotBeNil)
+			_, err = MotorUnit{}.fromUnit(0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMotorUnits(t *testing.T) {
+	var config DynastatConfig
+	err := yaml.Unmarshal([]byte(`
+version: 2
+motors:
+  TestMotor:
+    units:
+      deg: {low: -15, high: 15}
+  TestSize:
+    units:
+      mm: {low: 220, high: 310}
+      uk: {low: 3, high: 12}
+`), &config)
+	if err != nil {
+		panic(err)
+	}
+	dynastat := NewDynastatSimulator(&config)
+
+	Convey("Units are read from the motor config", t, func() {
+		So(config.Motors["TestMotor"].Units["deg"], ShouldResemble, MotorUnit{Low: -15, High: 15})
+		So(config.Motors["TestSize"].Units, ShouldHaveLength, 2)
+	})
+
+	Convey("Motors can be set in physical units", t, func() {
+		err := dynastat.SetMotorPosition("TestMotor", MotorPosition{Value: 0, Unit: "deg"})
+		So(err, ShouldBeNil)
+		So(dynastat.Motors["TestMotor"].(*SimulatedMotor).target, ShouldEqual, 128)
+
+		Convey("and are reported in them", func() {
+			state, err := dynastat.GetState()
+			So(err, ShouldBeNil)
+			So(state.Motors["TestMotor"].Units["deg"].Target, ShouldAlmostEqual, 0, 0.1)
+			So(state.Motors["TestSize"].Units, ShouldContainKey, "uk")
+			So(state.Motors["TestSize"].Units, ShouldContainKey, "mm")
+		})
+
+		Convey("but only in their own units", func() {
+			So(dynastat.SetMotorPosition("TestMotor", MotorPosition{Value: 250, Unit: "mm"}), ShouldNotBeNil)
+			So(dynastat.SetMotorPosition("missing", MotorPosition{Value: 0, Unit: "deg"}), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Moves can be given in physical units", t, func() {
+		targets, err := dynastat.MotorTargets(map[string]MotorPosition{
+			"TestMotor": {Value: 15, Unit: "deg"},
+			"TestSize":  {Value: 3, Unit: "uk"},
+		})
+		So(err, ShouldBeNil)
+		So(targets, ShouldResemble, map[string]int{"TestMotor": 255, "TestSize": 0})
+
+		_, err = dynastat.MotorTargets(map[string]MotorPosition{"TestSize": {Value: 13, Unit: "uk"}})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"github.com/CodedInternet/godynastat/comms"
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//---
+// Foot postures
+//---
+
+// PosturePayload names a posture and sets the 0-255 application range positions of any of the motors in it.
+type PosturePayload struct {
+	Name      string         `json:"name"`
+	Positions map[string]int `json:"positions"`
+}
+
+func (p *PosturePayload) Bind(r *http.Request) error {
+	if p.Name == "" {
+		return errors.New("Posture must have a name")
+	}
+	if len(p.Positions) == 0 {
+		return errors.New("Posture must position at least one motor")
+	}
+	return nil
+}
+
+// CapturePayload names a posture taken from the current motor positions.
+type CapturePayload struct {
+	Name string `json:"name"`
+}
+
+func (p *CapturePayload) Bind(r *http.Request) error {
+	if p.Name == "" {
+		return errors.New("Posture must have a name")
+	}
+	return nil
+}
+
+// ApplyPosturePayload moves the motors into a posture together, as for MoveMotorsPayload.
+type ApplyPosturePayload struct {
+	Tolerance int  `json:"tolerance"`
+	Timeout   int  `json:"timeout"`
+	Wait      bool `json:"wait"`
+}
+
+func (p *ApplyPosturePayload) Bind(r *http.Request) error {
+	if p.Tolerance < 0 || p.Timeout < 0 {
+		return errors.New("Tolerance and timeout must not be negative")
+	}
+	return nil
+}
+
+// postureID parses the posture id from the url
+func postureID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "postureID"))
+	if err != nil {
+		return 0, errors.New("Invalid posture id")
+	}
+	return id, nil
+}
+
+// renderPostureErr reports a missing posture as not found, a posture which can not be stored as given as an invalid
+// request, a capture without any motors to read as unavailable and anything else as a failure to render
+func renderPostureErr(w http.ResponseWriter, r *http.Request, err error) {
+	if err == storm.ErrNotFound {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+	if _, ok := err.(comms.InvalidPostureError); ok || err == comms.ErrPostureExists {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err == comms.ErrNoMotorsRead {
+		render.Render(w, r, ErrUnavailable(err))
+		return
+	}
+	render.Render(w, r, ErrRender(err))
+}
+
+// ListPostures returns all of the stored postures
+func ListPostures(w http.ResponseWriter, r *http.Request) {
+	postures, err := ENV.Conductor.Postures.Postures()
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	if postures == nil {
+		postures = []comms.Posture{}
+	}
+	render.JSON(w, r, postures)
+}
+
+// GetPosture returns a single stored posture
+func GetPosture(w http.ResponseWriter, r *http.Request) {
+	id, err := postureID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	posture, err := ENV.Conductor.Postures.Posture(id)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.JSON(w, r, posture)
+}
+
+// CreatePosture stores a new posture
+func CreatePosture(w http.ResponseWriter, r *http.Request) {
+	data := &PosturePayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	posture, err := ENV.Conductor.Postures.Create(data.Name, data.Positions)
+	if err != nil {
+		renderPostureErr(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, posture)
+}
+
+// CapturePosture stores the current position of every motor as a new posture
+func CapturePosture(w http.ResponseWriter, r *http.Request) {
+	data := &CapturePayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	posture, err := ENV.Conductor.Postures.Capture(data.Name)
+	if err != nil {
+		renderPostureErr(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, posture)
+}
+
+// UpdatePosture replaces the name and positions of a stored posture
+func UpdatePosture(w http.ResponseWriter, r *http.Request) {
+	id, err := postureID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	data := &PosturePayload{}
+	if err = render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	posture, err := ENV.Conductor.Postures.Update(id, data.Name, data.Positions)
+	if err != nil {
+		renderPostureErr(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, posture)
+}
+
+// DeletePosture removes a stored posture
+func DeletePosture(w http.ResponseWriter, r *http.Request) {
+	id, err := postureID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err = ENV.Conductor.Postures.Delete(id); err != nil {
+		renderPostureErr(w, r, err)
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// ApplyPosture moves the motors into a stored posture together and reports the progress of the move
+func ApplyPosture(w http.ResponseWriter, r *http.Request) {
+	id, err := postureID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	data := &ApplyPosturePayload{}
+	if r.ContentLength != 0 {
+		if err = render.Bind(r, data); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	move, err := ENV.Conductor.Postures.Apply(id, data.Tolerance, time.Duration(data.Timeout)*time.Millisecond)
+	if err == storm.ErrNotFound {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+	renderMove(w, r, move, err, data.Wait)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	. "github.com/CodedInternet/godynastat/onboard"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+//---
+// Sensor layout
+//---
+
+// SensorLayout payload describing the physical layout of a sensor
+type SensorLayout struct {
+	Rows     int            `json:"rows"`
+	Cols     int            `json:"cols"`
+	Foot     string         `json:"foot"`
+	Geometry SensorGeometry `json:"geometry"`
+}
+
+// SensorCalibration payload describing how a sensor converts counts to pressure
+type SensorCalibration struct {
+	ZeroValue   uint16             `json:"zero_value"`
+	HalfValue   uint16             `json:"half_value"`
+	FullValue   uint16             `json:"full_value"`
+	FullScale   float64            `json:"full_scale"`
+	Curve       *CalibrationCurve  `json:"curve,omitempty"`
+	Calibration *CalibrationRecord `json:"calibration,omitempty"`
+}
+
+// CalibrationStartPayload selects the curve fitted by a known mass calibration.
+// Area is the contact area of the masses in mm², leave as 0 to use the area of the loaded sensels.
+type CalibrationStartPayload struct {
+	Type   CurveType `json:"type"`
+	Degree int       `json:"degree"`
+	Area   float64   `json:"area"`
+}
+
+func (p *CalibrationStartPayload) Bind(r *http.Request) error {
+	return nil
+}
+
+// CalibrationStepPayload is the mass in kg placed on the sensor
+type CalibrationStepPayload struct {
+	Mass float64 `json:"mass"`
+}
+
+func (p *CalibrationStepPayload) Bind(r *http.Request) error {
+	if p.Mass <= 0 {
+		return errors.New("Mass must be greater than 0")
+	}
+	return nil
+}
+
+// CalibrationZeroPayload reports the zero value captured at the start of a calibration
+type CalibrationZeroPayload struct {
+	ZeroValue uint16 `json:"zero_value"`
+}
+
+// ListSensors returns the layout of every sensor on the plate
+func ListSensors(w http.ResponseWriter, r *http.Request) {
+	config := ENV.Conductor.Device.GetConfig()
+
+	layouts := make(map[string]SensorLayout, len(config.Sensors))
+	for name, conf := range config.Sensors {
+		layouts[name] = SensorLayout{
+			Rows:     conf.Rows,
+			Cols:     conf.Cols,
+			Foot:     conf.Foot,
+			Geometry: conf.Geometry,
+		}
+	}
+
+	render.JSON(w, r, layouts)
+}
+
+// PlateCoordinate maps the row and col query params on a sensor to a position on the plate in mm
+func PlateCoordinate(w http.ResponseWriter, r *http.Request) {
+	row, err := strconv.Atoi(r.URL.Query().Get("row"))
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(errors.New("Invalid row")))
+		return
+	}
+	col, err := strconv.Atoi(r.URL.Query().Get("col"))
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(errors.New("Invalid col")))
+		return
+	}
+
+	point, err := ENV.Conductor.Device.PlateCoordinate(chi.URLParam(r, "sensor"), row, col)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.JSON(w, r, point)
+}
+
+// GetSensorCalibration returns the calibration of a sensor, including the fit quality of any calibration curve
+func GetSensorCalibration(w http.ResponseWriter, r *http.Request) {
+	conf, ok := ENV.Conductor.Device.GetConfig().Sensors[chi.URLParam(r, "sensor")]
+	if !ok {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+
+	render.JSON(w, r, SensorCalibration{
+		ZeroValue:   conf.ZeroValue,
+		HalfValue:   conf.HalfValue,
+		FullValue:   conf.FullValue,
+		FullScale:   conf.FullScale,
+		Curve:       conf.Curve,
+		Calibration: conf.Calibration,
+	})
+}
+
+// SensorCalibrations handles the sensor calibration in progress through the API, only one sensor may be calibrated at a
+// time
+type SensorCalibrations struct {
+	calibrator *SensorCalibrator
+	lock       sync.Mutex
+}
+
+// active returns the calibration in progress on the sensor in the url
+func (s *SensorCalibrations) active(r *http.Request) (*SensorCalibrator, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.calibrator == nil || s.calibrator.Name != chi.URLParam(r, "sensor") {
+		return nil, errors.New("Sensor is not being calibrated")
+	}
+	return s.calibrator, nil
+}
+
+// set replaces the calibration in progress, nil once it is finished or abandoned
+func (s *SensorCalibrations) set(c *SensorCalibrator) {
+	s.lock.Lock()
+	s.calibrator = c
+	s.lock.Unlock()
+}
+
+// StartSensorCalibration begins a known mass calibration and captures the zero value.
+// The sensor must be unloaded when this is called.
+func (s *SensorCalibrations) StartSensorCalibration(w http.ResponseWriter, r *http.Request) {
+	data := &CalibrationStartPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	c, err := ENV.Conductor.Device.NewSensorCalibrator(chi.URLParam(r, "sensor"), data.Type, data.Degree, data.Area)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	s.set(c)
+
+	render.JSON(w, r, CalibrationZeroPayload{c.CaptureZero()})
+}
+
+// CaptureCalibrationStep records the response of the sensor to the mass now placed on it
+func (s *SensorCalibrations) CaptureCalibrationStep(w http.ResponseWriter, r *http.Request) {
+	c, err := s.active(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	data := &CalibrationStepPayload{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	step, err := c.CaptureStep(data.Mass)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.JSON(w, r, step)
+}
+
+// FinishSensorCalibration fits the calibration to the captured masses and saves it to the config
+func (s *SensorCalibrations) FinishSensorCalibration(w http.ResponseWriter, r *http.Request) {
+	c, err := s.active(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if _, _, err = c.Finish(); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	s.set(nil)
+
+	if err = saveConfig(ENV.Conductor.Device); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	GetSensorCalibration(w, r)
+}
+
+// CancelSensorCalibration abandons the calibration in progress, leaving the sensor as it was
+func (s *SensorCalibrations) CancelSensorCalibration(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.active(r); err != nil {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+
+	s.set(nil)
+
+	render.NoContent(w, r)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+)
+
+//---
+// Recorded sessions
+//---
+
+// sessionID parses the session id from the url
+func sessionID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	if err != nil {
+		return 0, errors.New("Invalid session id")
+	}
+	return id, nil
+}
+
+// ListSessions returns all of the recorded sessions
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := ENV.Conductor.Recorder.Sessions()
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.JSON(w, r, sessions)
+}
+
+// GetSession returns the details of a single recorded session
+func GetSession(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	session, err := ENV.Conductor.Recorder.Session(id)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	render.JSON(w, r, session)
+}
+
+// DeleteSession removes a recorded session and all of its frames
+func DeleteSession(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err = ENV.Conductor.Recorder.Delete(id); err != nil {
+		if err == storm.ErrNotFound {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	render.NoContent(w, r)
+}
+
+// ExportSession downloads a recorded session as a session file which can be played back with -sim-mode replay
+func ExportSession(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionID(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if _, err = ENV.Conductor.Recorder.Session(id); err != nil {
+		if err == storm.ErrNotFound {
+			render.Render(w, r, ErrNotFound)
+			return
+		}
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"session-%d.jsonl\"", id))
+	if err = ENV.Conductor.Recorder.Export(id, w); err != nil {
+		// the headers have already gone so all that can be done is to cut the download short
+		fmt.Printf("Unable to export session %d: %v\n", id, err)
+	}
+}